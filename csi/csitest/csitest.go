@@ -0,0 +1,184 @@
+// Package csitest is a CSI client and a set of sanity checks that exercise a
+// node plugin over its unix socket, the way a container orchestrator would,
+// without a cluster.
+package csitest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/rancher/secrets-bridge-v2/csi"
+	"golang.org/x/net/http2"
+)
+
+// Client makes unary gRPC calls to a plugin on a unix socket.
+type Client struct {
+	client *http.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Call invokes method, e.g. /csi.v1.Node/NodeGetInfo, a non OK status is
+// returned as a *csi.Error.
+func (c *Client) Call(method string, req []byte) ([]byte, error) {
+	body := &bytes.Buffer{}
+	if err := csi.WriteMessage(body, req); err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", "http://csi"+method, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		return nil, csi.Errorf(csi.CodeInternal, "missing grpc status, http status: %d", resp.StatusCode)
+	}
+	if code != csi.CodeOK {
+		return nil, csi.Errorf(code, "%s", csi.DecodeStatusMessage(resp.Trailer.Get("Grpc-Message")))
+	}
+
+	return csi.ReadMessage(bytes.NewReader(content))
+}
+
+// Sanity runs the identity and node checks against the plugin on socket.
+// Volumes are published with volumeContext under a temporary directory.
+func Sanity(t *testing.T, socket string, volumeContext map[string]string) {
+	c := NewClient(socket)
+
+	t.Run("GetPluginInfo", func(t *testing.T) {
+		resp, err := c.Call("/csi.v1.Identity/GetPluginInfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &csi.PluginInfo{}
+		if err := info.Unmarshal(resp); err != nil {
+			t.Fatal(err)
+		}
+		if info.Name == "" || info.VendorVersion == "" {
+			t.Errorf("plugin name and version must be set: %#v", info)
+		}
+	})
+
+	t.Run("Probe", func(t *testing.T) {
+		resp, err := c.Call("/csi.v1.Identity/Probe", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe := &csi.ProbeResponse{}
+		if err := probe.Unmarshal(resp); err != nil || !probe.Ready {
+			t.Errorf("plugin is not ready: %v", err)
+		}
+	})
+
+	t.Run("GetCapabilities", func(t *testing.T) {
+		for _, method := range []string{"/csi.v1.Identity/GetPluginCapabilities", "/csi.v1.Node/NodeGetCapabilities"} {
+			if _, err := c.Call(method, nil); err != nil {
+				t.Errorf("%s failed: %s", method, err)
+			}
+		}
+	})
+
+	t.Run("NodeGetInfo", func(t *testing.T) {
+		resp, err := c.Call("/csi.v1.Node/NodeGetInfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &csi.NodeInfo{}
+		if err := info.Unmarshal(resp); err != nil || info.NodeID == "" {
+			t.Errorf("node id must be set: %v", err)
+		}
+	})
+
+	t.Run("Unimplemented", func(t *testing.T) {
+		_, err := c.Call("/csi.v1.Controller/CreateVolume", nil)
+		expectCode(t, err, csi.CodeUnimplemented)
+	})
+
+	target := path.Join(t.TempDir(), "target")
+	capability := &csi.VolumeCapability{Mount: true, AccessMode: 1}
+
+	t.Run("NodePublishVolumeInvalid", func(t *testing.T) {
+		for _, req := range []*csi.NodePublishVolumeRequest{
+			{TargetPath: target, VolumeCapability: capability},
+			{VolumeID: "sanity", VolumeCapability: capability},
+			{VolumeID: "sanity", TargetPath: target},
+			{VolumeID: "sanity", TargetPath: target, VolumeCapability: &csi.VolumeCapability{Block: true}},
+		} {
+			_, err := c.Call("/csi.v1.Node/NodePublishVolume", req.Marshal())
+			expectCode(t, err, csi.CodeInvalidArgument)
+		}
+	})
+
+	t.Run("NodeUnpublishVolumeInvalid", func(t *testing.T) {
+		for _, req := range []*csi.NodeUnpublishVolumeRequest{
+			{TargetPath: target},
+			{VolumeID: "sanity"},
+		} {
+			_, err := c.Call("/csi.v1.Node/NodeUnpublishVolume", req.Marshal())
+			expectCode(t, err, csi.CodeInvalidArgument)
+		}
+	})
+
+	t.Run("NodePublishUnpublishVolume", func(t *testing.T) {
+		publish := &csi.NodePublishVolumeRequest{
+			VolumeID:         "sanity",
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    volumeContext,
+		}
+		if _, err := c.Call("/csi.v1.Node/NodePublishVolume", publish.Marshal()); err != nil {
+			t.Fatalf("publish failed: %s", err)
+		}
+
+		unpublish := &csi.NodeUnpublishVolumeRequest{VolumeID: "sanity", TargetPath: target}
+		for i := 0; i < 2; i++ {
+			if _, err := c.Call("/csi.v1.Node/NodeUnpublishVolume", unpublish.Marshal()); err != nil {
+				t.Fatalf("unpublish %d failed: %s", i, err)
+			}
+		}
+
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Errorf("target path was not removed")
+		}
+	})
+}
+
+func expectCode(t *testing.T, err error, code int) {
+	rpcErr, ok := err.(*csi.Error)
+	if !ok || rpcErr.Code != code {
+		t.Errorf("expected code: %d got: %v", code, err)
+	}
+}
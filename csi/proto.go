@@ -0,0 +1,151 @@
+package csi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Protobuf wire types used by the CSI messages.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// encoder writes protobuf fields. Only the field types the CSI messages use
+// are supported.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) tag(field, wire int) {
+	e.varint(uint64(field<<3 | wire))
+}
+
+func (e *encoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) bytes(field int, v []byte) {
+	e.tag(field, wireBytes)
+	e.varint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(field int, v string) {
+	if v != "" {
+		e.bytes(field, []byte(v))
+	}
+}
+
+func (e *encoder) bool(field int, v bool) {
+	if v {
+		e.tag(field, wireVarint)
+		e.varint(1)
+	}
+}
+
+func (e *encoder) int64(field int, v int64) {
+	if v != 0 {
+		e.tag(field, wireVarint)
+		e.varint(uint64(v))
+	}
+}
+
+// message writes a nested message, present even when it is empty.
+func (e *encoder) message(field int, v []byte) {
+	e.bytes(field, v)
+}
+
+// stringMap writes a map<string, string>, entries are sorted so the encoding
+// is stable.
+func (e *encoder) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		entry := &encoder{}
+		entry.string(1, k)
+		entry.string(2, m[k])
+		e.message(field, entry.buf)
+	}
+}
+
+// field is a single decoded protobuf field, value is set for length
+// delimited fields and number for varints.
+type field struct {
+	number int
+	wire   int
+	value  []byte
+	num    uint64
+}
+
+// decodeFields calls fn for every field in b, unknown fields are left to fn
+// to ignore.
+func decodeFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf field key")
+		}
+		b = b[n:]
+
+		f := field{number: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.num, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint in field: %d", f.number)
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated protobuf field: %d", f.number)
+			}
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return fmt.Errorf("truncated protobuf field: %d", f.number)
+			}
+			b = b[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return fmt.Errorf("truncated protobuf field: %d", f.number)
+			}
+			f.value = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type: %d", f.wire)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeMapEntry decodes one map<string, string> entry into m.
+func decodeMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	err := decodeFields(b, func(f field) error {
+		switch f.number {
+		case 1:
+			key = string(f.value)
+		case 2:
+			value = string(f.value)
+		}
+		return nil
+	})
+	m[key] = value
+	return err
+}
@@ -0,0 +1,266 @@
+// Package csi serves the CSI Identity and Node services. It speaks the gRPC
+// wire protocol directly over HTTP/2 and encodes the handful of CSI messages
+// by hand, only unary calls are supported.
+package csi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// gRPC status codes returned by the plugin.
+const (
+	CodeOK              = 0
+	CodeInvalidArgument = 3
+	CodeNotFound        = 5
+	CodeUnimplemented   = 12
+	CodeInternal        = 13
+	CodeUnavailable     = 14
+)
+
+const maxMessageSize = 4 << 20
+
+// Error is a failed call, Code is the gRPC status code.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", e.Code, e.Message)
+}
+
+// Errorf returns an Error with code.
+func Errorf(code int, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Node does the work behind the Node service. Requests are validated before
+// they are passed on.
+type Node interface {
+	NodeID() (string, error)
+	Ready() error
+	Publish(req *NodePublishVolumeRequest) error
+	Unpublish(req *NodeUnpublishVolumeRequest) error
+}
+
+// Server serves the Identity and Node services of a node plugin.
+type Server struct {
+	Name    string
+	Version string
+	Node    Node
+}
+
+type method func(body []byte) ([]byte, error)
+
+// Serve accepts connections on listener until it fails.
+func (s *Server) Serve(listener net.Listener) error {
+	h2 := &http2.Server{}
+	opts := &http2.ServeConnOpts{Handler: s.Handler()}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go h2.ServeConn(conn, opts)
+	}
+}
+
+// Handler returns the HTTP/2 handler serving the gRPC methods.
+func (s *Server) Handler() http.Handler {
+	methods := map[string]method{
+		"/csi.v1.Identity/GetPluginInfo":         s.getPluginInfo,
+		"/csi.v1.Identity/GetPluginCapabilities": empty,
+		"/csi.v1.Identity/Probe":                 s.probe,
+		"/csi.v1.Node/NodeGetInfo":               s.nodeGetInfo,
+		"/csi.v1.Node/NodeGetCapabilities":       empty,
+		"/csi.v1.Node/NodePublishVolume":         s.nodePublishVolume,
+		"/csi.v1.Node/NodeUnpublishVolume":       s.nodeUnpublishVolume,
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Add("Trailer", "Grpc-Status")
+		rw.Header().Add("Trailer", "Grpc-Message")
+
+		resp, err := s.call(methods[req.URL.Path], req)
+		if err == nil {
+			err = WriteMessage(rw, resp)
+		}
+
+		code, message := CodeOK, ""
+		if err != nil {
+			logrus.Errorf("%s failed: %s", req.URL.Path, err)
+			code, message = CodeInternal, err.Error()
+			if rpcErr, ok := err.(*Error); ok {
+				code, message = rpcErr.Code, rpcErr.Message
+			}
+		}
+
+		rw.Header().Set("Grpc-Status", strconv.Itoa(code))
+		rw.Header().Set("Grpc-Message", EncodeStatusMessage(message))
+	})
+}
+
+// EncodeStatusMessage percent-encodes the grpc-message trailer as the gRPC
+// spec requires, bytes outside printable ASCII and '%' become %XX.
+func EncodeStatusMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// DecodeStatusMessage reverses EncodeStatusMessage. Invalid escapes are
+// kept as they are, like other gRPC implementations do.
+func DecodeStatusMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if message[i] == '%' && i+2 < len(message) {
+			if c, err := strconv.ParseUint(message[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(message[i])
+	}
+	return b.String()
+}
+
+func (s *Server) call(m method, req *http.Request) ([]byte, error) {
+	if m == nil {
+		return nil, Errorf(CodeUnimplemented, "unknown method: %s", req.URL.Path)
+	}
+
+	body, err := ReadMessage(req.Body)
+	if err != nil {
+		return nil, Errorf(CodeInvalidArgument, "%s", err)
+	}
+
+	return m(body)
+}
+
+func empty(body []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func (s *Server) getPluginInfo(body []byte) ([]byte, error) {
+	info := &PluginInfo{Name: s.Name, VendorVersion: s.Version}
+	return info.Marshal(), nil
+}
+
+func (s *Server) probe(body []byte) ([]byte, error) {
+	if err := s.Node.Ready(); err != nil {
+		return nil, Errorf(CodeUnavailable, "%s", err)
+	}
+
+	resp := &ProbeResponse{Ready: true}
+	return resp.Marshal(), nil
+}
+
+func (s *Server) nodeGetInfo(body []byte) ([]byte, error) {
+	nodeID, err := s.Node.NodeID()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &NodeInfo{NodeID: nodeID}
+	return info.Marshal(), nil
+}
+
+func (s *Server) nodePublishVolume(body []byte) ([]byte, error) {
+	req := &NodePublishVolumeRequest{}
+	if err := req.Unmarshal(body); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "%s", err)
+	}
+
+	switch {
+	case req.VolumeID == "":
+		return nil, Errorf(CodeInvalidArgument, "volume id missing in request")
+	case req.TargetPath == "":
+		return nil, Errorf(CodeInvalidArgument, "target path missing in request")
+	case req.VolumeCapability == nil:
+		return nil, Errorf(CodeInvalidArgument, "volume capability missing in request")
+	case req.VolumeCapability.Block:
+		return nil, Errorf(CodeInvalidArgument, "block volumes are not supported")
+	}
+
+	return nil, s.Node.Publish(req)
+}
+
+func (s *Server) nodeUnpublishVolume(body []byte) ([]byte, error) {
+	req := &NodeUnpublishVolumeRequest{}
+	if err := req.Unmarshal(body); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "%s", err)
+	}
+
+	switch {
+	case req.VolumeID == "":
+		return nil, Errorf(CodeInvalidArgument, "volume id missing in request")
+	case req.TargetPath == "":
+		return nil, Errorf(CodeInvalidArgument, "target path missing in request")
+	}
+
+	return nil, s.Node.Unpublish(req)
+}
+
+// ReadMessage reads a length prefixed gRPC message, compression is never
+// negotiated so compressed messages are rejected.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read message: %s", err)
+	}
+
+	if header[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message too large: %d bytes", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("failed to read message: %s", err)
+	}
+
+	// Unary calls carry a single message.
+	io.Copy(ioutil.Discard, r)
+
+	return body, nil
+}
+
+// WriteMessage writes a length prefixed gRPC message.
+func WriteMessage(w io.Writer, body []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
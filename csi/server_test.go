@@ -0,0 +1,80 @@
+package csi_test
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rancher/secrets-bridge-v2/csi"
+	"github.com/rancher/secrets-bridge-v2/csi/csitest"
+)
+
+type fakeNode struct {
+	published map[string]string
+}
+
+func (f *fakeNode) NodeID() (string, error) { return "node-1", nil }
+
+func (f *fakeNode) Ready() error { return nil }
+
+func (f *fakeNode) Publish(req *csi.NodePublishVolumeRequest) error {
+	f.published[req.TargetPath] = req.VolumeContext["policies"]
+	return os.MkdirAll(req.TargetPath, 0750)
+}
+
+func (f *fakeNode) Unpublish(req *csi.NodeUnpublishVolumeRequest) error {
+	delete(f.published, req.TargetPath)
+	return os.RemoveAll(req.TargetPath)
+}
+
+func TestSanity(t *testing.T) {
+	socket := path.Join(t.TempDir(), "csi.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	node := &fakeNode{published: map[string]string{}}
+	server := &csi.Server{Name: "secrets-bridge-v2", Version: "test", Node: node}
+	go server.Serve(listener)
+
+	csitest.Sanity(t, socket, map[string]string{"policies": "app"})
+
+	if len(node.published) != 0 {
+		t.Errorf("volumes left published: %v", node.published)
+	}
+}
+
+func TestPublishRequestRoundTrip(t *testing.T) {
+	req := &csi.NodePublishVolumeRequest{
+		VolumeID:         "vol",
+		TargetPath:       "/target",
+		VolumeCapability: &csi.VolumeCapability{Mount: true, AccessMode: 1},
+		Readonly:         true,
+		VolumeContext:    map[string]string{"policies": "app", "secrets": "[]"},
+	}
+
+	decoded := &csi.NodePublishVolumeRequest{}
+	if err := decoded.Unmarshal(req.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.VolumeID != "vol" || decoded.TargetPath != "/target" || !decoded.Readonly ||
+		!decoded.VolumeCapability.Mount || decoded.VolumeCapability.AccessMode != 1 ||
+		decoded.VolumeContext["secrets"] != "[]" || len(decoded.VolumeContext) != 2 {
+		t.Errorf("request did not survive a round trip: %#v", decoded)
+	}
+}
+
+func TestStatusMessageEncoding(t *testing.T) {
+	message := "mount failed: 100% full\nretry on nöde"
+	encoded := csi.EncodeStatusMessage(message)
+	if encoded != "mount failed: 100%25 full%0Aretry on n%C3%B6de" {
+		t.Errorf("unexpected encoding: %s", encoded)
+	}
+	if decoded := csi.DecodeStatusMessage(encoded); decoded != message {
+		t.Errorf("expected: %q got: %q", message, decoded)
+	}
+}
@@ -0,0 +1,207 @@
+package csi
+
+// The CSI v1 messages served by the plugin. Field numbers follow csi.proto,
+// fields the plugin has no use for are skipped when decoding.
+
+// PluginInfo is the GetPluginInfoResponse.
+type PluginInfo struct {
+	Name          string
+	VendorVersion string
+}
+
+func (p *PluginInfo) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, p.Name)
+	e.string(2, p.VendorVersion)
+	return e.buf
+}
+
+func (p *PluginInfo) Unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.number {
+		case 1:
+			p.Name = string(f.value)
+		case 2:
+			p.VendorVersion = string(f.value)
+		}
+		return nil
+	})
+}
+
+// ProbeResponse reports whether the plugin is ready to serve requests.
+type ProbeResponse struct {
+	Ready bool
+}
+
+func (p *ProbeResponse) Marshal() []byte {
+	ready := &encoder{}
+	ready.bool(1, p.Ready)
+
+	e := &encoder{}
+	e.message(1, ready.buf)
+	return e.buf
+}
+
+func (p *ProbeResponse) Unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		if f.number != 1 {
+			return nil
+		}
+		return decodeFields(f.value, func(f field) error {
+			if f.number == 1 {
+				p.Ready = f.num != 0
+			}
+			return nil
+		})
+	})
+}
+
+// NodeInfo is the NodeGetInfoResponse.
+type NodeInfo struct {
+	NodeID            string
+	MaxVolumesPerNode int64
+}
+
+func (n *NodeInfo) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, n.NodeID)
+	e.int64(2, n.MaxVolumesPerNode)
+	return e.buf
+}
+
+func (n *NodeInfo) Unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.number {
+		case 1:
+			n.NodeID = string(f.value)
+		case 2:
+			n.MaxVolumesPerNode = int64(f.num)
+		}
+		return nil
+	})
+}
+
+// VolumeCapability records the access type, only mount volumes can hold
+// secrets.
+type VolumeCapability struct {
+	Block      bool
+	Mount      bool
+	AccessMode int
+}
+
+func (v *VolumeCapability) Marshal() []byte {
+	e := &encoder{}
+	if v.Block {
+		e.message(1, nil)
+	}
+	if v.Mount {
+		e.message(2, nil)
+	}
+	if v.AccessMode != 0 {
+		mode := &encoder{}
+		mode.int64(1, int64(v.AccessMode))
+		e.message(3, mode.buf)
+	}
+	return e.buf
+}
+
+func (v *VolumeCapability) Unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.number {
+		case 1:
+			v.Block = true
+		case 2:
+			v.Mount = true
+		case 3:
+			return decodeFields(f.value, func(f field) error {
+				if f.number == 1 {
+					v.AccessMode = int(f.num)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// NodePublishVolumeRequest asks for the volume to be mounted at TargetPath.
+type NodePublishVolumeRequest struct {
+	VolumeID          string
+	PublishContext    map[string]string
+	StagingTargetPath string
+	TargetPath        string
+	VolumeCapability  *VolumeCapability
+	Readonly          bool
+	Secrets           map[string]string
+	VolumeContext     map[string]string
+}
+
+func (r *NodePublishVolumeRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, r.VolumeID)
+	e.stringMap(2, r.PublishContext)
+	e.string(3, r.StagingTargetPath)
+	e.string(4, r.TargetPath)
+	if r.VolumeCapability != nil {
+		e.message(5, r.VolumeCapability.Marshal())
+	}
+	e.bool(6, r.Readonly)
+	e.stringMap(7, r.Secrets)
+	e.stringMap(8, r.VolumeContext)
+	return e.buf
+}
+
+func (r *NodePublishVolumeRequest) Unmarshal(b []byte) error {
+	r.PublishContext = map[string]string{}
+	r.Secrets = map[string]string{}
+	r.VolumeContext = map[string]string{}
+
+	return decodeFields(b, func(f field) error {
+		switch f.number {
+		case 1:
+			r.VolumeID = string(f.value)
+		case 2:
+			return decodeMapEntry(f.value, r.PublishContext)
+		case 3:
+			r.StagingTargetPath = string(f.value)
+		case 4:
+			r.TargetPath = string(f.value)
+		case 5:
+			r.VolumeCapability = &VolumeCapability{}
+			return r.VolumeCapability.Unmarshal(f.value)
+		case 6:
+			r.Readonly = f.num != 0
+		case 7:
+			return decodeMapEntry(f.value, r.Secrets)
+		case 8:
+			return decodeMapEntry(f.value, r.VolumeContext)
+		}
+		return nil
+	})
+}
+
+// NodeUnpublishVolumeRequest asks for the volume to be removed from
+// TargetPath.
+type NodeUnpublishVolumeRequest struct {
+	VolumeID   string
+	TargetPath string
+}
+
+func (r *NodeUnpublishVolumeRequest) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, r.VolumeID)
+	e.string(2, r.TargetPath)
+	return e.buf
+}
+
+func (r *NodeUnpublishVolumeRequest) Unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.number {
+		case 1:
+			r.VolumeID = string(f.value)
+		case 2:
+			r.TargetPath = string(f.value)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	jksMagic              = 0xfeedfeed
+	jksVersion            = 2
+	jksPrivateKeyTag      = 1
+	jksTrustedCertTag     = 2
+	jksIntegrityWhitening = "Mighty Aphrodite"
+)
+
+// oidJKSKeyProtector is Sun's proprietary key protection algorithm, the only
+// one the JKS format supports.
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// EncodeJKS returns a Java KeyStore holding the private key with its
+// certificate chain under alias, and every CA certificate as a trusted
+// certificate entry. The same password protects the key and the store.
+func EncodeJKS(key interface{}, cert *x509.Certificate, caCerts []*x509.Certificate, alias, password string) ([]byte, error) {
+	jksPassword := bmpString(password)
+	jksPassword = jksPassword[:len(jksPassword)-2]
+
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	protectedKey, err := protectJKSKey(pkcs8Key, jksPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+
+	writeUint32(buf, jksMagic)
+	writeUint32(buf, jksVersion)
+	writeUint32(buf, uint32(1+len(caCerts)))
+
+	writeUint32(buf, jksPrivateKeyTag)
+	if err := writeUTF(buf, alias); err != nil {
+		return nil, err
+	}
+	binary.Write(buf, binary.BigEndian, timestamp)
+	writeUint32(buf, uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+
+	chain := append([]*x509.Certificate{cert}, caCerts...)
+	writeUint32(buf, uint32(len(chain)))
+	for _, c := range chain {
+		writeJKSCert(buf, c)
+	}
+
+	for i, c := range caCerts {
+		writeUint32(buf, jksTrustedCertTag)
+		if err := writeUTF(buf, fmt.Sprintf("%s-ca-%d", alias, i)); err != nil {
+			return nil, err
+		}
+		binary.Write(buf, binary.BigEndian, timestamp)
+		writeJKSCert(buf, c)
+	}
+
+	digest := sha1.New()
+	digest.Write(jksPassword)
+	digest.Write([]byte(jksIntegrityWhitening))
+	digest.Write(buf.Bytes())
+	buf.Write(digest.Sum(nil))
+
+	return buf.Bytes(), nil
+}
+
+// protectJKSKey encrypts the PKCS#8 key with the JKS key protector: a SHA1
+// key stream seeded with a random salt, followed by a SHA1 integrity check.
+func protectJKSKey(plainKey, password []byte) ([]byte, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(plainKey))
+	digest := salt
+	for offset := 0; offset < len(plainKey); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(password)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+
+		for i := 0; i < sha1.Size && offset+i < len(plainKey); i++ {
+			encrypted[offset+i] = plainKey[offset+i] ^ digest[i]
+		}
+	}
+
+	check := sha1.New()
+	check.Write(password)
+	check.Write(plainKey)
+
+	protected := append(append(salt, encrypted...), check.Sum(nil)...)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidJKSKeyProtector,
+			Parameters: asn1.NullRawValue,
+		},
+		EncryptedData: protected,
+	})
+}
+
+func writeJKSCert(buf *bytes.Buffer, cert *x509.Certificate) {
+	writeUTF(buf, "X.509")
+	writeUint32(buf, uint32(len(cert.Raw)))
+	buf.Write(cert.Raw)
+}
+
+func writeUint32(buf *bytes.Buffer, value uint32) {
+	binary.Write(buf, binary.BigEndian, value)
+}
+
+// writeUTF writes a string the way java.io.DataOutputStream.writeUTF does,
+// which matches plain UTF-8 for the strings used here.
+func writeUTF(buf *bytes.Buffer, value string) error {
+	if len(value) > 0xffff {
+		return fmt.Errorf("string too long for keystore: %d bytes", len(value))
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+	return nil
+}
@@ -0,0 +1,155 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+func newTestCertificate(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "web.stack.rancher.internal"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, cert
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	key, cert := newTestCertificate(t)
+
+	bundle, err := EncodePKCS12(key, cert, nil, "changeit")
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+
+	pfx := pfxPdu{}
+	if _, err := asn1.Unmarshal(bundle, &pfx); err != nil {
+		t.Fatalf("failed to decode bundle: %s", err)
+	}
+
+	var authenticatedSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+		t.Fatalf("failed to decode authenticated safe: %s", err)
+	}
+
+	macKey := pkcs12KDF(bmpString("changeit"), pfx.MacData.MacSalt, 3, pfx.MacData.Iterations, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Errorf("bundle MAC did not verify")
+	}
+}
+
+// TestDecodePKCS12 reads the bundle back with an independent decoder.
+func TestDecodePKCS12(t *testing.T) {
+	key, cert := newTestCertificate(t)
+
+	bundle, err := EncodePKCS12(key, cert, nil, "s3cret")
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+
+	decodedKey, decodedCert, err := pkcs12.Decode(bundle, "s3cret")
+	if err != nil {
+		t.Fatalf("failed to decode bundle: %s", err)
+	}
+
+	if !decodedCert.Equal(cert) {
+		t.Errorf("decoded certificate does not match")
+	}
+	if ecKey, ok := decodedKey.(*ecdsa.PrivateKey); !ok || !ecKey.Equal(key) {
+		t.Errorf("decoded key does not match")
+	}
+
+	if _, _, err := pkcs12.Decode(bundle, "wrong"); err == nil {
+		t.Errorf("expected the wrong password to fail")
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	key, cert := newTestCertificate(t)
+
+	store, err := EncodeJKS(key, cert, []*x509.Certificate{cert}, "web", "changeit")
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+
+	password := []byte{0, 'c', 0, 'h', 0, 'a', 0, 'n', 0, 'g', 0, 'e', 0, 'i', 0, 't'}
+
+	body, digest := store[:len(store)-sha1.Size], store[len(store)-sha1.Size:]
+	check := sha1.New()
+	check.Write(password)
+	check.Write([]byte("Mighty Aphrodite"))
+	check.Write(body)
+	if !bytes.Equal(check.Sum(nil), digest) {
+		t.Fatalf("keystore digest did not verify")
+	}
+
+	if magic := binary.BigEndian.Uint32(body); magic != jksMagic {
+		t.Errorf("unexpected magic: %x", magic)
+	}
+	if count := binary.BigEndian.Uint32(body[8:]); count != 2 {
+		t.Errorf("expected 2 entries, got: %d", count)
+	}
+
+	// tag, alias, timestamp then the protected key
+	offset := 12 + 4 + 2 + len("web") + 8
+	keyLength := int(binary.BigEndian.Uint32(body[offset:]))
+	info := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(body[offset+4:offset+4+keyLength], &info); err != nil {
+		t.Fatalf("failed to decode protected key: %s", err)
+	}
+
+	protected := info.EncryptedData
+	salt, encrypted := protected[:sha1.Size], protected[sha1.Size:len(protected)-sha1.Size]
+	plain := make([]byte, len(encrypted))
+	stream := salt
+	for offset := 0; offset < len(encrypted); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(password)
+		hash.Write(stream)
+		stream = hash.Sum(nil)
+		for i := 0; i < sha1.Size && offset+i < len(encrypted); i++ {
+			plain[offset+i] = encrypted[offset+i] ^ stream[i]
+		}
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		t.Fatalf("failed to decrypt key: %s", err)
+	}
+
+	if parsed.(*ecdsa.PrivateKey).D.Cmp(key.D) != 0 {
+		t.Errorf("decrypted key does not match")
+	}
+}
@@ -0,0 +1,351 @@
+package keystore
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"unicode/utf16"
+)
+
+const (
+	pkcs12Iterations = 2048
+	pkcs12SaltLength = 8
+)
+
+var (
+	oidDataContentType            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyTripleDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// EncodePKCS12 returns a PKCS#12 bundle holding the private key, the
+// certificate and the CA chain. The key is encrypted and the bundle is
+// integrity protected with password, using the SHA1 and 3DES algorithms every
+// PKCS#12 consumer, including Java keytool and OpenSSL, understands.
+func EncodePKCS12(key interface{}, cert *x509.Certificate, caCerts []*x509.Certificate, password string) ([]byte, error) {
+	bmpPassword := bmpString(password)
+
+	localKeyID := sha1.Sum(cert.Raw)
+	attributes, err := bagAttributes("1", localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	certBags := []safeBag{}
+	for i, c := range append([]*x509.Certificate{cert}, caCerts...) {
+		bag, err := newCertBag(c)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			bag.Attributes = attributes
+		}
+		certBags = append(certBags, bag)
+	}
+
+	keyBag, err := newShroudedKeyBag(key, bmpPassword)
+	if err != nil {
+		return nil, err
+	}
+	keyBag.Attributes = attributes
+
+	certContent, err := dataContentInfo(certBags)
+	if err != nil {
+		return nil, err
+	}
+
+	keyContent, err := dataContentInfo([]safeBag{keyBag})
+	if err != nil {
+		return nil, err
+	}
+
+	authenticatedSafe, err := asn1.Marshal([]contentInfo{certContent, keyContent})
+	if err != nil {
+		return nil, err
+	}
+
+	pfx := pfxPdu{
+		Version: 3,
+	}
+
+	if pfx.MacData, err = newMacData(authenticatedSafe, bmpPassword); err != nil {
+		return nil, err
+	}
+
+	if pfx.AuthSafe, err = octetContentInfo(authenticatedSafe); err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pfx)
+}
+
+func newCertBag(cert *x509.Certificate) (safeBag, error) {
+	bag := safeBag{ID: oidCertBag}
+
+	content, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: cert.Raw})
+	if err != nil {
+		return bag, err
+	}
+
+	bag.Value = asn1.RawValue{FullBytes: explicitTag(content)}
+	return bag, nil
+}
+
+func newShroudedKeyBag(key interface{}, bmpPassword []byte) (safeBag, error) {
+	bag := safeBag{ID: oidPKCS8ShroudedKeyBag}
+
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return bag, err
+	}
+
+	params := pbeParams{
+		Salt:       make([]byte, pkcs12SaltLength),
+		Iterations: pkcs12Iterations,
+	}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return bag, err
+	}
+
+	encrypted, err := pbeEncrypt(pkcs8Key, bmpPassword, params)
+	if err != nil {
+		return bag, err
+	}
+
+	paramBytes, err := asn1.Marshal(params)
+	if err != nil {
+		return bag, err
+	}
+
+	content, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleDES,
+			Parameters: asn1.RawValue{FullBytes: paramBytes},
+		},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return bag, err
+	}
+
+	bag.Value = asn1.RawValue{FullBytes: explicitTag(content)}
+	return bag, nil
+}
+
+func bagAttributes(friendlyName string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	name := bmpString(friendlyName)
+	nameValue, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return nil, err
+	}
+
+	keyIDValue, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal, IsCompound: true, Bytes: nameValue}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal, IsCompound: true, Bytes: keyIDValue}},
+	}, nil
+}
+
+// dataContentInfo wraps SafeContents in a ContentInfo of type data.
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	content, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return octetContentInfo(content)
+}
+
+func octetContentInfo(content []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	return contentInfo{
+		ContentType: oidDataContentType,
+		Content:     asn1.RawValue{FullBytes: explicitTag(octets)},
+	}, nil
+}
+
+// explicitTag wraps DER in a context specific [0] constructed tag.
+func explicitTag(content []byte) []byte {
+	tagged, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content})
+	return tagged
+}
+
+func newMacData(content, bmpPassword []byte) (macData, error) {
+	data := macData{
+		MacSalt:    make([]byte, pkcs12SaltLength),
+		Iterations: pkcs12Iterations,
+	}
+	if _, err := rand.Read(data.MacSalt); err != nil {
+		return data, err
+	}
+
+	key := pkcs12KDF(bmpPassword, data.MacSalt, 3, data.Iterations, sha1.Size)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(content)
+
+	data.Mac = digestInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		Digest:    mac.Sum(nil),
+	}
+
+	return data, nil
+}
+
+// pbeEncrypt implements pbeWithSHAAnd3-KeyTripleDES-CBC.
+func pbeEncrypt(plainText, bmpPassword []byte, params pbeParams) ([]byte, error) {
+	key := pkcs12KDF(bmpPassword, params.Salt, 1, params.Iterations, 24)
+	iv := pkcs12KDF(bmpPassword, params.Salt, 2, params.Iterations, des.BlockSize)
+
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := des.BlockSize - len(plainText)%des.BlockSize
+	padded := make([]byte, len(plainText), len(plainText)+padding)
+	copy(padded, plainText)
+	for i := 0; i < padding; i++ {
+		padded = append(padded, byte(padding))
+	}
+
+	cipherText := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(cipherText, padded)
+	return cipherText, nil
+}
+
+// pkcs12KDF is the key derivation function from RFC 7292 appendix B using
+// SHA1, id is 1 for keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(bmpPassword, salt []byte, id byte, iterations, size int) []byte {
+	const u = sha1.Size
+	const v = 64
+
+	fill := func(input []byte) []byte {
+		if len(input) == 0 {
+			return nil
+		}
+		length := v * ((len(input) + v - 1) / v)
+		out := make([]byte, length)
+		for i := range out {
+			out[i] = input[i%len(input)]
+		}
+		return out
+	}
+
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+
+	I := append(fill(salt), fill(bmpPassword)...)
+
+	one := big.NewInt(1)
+	out := make([]byte, 0, size+u)
+	for len(out) < size {
+		hash := sha1.New()
+		hash.Write(D)
+		hash.Write(I)
+		A := hash.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			sum := sha1.Sum(A)
+			A = sum[:]
+		}
+		out = append(out, A...)
+
+		if len(out) >= size {
+			break
+		}
+
+		B := new(big.Int).SetBytes(fill(A)[:v])
+		B.Add(B, one)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, B)
+			block := Ij.Bytes()
+			// Keep the low v bytes, dropping any carry.
+			if len(block) > v {
+				block = block[len(block)-v:]
+			}
+			copy(I[j:j+v], make([]byte, v-len(block)))
+			copy(I[j+v-len(block):j+v], block)
+		}
+	}
+
+	return out[:size]
+}
+
+// bmpString encodes s as big endian UTF-16 with a trailing null, the
+// password encoding PKCS#12 expects.
+func bmpString(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	out := make([]byte, 0, len(encoded)*2+2)
+	for _, r := range encoded {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0)
+}
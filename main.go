@@ -31,6 +31,7 @@ func main() {
 
 	app.Commands = []cli.Command{
 		server.Command(),
+		server.RulesCommand(),
 	}
 
 	app.Run(os.Args)
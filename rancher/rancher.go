@@ -5,6 +5,7 @@ import (
 
 	"github.com/rancher/go-rancher/v2"
 	"os"
+	"strings"
 )
 
 func NewRancherClient(url, accessKey, secretKey string) (*client.RancherClient, error) {
@@ -26,6 +27,15 @@ func NewRancherClientFromContainerEnv() (*client.RancherClient, error) {
 }
 
 func GetRancherHostPublicKey(rClient *client.RancherClient, hostUUID string) (string, error) {
+	host, err := GetHost(rClient, hostUUID)
+	if err != nil {
+		return "", err
+	}
+
+	return host.Info.(map[string]interface{})["hostKey"].(map[string]interface{})["data"].(string), nil
+}
+
+func GetHost(rClient *client.RancherClient, hostUUID string) (*client.Host, error) {
 	// TODO: add a cache here possibly use hashicorp/lru
 	hosts, err := rClient.Host.List(&client.ListOpts{
 		Filters: map[string]interface{}{
@@ -33,14 +43,26 @@ func GetRancherHostPublicKey(rClient *client.RancherClient, hostUUID string) (st
 		},
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(hosts.Data) > 0 {
-		return hosts.Data[0].Info.(map[string]interface{})["hostKey"].(map[string]interface{})["data"].(string), nil
+		return &hosts.Data[0], nil
 	}
 
-	return "", fmt.Errorf("host: %s not found", hostUUID)
+	return nil, fmt.Errorf("host: %s not found", hostUUID)
+}
+
+// GetEnvironmentName returns the name of the environment the host is in.
+func GetEnvironmentName(rClient *client.RancherClient, host *client.Host) (string, error) {
+	project, err := rClient.Project.ById(host.AccountId)
+	if err != nil {
+		return "", err
+	}
+	if project == nil {
+		return "", fmt.Errorf("environment: %s not found", host.AccountId)
+	}
+	return project.Name, nil
 }
 
 func GetVolumeTemplate(rclient *client.RancherClient, volumeName string) (*client.VolumeTemplate, error) {
@@ -66,3 +88,92 @@ func GetVolumeTemplate(rclient *client.RancherClient, volumeName string) (*clien
 
 	return volumeTemplate, fmt.Errorf("no volumes found")
 }
+
+// GetVolumeServices returns the stack of the volume template and the
+// services of it that mount the template, secondary launch configs included.
+func GetVolumeServices(rclient *client.RancherClient, volumeName string) (*client.Stack, []client.Service, error) {
+	template, err := GetVolumeTemplate(rclient, volumeName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stack, err := rclient.Stack.ById(template.StackId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stack == nil {
+		return nil, nil, fmt.Errorf("stack: %s of volume: %s not found", template.StackId, volumeName)
+	}
+
+	services, err := rclient.Service.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"stackId": template.StackId,
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mounting := []client.Service{}
+	for _, service := range services.Data {
+		if len(serviceLabels(&service, template.Name)) > 0 {
+			mounting = append(mounting, service)
+		}
+	}
+
+	return stack, mounting, nil
+}
+
+// GetVolumeServiceLabels returns the value of label on every service of the
+// volume template's stack that mounts the template, secondary launch configs
+// included. Services without the label are skipped.
+func GetVolumeServiceLabels(rclient *client.RancherClient, volumeName, label string) ([]string, error) {
+	template, err := GetVolumeTemplate(rclient, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := rclient.Service.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"stackId": template.StackId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for _, service := range services.Data {
+		for _, labels := range serviceLabels(&service, template.Name) {
+			if value, ok := labels[label].(string); ok {
+				values = append(values, value)
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// serviceLabels returns the labels of the launch configs of service that
+// mount the template.
+func serviceLabels(service *client.Service, templateName string) []map[string]interface{} {
+	labels := []map[string]interface{}{}
+	if service.LaunchConfig != nil && mountsTemplate(service.LaunchConfig.DataVolumes, templateName) {
+		labels = append(labels, service.LaunchConfig.Labels)
+	}
+	for _, secondary := range service.SecondaryLaunchConfigs {
+		if mountsTemplate(secondary.DataVolumes, templateName) {
+			labels = append(labels, secondary.Labels)
+		}
+	}
+	return labels
+}
+
+func mountsTemplate(dataVolumes []string, templateName string) bool {
+	for _, dataVolume := range dataVolumes {
+		if strings.SplitN(dataVolume, ":", 2)[0] == templateName {
+			return true
+		}
+	}
+	return false
+}
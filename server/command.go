@@ -1,10 +1,13 @@
 package server
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/secrets-bridge-v2/signature"
 	"github.com/urfave/cli"
 )
 
@@ -49,10 +52,189 @@ func Command() cli.Command {
 				Usage:  "Rancher secret key",
 				EnvVar: "CATTLE_SECRET_KEY",
 			},
+			cli.StringSliceFlag{
+				Name:   "revocable-lease-prefix",
+				Usage:  "lease ID prefix hosts may revoke leases under",
+				EnvVar: "REVOCABLE_LEASE_PREFIXES",
+				Value:  &cli.StringSlice{"database/creds/"},
+			},
+			cli.StringSliceFlag{
+				Name:   "revocable-pki-mount",
+				Usage:  "PKI secrets engine mount hosts may revoke certificates from",
+				EnvVar: "REVOCABLE_PKI_MOUNTS",
+				Value:  &cli.StringSlice{"pki"},
+			},
+			cli.StringFlag{
+				Name:   "owners-file",
+				Usage:  "JSON file recording which host registered each lease and certificate, without it the owners are lost on restart",
+				EnvVar: "OWNERS_FILE",
+			},
+			cli.StringFlag{
+				Name:   "host-registry-file",
+				Usage:  "JSON file recording the identity provider of each host and the keys pinned to cloud hosts, without it they are lost on restart",
+				EnvVar: "HOST_REGISTRY_FILE",
+			},
+			cli.StringFlag{
+				Name:   "host-keys-file",
+				Usage:  "JSON file of host UUIDs to public keys for hosts with a static identity",
+				EnvVar: "HOST_KEYS_FILE",
+			},
+			cli.StringFlag{
+				Name:   "cloud-identity-cert",
+				Usage:  "certificate or public key the cloud provider signs instance identity documents with",
+				EnvVar: "CLOUD_IDENTITY_CERT",
+			},
+			cli.StringSliceFlag{
+				Name:   "host-policy",
+				Usage:  "policy volumes of hosts outside Rancher, which have no service labels, may request",
+				EnvVar: "HOST_POLICIES",
+			},
+			cli.StringSliceFlag{
+				Name:   "denied-policy",
+				Usage:  "policy that is never issued to hosts",
+				EnvVar: "DENIED_POLICIES",
+				Value:  &cli.StringSlice{"root"},
+			},
+			cli.StringFlag{
+				Name:   "rules-file",
+				Usage:  "JSON or YAML (.yaml, .yml) file of access rules deciding what token requests may be granted",
+				EnvVar: "RULES_FILE",
+			},
+			cli.BoolFlag{
+				Name:   "deny-by-default",
+				Usage:  "refuse token requests no access rule matches",
+				EnvVar: "DENY_BY_DEFAULT",
+			},
+			cli.DurationFlag{
+				Name:   "signature-skew",
+				Usage:  "how far the timestamp of a signed request may be from the server clock, either way",
+				EnvVar: "SIGNATURE_SKEW",
+				Value:  signature.TimeWindow,
+			},
+			cli.BoolFlag{
+				Name:   "require-nonce",
+				Usage:  "refuse signed requests without a nonce",
+				EnvVar: "REQUIRE_NONCE",
+			},
+			cli.BoolFlag{
+				Name:   "require-challenge",
+				Usage:  "only accept nonces issued by the challenge endpoint",
+				EnvVar: "REQUIRE_CHALLENGE",
+			},
+			cli.BoolFlag{
+				Name:   "require-signature-v2",
+				Usage:  "refuse requests signed with the v1 format",
+				EnvVar: "REQUIRE_SIGNATURE_V2",
+			},
 		},
 	}
 }
 
+// RulesCommand works with the access rules file.
+func RulesCommand() cli.Command {
+	return cli.Command{
+		Name:  "rules",
+		Usage: "Check the access rules of the token server",
+		Subcommands: []cli.Command{
+			{
+				Name:   "test",
+				Usage:  "Show which access rule matches a token request",
+				Action: TestRules,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "rules-file",
+						Usage:  "JSON or YAML (.yaml, .yml) file of access rules",
+						EnvVar: "RULES_FILE",
+					},
+					cli.BoolFlag{
+						Name:  "deny-by-default",
+						Usage: "refuse token requests no access rule matches",
+					},
+					cli.StringFlag{Name: "environment", Usage: "Rancher environment of the host"},
+					cli.StringFlag{Name: "stack", Usage: "stack of the volume"},
+					cli.StringSliceFlag{Name: "service", Usage: "service mounting the volume"},
+					cli.StringSliceFlag{Name: "host-label", Usage: "host label as key=value"},
+					cli.StringFlag{Name: "volume", Usage: "volume name"},
+					cli.StringFlag{Name: "provider", Usage: "host identity provider", Value: IdentityRancher},
+					cli.StringFlag{Name: "policies", Usage: "comma separated policies to check against the matched rule"},
+				},
+			},
+		},
+	}
+}
+
+// TestRules prints the rule matching the request described by the flags and,
+// given policies, whether they would be granted.
+func TestRules(c *cli.Context) error {
+	rules := &AccessRules{}
+	if c.String("rules-file") != "" {
+		var err error
+		if rules, err = LoadAccessRules(c.String("rules-file")); err != nil {
+			return err
+		}
+	}
+	if c.Bool("deny-by-default") {
+		rules.DenyByDefault = true
+	}
+
+	req := &RuleRequest{
+		Environment: c.String("environment"),
+		Stack:       c.String("stack"),
+		Services:    c.StringSlice("service"),
+		HostLabels:  map[string]string{},
+		Volume:      c.String("volume"),
+		Provider:    c.String("provider"),
+	}
+	for _, label := range c.StringSlice("host-label") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("host label: %s must be key=value", label)
+		}
+		req.HostLabels[parts[0]] = parts[1]
+	}
+
+	return printRuleMatch(c.App.Writer, rules, req, c.String("policies"))
+}
+
+func printRuleMatch(w io.Writer, rules *AccessRules, req *RuleRequest, policies string) error {
+	rule := rules.Match(req)
+	switch {
+	case rule == nil && rules.DenyByDefault:
+		fmt.Fprintln(w, "no rule matches, the request is denied")
+		return nil
+	case rule == nil:
+		fmt.Fprintf(w, "no rule matches, the %s label of the services decides\n", PoliciesLabel)
+		return nil
+	case rule.Deny:
+		fmt.Fprintf(w, "rule: %s matches, the request is denied\n", rule.Name)
+		return nil
+	}
+
+	fmt.Fprintf(w, "rule: %s matches\n", rule.Name)
+	fmt.Fprintf(w, "  policies:  %s\n", strings.Join(normalizePolicies(rule.Policies), ","))
+	if rule.MaxTTL != "" {
+		fmt.Fprintf(w, "  maxTTL:    %s\n", rule.MaxTTL)
+	}
+	if rule.Renewable != nil {
+		fmt.Fprintf(w, "  renewable: %t\n", *rule.Renewable)
+	}
+	if rule.NumUses > 0 {
+		fmt.Fprintf(w, "  numUses:   %d\n", rule.NumUses)
+	}
+	if rule.WrapTTL != "" {
+		fmt.Fprintf(w, "  wrapTTL:   %s\n", rule.WrapTTL)
+	}
+
+	if policies != "" {
+		if granted, err := authorizePolicies(policies, rule.Policies); err != nil {
+			fmt.Fprintf(w, "request refused: %s\n", err)
+		} else {
+			fmt.Fprintf(w, "request granted: %s\n", strings.Join(granted, ","))
+		}
+	}
+	return nil
+}
+
 // StartServer takes the CLI options and starts a server based on the configuration.
 func StartServer(c *cli.Context) error {
 	var err error
@@ -73,6 +255,25 @@ func StartServer(c *cli.Context) error {
 		RancherURL:    c.String("rancher-url"),
 		RancherAccess: c.String("rancher-access-key"),
 		RancherSecret: c.String("rancher-secret-key"),
+		LeasePrefixes: c.StringSlice("revocable-lease-prefix"),
+		PKIMounts:     c.StringSlice("revocable-pki-mount"),
+		OwnersFile:    c.String("owners-file"),
+
+		HostRegistryFile:  c.String("host-registry-file"),
+		HostKeysFile:      c.String("host-keys-file"),
+		CloudIdentityCert: c.String("cloud-identity-cert"),
+
+		HostPolicies:   c.StringSlice("host-policy"),
+		DeniedPolicies: c.StringSlice("denied-policy"),
+
+		RulesFile:     c.String("rules-file"),
+		DenyByDefault: c.Bool("deny-by-default"),
+
+		SignatureSkew:    c.Duration("signature-skew"),
+		RequireNonce:     c.Bool("require-nonce"),
+		RequireChallenge: c.Bool("require-challenge"),
+
+		RequireSignatureV2: c.Bool("require-signature-v2"),
 	}
 
 	if err = config.ValidateConfig(); err == nil {
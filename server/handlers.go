@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"encoding/base64"
 	"fmt"
@@ -15,8 +16,14 @@ import (
 
 const (
 	SignatureHeaderString = "X-Vault-Driver-Signature"
+	// SignatureParamsHeader carries the header of a v2 signature, requests
+	// without it are signed with v1.
+	SignatureParamsHeader = "X-Vault-Driver-Signature-Header"
 )
 
+// requireSignatureV2 refuses v1 signed requests once every host signs v2.
+var requireSignatureV2 bool
+
 func CreateTokenRequest(rw http.ResponseWriter, req *http.Request) (int, error) {
 	apiContext := api.GetApiContext(req)
 
@@ -25,12 +32,35 @@ func CreateTokenRequest(rw http.ResponseWriter, req *http.Request) (int, error)
 		return http.StatusBadRequest, err
 	}
 
-	resp, err := vaultClient.NewWrappedVaultToken(policiesList(vti.Policies))
+	// Checked before the token exists, it could not be handed out.
+	encryptionKey, err := tokenEncryptionKey(vti.PublicKey, vti.Input.EncryptionKey)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	grant, err := grantFor(req, vti.Input)
+	if _, denied := err.(policyError); denied {
+		return http.StatusForbidden, err
+	}
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	policies, err := authorizePolicies(vti.Policies, grant.policies)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+
+	if grant.rule != nil {
+		logrus.Debugf("granting policies: %v for volume: %s by rule: %s", policies, vti.Input.VolumeName, grant.rule.Name)
+	}
+
+	resp, err := vaultClient.NewWrappedVaultToken(policies, vti.Metadata, grant)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	vtr, err := NewVaultTokenResponse(resp, vti.PublicKey)
+	vtr, err := NewVaultTokenResponse(resp, encryptionKey)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -58,6 +88,105 @@ func RevokeTokenRequest(rw http.ResponseWriter, req *http.Request) (int, error)
 	return http.StatusAccepted, nil
 }
 
+func RevokeLeaseRequest(rw http.ResponseWriter, req *http.Request) (int, error) {
+	vlr, err := newVerifiedRevokeLeaseRequest(req)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if !revocableLease(vlr.LeaseID) {
+		return http.StatusForbidden, fmt.Errorf("lease: %s can not be revoked by hosts", vlr.LeaseID)
+	}
+
+	if err := secretOwners.check(SecretLease, vlr.LeaseID, vlr.HostUUID); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	err = vaultClient.RevokeLease(vlr.LeaseID)
+	if err != nil {
+		logrus.Errorf("failed to revoke lease: %s got: %s\n", vlr.LeaseID, err)
+		return http.StatusBadRequest, nil
+	}
+
+	logrus.Debugf("Revoked lease: %s", vlr.LeaseID)
+	if err := secretOwners.release(SecretLease, vlr.LeaseID); err != nil {
+		logrus.Errorf("failed to forget owner of lease: %s got: %s", vlr.LeaseID, err)
+	}
+
+	return http.StatusAccepted, nil
+}
+
+func RevokeCertificateRequest(rw http.ResponseWriter, req *http.Request) (int, error) {
+	vcr, err := newVerifiedRevokeCertificateRequest(req)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if !revocablePKIMount(vcr.Mount) {
+		return http.StatusForbidden, fmt.Errorf("certificates from: %s can not be revoked by hosts", vcr.Mount)
+	}
+
+	id := certificateID(vcr.Mount, vcr.SerialNumber)
+	if err := secretOwners.check(SecretCertificate, id, vcr.HostUUID); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	err = vaultClient.RevokeCertificate(vcr.Mount, vcr.SerialNumber)
+	if err != nil {
+		logrus.Errorf("failed to revoke certificate: %s got: %s\n", vcr.SerialNumber, err)
+		return http.StatusBadRequest, nil
+	}
+
+	logrus.Debugf("Revoked certificate: %s", vcr.SerialNumber)
+	if err := secretOwners.release(SecretCertificate, id); err != nil {
+		logrus.Errorf("failed to forget owner of certificate: %s got: %s", id, err)
+	}
+
+	return http.StatusAccepted, nil
+}
+
+// RegisterSecretRequest records the host a lease or certificate was issued
+// to, right after the host read it from Vault. Only that host may revoke it.
+func RegisterSecretRequest(rw http.ResponseWriter, req *http.Request) (int, error) {
+	vsr, err := newVerifiedRegisterSecretRequest(req)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	var expires time.Time
+	switch vsr.Kind {
+	case SecretLease:
+		if !revocableLease(vsr.ID) {
+			return http.StatusForbidden, fmt.Errorf("lease: %s can not be revoked by hosts", vsr.ID)
+		}
+		if expires, err = vaultClient.LeaseExpiry(vsr.ID); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("failed to look up lease: %s got: %s", vsr.ID, err)
+		}
+	case SecretCertificate:
+		i := strings.LastIndex(vsr.ID, "/")
+		if i < 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid certificate: %s", vsr.ID)
+		}
+		mount, serialNumber := vsr.ID[:i], vsr.ID[i+1:]
+		if !revocablePKIMount(mount) {
+			return http.StatusForbidden, fmt.Errorf("certificates from: %s can not be revoked by hosts", mount)
+		}
+		if expires, err = vaultClient.CertificateExpiry(mount, serialNumber); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("failed to look up certificate: %s got: %s", vsr.ID, err)
+		}
+		vsr.ID = certificateID(mount, serialNumber)
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown secret kind: %s", vsr.Kind)
+	}
+
+	if err := secretOwners.claim(vsr.Kind, vsr.ID, vsr.HostUUID, expires); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	logrus.Debugf("registered %s: %s to host: %s", vsr.Kind, vsr.ID, vsr.HostUUID)
+	return http.StatusCreated, nil
+}
+
 func HealthCheck(rw http.ResponseWriter, req *http.Request) (int, error) {
 	if vaultClient.Healthy() {
 		return http.StatusOK, nil
@@ -65,10 +194,6 @@ func HealthCheck(rw http.ResponseWriter, req *http.Request) (int, error) {
 	return http.StatusInternalServerError, fmt.Errorf("vault token refresh is failing")
 }
 
-func policiesList(policies string) []string {
-	return strings.Split(policies, ",")
-}
-
 func newVerifiedVaultTokenInput(req *http.Request) (*verifiedVaultTokenInput, error) {
 	msg := &VaultTokenInput{}
 	resp := &verifiedVaultTokenInput{}
@@ -81,20 +206,35 @@ func newVerifiedVaultTokenInput(req *http.Request) (*verifiedVaultTokenInput, er
 		return resp, err
 	}
 
-	if !perContainerDef(msg.VolumeName) {
+	// The pod fields are reported by the host itself. On a Rancher host they
+	// would skip the per_container check and the service label policies, so
+	// they are refused until pods are verified with a Kubernetes identity.
+	provider := hostProvider(req, msg.HostUUID)
+	if msg.isPod() && provider == IdentityRancher {
+		return resp, fmt.Errorf("pod volumes can not be requested by hosts with the %s identity", IdentityRancher)
+	}
+
+	if err := checkTokenSignatureVersion(req, msg, provider); err != nil {
+		return resp, err
+	}
+
+	// Volumes of hosts outside Rancher have no Rancher volume template.
+	if provider == IdentityRancher && !perContainerDef(msg.VolumeName) {
 		return resp, fmt.Errorf("per_container is set to false or not defined on this volume")
 	}
 
-	verified, err := verifySignature(msg.HostUUID, req.Header.Get(SignatureHeaderString), msg)
+	publicKey, verified, err := verifySignature(req, msg.HostUUID, msg)
 	if err != nil {
 		return resp, err
 	}
 
 	if verified {
-		logrus.Debugf("verified: %s", verified)
+		logrus.Debugf("verified signature from host: %s", msg.HostUUID)
 		resp.Policies = msg.Policies
-		resp.PublicKey, err = rancher.GetRancherHostPublicKey(rancherClient, msg.HostUUID)
-		return resp, err
+		resp.Metadata = msg.metadata()
+		resp.PublicKey = publicKey
+		resp.Input = msg
+		return resp, nil
 	}
 
 	return resp, fmt.Errorf("signatures did not match")
@@ -110,7 +250,30 @@ func newVerifiedRevokeTokenRequest(req *http.Request) (*VaultTokenExpireInput, e
 		return msg, err
 	}
 
-	verified, err := verifySignature(msg.HostUUID, req.Header.Get(SignatureHeaderString), msg)
+	_, verified, err := verifySignature(req, msg.HostUUID, msg)
+	if err != nil {
+		return msg, err
+	}
+
+	if verified {
+		logrus.Debugf("verified signature from host: %s", msg.HostUUID)
+		return msg, nil
+	}
+
+	return msg, fmt.Errorf("signatures did not match")
+}
+
+func newVerifiedRevokeLeaseRequest(req *http.Request) (*VaultLeaseRevokeInput, error) {
+	msg := &VaultLeaseRevokeInput{}
+
+	jsonDecoder := json.NewDecoder(req.Body)
+
+	err := jsonDecoder.Decode(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	_, verified, err := verifySignature(req, msg.HostUUID, msg)
 	if err != nil {
 		return msg, err
 	}
@@ -123,25 +286,153 @@ func newVerifiedRevokeTokenRequest(req *http.Request) (*VaultTokenExpireInput, e
 	return msg, fmt.Errorf("signatures did not match")
 }
 
-func verifySignature(hostUUID, reqSignature string, msg signature.Message) (bool, error) {
-	verified := false
+func newVerifiedRegisterSecretRequest(req *http.Request) (*VaultSecretRegisterInput, error) {
+	msg := &VaultSecretRegisterInput{}
+
+	jsonDecoder := json.NewDecoder(req.Body)
+
+	err := jsonDecoder.Decode(msg)
+	if err != nil {
+		return msg, err
+	}
 
-	sigBytes, err := base64.StdEncoding.DecodeString(reqSignature)
+	_, verified, err := verifySignature(req, msg.HostUUID, msg)
 	if err != nil {
-		return verified, err
+		return msg, err
+	}
+
+	if verified {
+		logrus.Debugf("verified signature from host: %s", msg.HostUUID)
+		return msg, nil
 	}
 
-	key, err := rancher.GetRancherHostPublicKey(rancherClient, hostUUID)
+	return msg, fmt.Errorf("signatures did not match")
+}
+
+func newVerifiedRevokeCertificateRequest(req *http.Request) (*VaultCertificateRevokeInput, error) {
+	msg := &VaultCertificateRevokeInput{}
+
+	jsonDecoder := json.NewDecoder(req.Body)
+
+	err := jsonDecoder.Decode(msg)
 	if err != nil {
-		return verified, err
+		return msg, err
 	}
 
-	pubKey, err := signature.LoadRSAPublicKey(key)
+	_, verified, err := verifySignature(req, msg.HostUUID, msg)
 	if err != nil {
-		return verified, err
+		return msg, err
+	}
+
+	if verified {
+		logrus.Debugf("verified signature from host: %s", msg.HostUUID)
+		return msg, nil
+	}
+
+	return msg, fmt.Errorf("signatures did not match")
+}
+
+func revocablePKIMount(mount string) bool {
+	for _, allowed := range revocablePKIMounts {
+		if allowed != "" && strings.Trim(allowed, "/") == strings.Trim(mount, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateID identifies a certificate the way hosts register it.
+func certificateID(mount, serialNumber string) string {
+	return strings.Trim(mount, "/") + "/" + serialNumber
+}
+
+// revocableLease checks the lease was issued by a secrets engine hosts are
+// allowed to revoke leases from.
+func revocableLease(leaseID string) bool {
+	for _, prefix := range revocableLeasePrefixes {
+		if prefix != "" && strings.HasPrefix(leaseID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTokenSignatureVersion refuses v1 signed token requests that are
+// authorized by something v1 does not sign. v1 only covers the policies, the
+// host, the timestamp and the nonce, not the volume name service labels and
+// access rules are matched against, nor the pod fields or the encryption
+// key, which anyone on the path could change.
+func checkTokenSignatureVersion(req *http.Request, msg *VaultTokenInput, provider string) error {
+	if req.Header.Get(SignatureParamsHeader) != "" {
+		return nil
+	}
+
+	switch {
+	case provider == IdentityRancher:
+		return fmt.Errorf("token requests of %s hosts are authorized by their volume name and must be signed with v2", IdentityRancher)
+	case accessRules != nil:
+		return fmt.Errorf("token requests are authorized by access rules and must be signed with v2")
+	case msg.isPod() || msg.EncryptionKey != "":
+		return fmt.Errorf("token requests with pod fields or an encryption key must be signed with v2")
+	}
+	return nil
+}
+
+// verifySignature checks the request was signed by the host, the public key
+// of the host is returned.
+func verifySignature(req *http.Request, hostUUID string, msg signature.Message) (string, bool, error) {
+	sigBytes, err := base64.StdEncoding.DecodeString(req.Header.Get(SignatureHeaderString))
+	if err != nil {
+		return "", false, err
+	}
+
+	provider, source, err := hostKeySourceFor(req, hostUUID)
+	if err != nil {
+		return "", false, err
+	}
+
+	key, err := source.PublicKey(req, hostUUID)
+	if err != nil {
+		return "", false, err
+	}
+
+	pubKey, err := signature.LoadPublicKey(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	var verified bool
+	if params := req.Header.Get(SignatureParamsHeader); params != "" {
+		canonical, ok := msg.(signature.CanonicalMessage)
+		if !ok {
+			return key, false, fmt.Errorf("request can not be signed with v2")
+		}
+		verified, err = signature.VerifyV2(params, sigBytes, canonical, req.Method, req.URL.Path, pubKey, signatureSkew)
+	} else if requireSignatureV2 {
+		return key, false, fmt.Errorf("v1 signatures are no longer accepted, the request has no %s", SignatureParamsHeader)
+	} else {
+		verified, err = signature.VerifyWithin(sigBytes, msg, pubKey, signatureSkew)
+	}
+	if !verified || err != nil {
+		return key, verified, err
+	}
+
+	// Attested keys are only trusted for requests with a challenge, and only
+	// pinned once such a request verified.
+	attested, isAttested := source.(attestedHostKeySource)
+	if err := checkNonce(hostUUID, msg, isAttested); err != nil {
+		return key, verified, err
+	}
+
+	pin := ""
+	if isAttested {
+		if err := attested.confirm(req, hostUUID, messageNonce(msg)); err != nil {
+			return key, false, err
+		}
+		pin = key
 	}
 
-	return signature.Verify(sigBytes, msg, pubKey)
+	return key, verified, knownHosts.record(hostUUID, provider, pin)
 }
 
 func perContainerDef(volumeName string) bool {
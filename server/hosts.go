@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// knownHosts records the provider each host was verified with, so a host
+// can not pick another provider later, and the key pinned to cloud hosts.
+var knownHosts = &hostRegistry{hosts: map[string]*knownHost{}}
+
+type knownHost struct {
+	Provider  string `json:"provider"`
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// hostRegistry keeps the hosts in memory and, if path is set, in a JSON file
+// so they survive a restart.
+type hostRegistry struct {
+	mu    sync.Mutex
+	path  string
+	hosts map[string]*knownHost
+}
+
+func loadHostRegistry(path string) (*hostRegistry, error) {
+	registry := &hostRegistry{path: path, hosts: map[string]*knownHost{}}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &registry.hosts); err != nil {
+			return nil, fmt.Errorf("invalid host registry file: %s: %s", path, err)
+		}
+	}
+
+	return registry, nil
+}
+
+// lookup returns the record of a host verified before.
+func (r *hostRegistry) lookup(hostUUID string) (knownHost, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host, ok := r.hosts[hostUUID]
+	if !ok {
+		return knownHost{}, false
+	}
+	return *host, true
+}
+
+// record remembers the provider a request of the host verified with, and
+// pins publicKey to the host unless it is empty.
+func (r *hostRegistry) record(hostUUID, provider, publicKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host, ok := r.hosts[hostUUID]
+	if ok && host.Provider == provider && (publicKey == "" || host.PublicKey == publicKey) {
+		return nil
+	}
+	// A key pinned for another provider does not carry over.
+	if !ok || host.Provider != provider {
+		host = &knownHost{Provider: provider}
+		r.hosts[hostUUID] = host
+	}
+	if publicKey != "" {
+		host.PublicKey = publicKey
+	}
+
+	if r.path == "" {
+		return nil
+	}
+	return writeJSONFile(r.path, r.hosts)
+}
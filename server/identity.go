@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/secrets-bridge-v2/rancher"
+)
+
+// Headers the driver sends to tell the server how to verify the host. The
+// provider header is informational, the server decides how a host is
+// verified itself.
+const (
+	IdentityProviderHeader  = "X-Vault-Driver-Identity-Provider"
+	IdentityDocumentHeader  = "X-Vault-Driver-Identity-Document"
+	IdentitySignatureHeader = "X-Vault-Driver-Identity-Signature"
+	HostPublicKeyHeader     = "X-Vault-Driver-Host-Public-Key"
+)
+
+// Host identity providers, hosts without a static key, a recorded provider
+// or an identity document are Rancher hosts.
+const (
+	IdentityRancher = "rancher"
+	IdentityStatic  = "static"
+	IdentityCloud   = "cloud"
+)
+
+// InstanceIdentityDocument is the signed description of a cloud instance
+// served by the instance metadata service. The document requested for a
+// signed request names the SHA-256 of the host key and the nonce of the
+// request, so it can not be presented with another key or replayed.
+type InstanceIdentityDocument struct {
+	InstanceID    string `json:"instanceId"`
+	AccountID     string `json:"accountId"`
+	Region        string `json:"region"`
+	HostKeySHA256 string `json:"hostKeySha256,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+}
+
+// hostKeySource returns the PEM encoded public key a host signs its requests
+// with.
+type hostKeySource interface {
+	PublicKey(req *http.Request, hostUUID string) (string, error)
+}
+
+// attestedHostKeySource proves the host key with a document bound to the
+// nonce of the request. confirm is only called once the request signature
+// verified, the nonce must be a challenge of this server.
+type attestedHostKeySource interface {
+	hostKeySource
+	confirm(req *http.Request, hostUUID, nonce string) error
+}
+
+var hostKeySources = map[string]hostKeySource{}
+
+// rancherHostKeys looks the host key up in Rancher.
+type rancherHostKeys struct {
+	client *client.RancherClient
+}
+
+func (r *rancherHostKeys) PublicKey(req *http.Request, hostUUID string) (string, error) {
+	return rancher.GetRancherHostPublicKey(r.client, hostUUID)
+}
+
+// staticHostKeys are the keys of hosts registered in a file, a JSON object of
+// host UUIDs to PEM encoded public keys.
+type staticHostKeys struct {
+	keys map[string]string
+}
+
+func newStaticHostKeys(keysFile string) (*staticHostKeys, error) {
+	content, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]string{}
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("invalid host keys file: %s: %s", keysFile, err)
+	}
+
+	return &staticHostKeys{keys: keys}, nil
+}
+
+func (s *staticHostKeys) PublicKey(req *http.Request, hostUUID string) (string, error) {
+	if key, ok := s.keys[hostUUID]; ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("host: %s not found", hostUUID)
+}
+
+// cloudHostKeys trusts hosts that present an instance identity document
+// signed by the cloud provider for their key and the challenge of the
+// request. The first key that verifies for an instance is pinned in the host
+// registry and any other key for the same instance is rejected.
+type cloudHostKeys struct {
+	providerKey *rsa.PublicKey
+}
+
+func newCloudHostKeys(certFile string) (*cloudHostKeys, error) {
+	content, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in: %s", certFile)
+	}
+
+	var key interface{}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	} else if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("cloud identity key must be an RSA key")
+	}
+
+	return &cloudHostKeys{providerKey: rsaKey}, nil
+}
+
+func (c *cloudHostKeys) PublicKey(req *http.Request, hostUUID string) (string, error) {
+	_, hostKey, err := c.verifiedDocument(req, hostUUID)
+	if err != nil {
+		return "", err
+	}
+
+	if host, ok := knownHosts.lookup(hostUUID); ok && host.PublicKey != "" && host.PublicKey != hostKey {
+		return "", fmt.Errorf("host: %s presented a different key than before", hostUUID)
+	}
+
+	return hostKey, nil
+}
+
+// confirm checks the document was requested for the nonce of the request.
+func (c *cloudHostKeys) confirm(req *http.Request, hostUUID, nonce string) error {
+	doc, _, err := c.verifiedDocument(req, hostUUID)
+	if err != nil {
+		return err
+	}
+
+	if nonce == "" || doc.Nonce != nonce {
+		return fmt.Errorf("identity document is not bound to the nonce of the request")
+	}
+	return nil
+}
+
+// verifiedDocument returns the document of req, signed by the cloud provider
+// for the instance hostUUID and the host key presented with it.
+func (c *cloudHostKeys) verifiedDocument(req *http.Request, hostUUID string) (*InstanceIdentityDocument, string, error) {
+	doc, err := c.verifyDocument(req.Header.Get(IdentityDocumentHeader), req.Header.Get(IdentitySignatureHeader))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if doc.InstanceID != hostUUID {
+		return nil, "", fmt.Errorf("identity document is for instance: %s not: %s", doc.InstanceID, hostUUID)
+	}
+
+	hostKey, err := base64.StdEncoding.DecodeString(req.Header.Get(HostPublicKeyHeader))
+	if err != nil || len(hostKey) == 0 {
+		return nil, "", fmt.Errorf("missing host public key")
+	}
+
+	if doc.HostKeySHA256 != HostKeyFingerprint(hostKey) {
+		return nil, "", fmt.Errorf("identity document is not bound to the presented host key")
+	}
+
+	return doc, string(hostKey), nil
+}
+
+// HostKeyFingerprint is the hex encoded SHA-256 of the PEM encoded host key
+// an identity document names.
+func HostKeyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyDocument checks the base64 encoded document was signed by the cloud
+// provider with RSA PKCS #1 v1.5 over SHA-256.
+func (c *cloudHostKeys) verifyDocument(encodedDoc, encodedSig string) (*InstanceIdentityDocument, error) {
+	content, err := base64.StdEncoding.DecodeString(encodedDoc)
+	if err != nil || len(content) == 0 {
+		return nil, fmt.Errorf("missing identity document")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity document signature")
+	}
+
+	hashed := sha256.Sum256(content)
+	if err := rsa.VerifyPKCS1v15(c.providerKey, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, fmt.Errorf("identity document signature did not verify: %s", err)
+	}
+
+	doc := &InstanceIdentityDocument{}
+	if err := json.Unmarshal(content, doc); err != nil {
+		return nil, err
+	}
+	if doc.InstanceID == "" {
+		return nil, fmt.Errorf("identity document has no instance ID")
+	}
+
+	return doc, nil
+}
+
+// hostProvider is how the host is verified. Hosts in the host keys file are
+// static hosts, hosts verified before keep their provider, others are cloud
+// hosts if they present an identity document and Rancher hosts otherwise.
+func hostProvider(req *http.Request, hostUUID string) string {
+	if static, ok := hostKeySources[IdentityStatic].(*staticHostKeys); ok {
+		if _, ok := static.keys[hostUUID]; ok {
+			return IdentityStatic
+		}
+	}
+	if host, ok := knownHosts.lookup(hostUUID); ok {
+		return host.Provider
+	}
+	if req.Header.Get(IdentityDocumentHeader) != "" {
+		return IdentityCloud
+	}
+	return IdentityRancher
+}
+
+// hostKeySourceFor returns the provider of the host that sent req and the
+// source of its key.
+func hostKeySourceFor(req *http.Request, hostUUID string) (string, hostKeySource, error) {
+	provider := hostProvider(req, hostUUID)
+	source, ok := hostKeySources[provider]
+	if !ok {
+		return provider, nil, fmt.Errorf("host identity provider: %s is not enabled", provider)
+	}
+
+	return provider, source, nil
+}
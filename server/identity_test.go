@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+func publicKeyPEM(t *testing.T, key *rsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestCloudHostKeys(t *testing.T) {
+	providerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := path.Join(t.TempDir(), "cloud.pem")
+	if err := ioutil.WriteFile(certFile, publicKeyPEM(t, providerKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := newCloudHostKeys(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registryFile := path.Join(t.TempDir(), "hosts.json")
+	savedSources, savedHosts, savedSeen, savedChallenges := hostKeySources, knownHosts, seenNonces, challenges
+	defer func() {
+		hostKeySources, knownHosts, seenNonces, challenges = savedSources, savedHosts, savedSeen, savedChallenges
+	}()
+	hostKeySources = map[string]hostKeySource{IdentityCloud: keys}
+	seenNonces, challenges = &nonceCache{}, newChallengeIssuer()
+	if knownHosts, err = loadHostRegistry(registryFile); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeyPEM, otherKeyPEM := publicKeyPEM(t, hostKey), publicKeyPEM(t, otherKey)
+
+	// signDocument is what the metadata service returns for a key and nonce.
+	signDocument := func(key *rsa.PrivateKey, instanceID string, publicKey []byte, nonce string) ([]byte, []byte) {
+		document, _ := json.Marshal(&InstanceIdentityDocument{InstanceID: instanceID, HostKeySHA256: HostKeyFingerprint(publicKey), Nonce: nonce})
+		hashed := sha256.Sum256(document)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return document, sig
+	}
+	challenge := func() string {
+		nonce, _ := challenges.issue(time.Now().Add(time.Minute))
+		return nonce
+	}
+	verify := func(signer *rsa.PrivateKey, presented []byte, nonce string, document, sig []byte) (bool, error) {
+		msg := &VaultTokenExpireInput{Accessor: "abc", HostUUID: "i-0123456789", Nonce: nonce}
+		params, msgSig, err := signature.SignV2(msg, "DELETE", "/v1-vault-driver/tokens", signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("DELETE", "/v1-vault-driver/tokens", nil)
+		req.Header.Set(SignatureHeaderString, base64.StdEncoding.EncodeToString(msgSig))
+		req.Header.Set(SignatureParamsHeader, params)
+		req.Header.Set(IdentityDocumentHeader, base64.StdEncoding.EncodeToString(document))
+		req.Header.Set(IdentitySignatureHeader, base64.StdEncoding.EncodeToString(sig))
+		req.Header.Set(HostPublicKeyHeader, base64.StdEncoding.EncodeToString(presented))
+
+		_, verified, err := verifySignature(req, msg.HostUUID, msg)
+		return verified && err == nil, err
+	}
+
+	// Nothing is pinned for a request the host did not sign.
+	nonce := challenge()
+	document, sig := signDocument(providerKey, "i-0123456789", hostKeyPEM, nonce)
+	if ok, _ := verify(otherKey, hostKeyPEM, nonce, document, sig); ok {
+		t.Errorf("expected a request signed with another key to be rejected")
+	}
+	if _, ok := knownHosts.lookup("i-0123456789"); ok {
+		t.Errorf("expected nothing to be recorded for a request that did not verify")
+	}
+
+	nonce = challenge()
+	document, sig = signDocument(providerKey, "i-0123456789", hostKeyPEM, nonce)
+	if ok, err := verify(hostKey, hostKeyPEM, nonce, document, sig); !ok {
+		t.Fatalf("expected the host to verify: %v", err)
+	}
+
+	// The document and the challenge can only be used once.
+	if ok, _ := verify(hostKey, hostKeyPEM, nonce, document, sig); ok {
+		t.Errorf("expected a replayed request to be rejected")
+	}
+	if ok, _ := verify(hostKey, hostKeyPEM, challenge(), document, sig); ok {
+		t.Errorf("expected a document for another nonce to be rejected")
+	}
+	if ok, _ := verify(hostKey, hostKeyPEM, "made-up", document, sig); ok {
+		t.Errorf("expected a nonce the server did not issue to be rejected")
+	}
+
+	// The document only vouches for the key it names.
+	nonce = challenge()
+	document, sig = signDocument(providerKey, "i-0123456789", hostKeyPEM, nonce)
+	if ok, _ := verify(otherKey, otherKeyPEM, nonce, document, sig); ok {
+		t.Errorf("expected a document for another key to be rejected")
+	}
+
+	nonce = challenge()
+	document, sig = signDocument(otherKey, "i-0123456789", hostKeyPEM, nonce)
+	if ok, _ := verify(hostKey, hostKeyPEM, nonce, document, sig); ok {
+		t.Errorf("expected a forged document to be rejected")
+	}
+
+	nonce = challenge()
+	document, sig = signDocument(providerKey, "i-other", hostKeyPEM, nonce)
+	if ok, _ := verify(hostKey, hostKeyPEM, nonce, document, sig); ok {
+		t.Errorf("expected a document of another instance to be rejected")
+	}
+
+	// The pinned key survives a restart, another key is rejected.
+	if knownHosts, err = loadHostRegistry(registryFile); err != nil {
+		t.Fatal(err)
+	}
+	if host, ok := knownHosts.lookup("i-0123456789"); !ok || host.Provider != IdentityCloud || host.PublicKey != string(hostKeyPEM) {
+		t.Errorf("expected the host key to be pinned, got: %#v", host)
+	}
+
+	nonce = challenge()
+	document, sig = signDocument(providerKey, "i-0123456789", otherKeyPEM, nonce)
+	if ok, _ := verify(otherKey, otherKeyPEM, nonce, document, sig); ok {
+		t.Errorf("expected a different key for a pinned instance to be rejected")
+	}
+
+	nonce = challenge()
+	document, sig = signDocument(providerKey, "i-0123456789", hostKeyPEM, nonce)
+	if ok, err := verify(hostKey, hostKeyPEM, nonce, document, sig); !ok {
+		t.Errorf("expected the pinned host to verify: %v", err)
+	}
+}
+
+func TestHostProvider(t *testing.T) {
+	savedSources, savedHosts := hostKeySources, knownHosts
+	defer func() { hostKeySources, knownHosts = savedSources, savedHosts }()
+	hostKeySources = map[string]hostKeySource{
+		IdentityStatic: &staticHostKeys{keys: map[string]string{"host-1": "PEM"}},
+	}
+	knownHosts = &hostRegistry{hosts: map[string]*knownHost{}}
+
+	// The provider header of the driver is not trusted.
+	req, _ := http.NewRequest("POST", "/v1-vault-driver/tokens", nil)
+	req.Header.Set(IdentityProviderHeader, IdentityStatic)
+	if provider := hostProvider(req, "host-2"); provider != IdentityRancher {
+		t.Errorf("expected an unknown host to be a Rancher host, got: %s", provider)
+	}
+	if provider := hostProvider(req, "host-1"); provider != IdentityStatic {
+		t.Errorf("expected a host of the keys file to be static, got: %s", provider)
+	}
+	if _, _, err := hostKeySourceFor(req, "host-2"); err == nil {
+		t.Errorf("expected a provider that is not enabled to be rejected")
+	}
+
+	req.Header.Set(IdentityDocumentHeader, "document")
+	if provider := hostProvider(req, "host-2"); provider != IdentityCloud {
+		t.Errorf("expected a host with a document to be a cloud host, got: %s", provider)
+	}
+
+	// A host keeps the provider it was verified with.
+	if err := knownHosts.record("host-2", IdentityRancher, ""); err != nil {
+		t.Fatal(err)
+	}
+	if provider := hostProvider(req, "host-2"); provider != IdentityRancher {
+		t.Errorf("expected the recorded provider, got: %s", provider)
+	}
+}
+
+func TestStaticHostKeys(t *testing.T) {
+	keysFile := path.Join(t.TempDir(), "hosts.json")
+	if err := ioutil.WriteFile(keysFile, []byte(`{"host-1": "PEM"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := newStaticHostKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := keys.PublicKey(nil, "host-1"); err != nil || key != "PEM" {
+		t.Errorf("expected the registered key, got: %q %v", key, err)
+	}
+	if _, err := keys.PublicKey(nil, "host-2"); err == nil {
+		t.Errorf("expected an unknown host to be rejected")
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher/api"
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+var (
+	// signatureSkew is how far the timestamp of a signed request may be from
+	// the clock of the server, either way.
+	signatureSkew = signature.TimeWindow
+	// requireNonce refuses signed requests without a nonce, requireChallenge
+	// only accepts nonces the server issued as challenges.
+	requireNonce     bool
+	requireChallenge bool
+
+	seenNonces = &nonceCache{}
+	challenges = newChallengeIssuer()
+)
+
+// challengeIssuer issues challenges without keeping them. A challenge is a
+// random value and its expiry with an HMAC under a key only this process
+// knows, so anyone can ask for one without taking server memory. Using a
+// challenge once is enforced by seenNonces, which only grows with requests
+// whose signature verified.
+type challengeIssuer struct {
+	key []byte
+}
+
+func newChallengeIssuer() *challengeIssuer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &challengeIssuer{key: key}
+}
+
+// issue returns a challenge that is valid until expires.
+func (c *challengeIssuer) issue(expires time.Time) (string, error) {
+	nonce, err := signature.NewNonce()
+	if err != nil {
+		return "", err
+	}
+
+	value := fmt.Sprintf("%s.%d", nonce, expires.Unix())
+	return value + "." + c.mac(value), nil
+}
+
+// verify returns when the challenge expires, false if it was not issued
+// by this server or has expired.
+func (c *challengeIssuer) verify(challenge string) (time.Time, bool) {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	value := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(c.mac(value))) {
+		return time.Time{}, false
+	}
+
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	return expires, time.Now().Before(expires)
+}
+
+func (c *challengeIssuer) mac(value string) string {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// nonceCache remembers nonces until they expire.
+type nonceCache struct {
+	mu      sync.Mutex
+	nonces  map[string]time.Time
+	checked time.Time
+}
+
+// add records the nonce until expires, false if it is already recorded.
+func (c *nonceCache) add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.prune(now)
+
+	if expiry, ok := c.nonces[nonce]; ok && now.Before(expiry) {
+		return false
+	}
+	c.nonces[nonce] = expires
+	return true
+}
+
+// prune drops expired nonces, at most once a second.
+func (c *nonceCache) prune(now time.Time) {
+	if c.nonces == nil {
+		c.nonces = map[string]time.Time{}
+	}
+	if now.Sub(c.checked) < time.Second {
+		return
+	}
+	c.checked = now
+
+	for nonce, expiry := range c.nonces {
+		if !now.Before(expiry) {
+			delete(c.nonces, nonce)
+		}
+	}
+}
+
+// checkNonce refuses a signed message whose nonce was seen before. A nonce is
+// remembered for twice the skew, older messages fail the timestamp check.
+// With challenge set, or requireChallenge, the nonce must be a challenge.
+func checkNonce(hostUUID string, msg signature.Message, challenge bool) error {
+	challenge = challenge || requireChallenge
+
+	nonce := messageNonce(msg)
+	if nonce == "" {
+		if requireNonce || challenge {
+			return fmt.Errorf("request has no nonce")
+		}
+		return nil
+	}
+
+	if challenge {
+		expires, ok := challenges.verify(nonce)
+		if !ok {
+			return fmt.Errorf("nonce was not issued by this server or has expired")
+		}
+		// A challenge is used once, by any host.
+		if !seenNonces.add("challenge/"+nonce, expires) {
+			return fmt.Errorf("challenge was already used, refusing replayed request")
+		}
+	}
+
+	if !seenNonces.add(hostUUID+"/"+nonce, time.Now().Add(2*signatureSkew)) {
+		return fmt.Errorf("nonce was already used, refusing replayed request")
+	}
+	return nil
+}
+
+// messageNonce is the nonce of msg, empty if it has none.
+func messageNonce(msg signature.Message) string {
+	if nonced, ok := msg.(signature.NoncedMessage); ok {
+		return nonced.GetNonce()
+	}
+	return ""
+}
+
+// ChallengeRequest issues a nonce for the next signed request of a host, it
+// is valid for the skew window and can be used once. Nothing is stored until
+// a signed request uses it.
+func ChallengeRequest(rw http.ResponseWriter, req *http.Request) (int, error) {
+	apiContext := api.GetApiContext(req)
+
+	expires := time.Now().Add(signatureSkew)
+	nonce, err := challenges.issue(expires)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	apiContext.Write(&Challenge{
+		Nonce:     nonce,
+		ExpiresAt: expires.UTC().Format(time.RFC3339),
+	})
+	return http.StatusOK, nil
+}
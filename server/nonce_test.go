@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckNonce(t *testing.T) {
+	saved := seenNonces
+	defer func() { seenNonces = saved }()
+	seenNonces = &nonceCache{}
+
+	msg := &VaultTokenExpireInput{Accessor: "abc", Nonce: "one"}
+	if err := checkNonce("host-1", msg, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkNonce("host-1", msg, false); err == nil {
+		t.Errorf("expected the replayed nonce to be refused")
+	}
+	if err := checkNonce("host-2", msg, false); err != nil {
+		t.Errorf("nonces of different hosts must not collide: %s", err)
+	}
+
+	if err := checkNonce("host-1", &VaultTokenExpireInput{Accessor: "abc"}, false); err != nil {
+		t.Errorf("requests without a nonce are accepted by default: %s", err)
+	}
+
+	requireNonce = true
+	defer func() { requireNonce = false }()
+	if err := checkNonce("host-1", &VaultTokenExpireInput{Accessor: "abc"}, false); err == nil {
+		t.Errorf("expected a request without a nonce to be refused")
+	}
+}
+
+func TestCheckNonceChallenge(t *testing.T) {
+	savedSeen, savedChallenges := seenNonces, challenges
+	defer func() { seenNonces, challenges = savedSeen, savedChallenges }()
+	seenNonces, challenges = &nonceCache{}, newChallengeIssuer()
+
+	requireChallenge = true
+	defer func() { requireChallenge = false }()
+
+	issued, _ := challenges.issue(time.Now().Add(time.Minute))
+	expired, _ := challenges.issue(time.Now().Add(-time.Second))
+	forged, _ := newChallengeIssuer().issue(time.Now().Add(time.Minute))
+	extended := strings.Replace(expired, fmt.Sprintf(".%d.", time.Now().Add(-time.Second).Unix()), fmt.Sprintf(".%d.", time.Now().Add(time.Hour).Unix()), 1)
+
+	for _, nonce := range []string{"made-up", forged} {
+		if err := checkNonce("host-1", &VaultTokenInput{Nonce: nonce}, false); err == nil {
+			t.Errorf("expected a nonce the server did not issue to be refused")
+		}
+	}
+	for _, nonce := range []string{expired, extended} {
+		if err := checkNonce("host-1", &VaultTokenInput{Nonce: nonce}, false); err == nil {
+			t.Errorf("expected an expired challenge to be refused")
+		}
+	}
+	if err := checkNonce("host-1", &VaultTokenInput{Nonce: issued}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkNonce("host-2", &VaultTokenInput{Nonce: issued}, false); err == nil {
+		t.Errorf("expected a challenge to be usable once")
+	}
+}
+
+func TestCheckNonceChallengeRequired(t *testing.T) {
+	savedSeen, savedChallenges := seenNonces, challenges
+	defer func() { seenNonces, challenges = savedSeen, savedChallenges }()
+	seenNonces, challenges = &nonceCache{}, newChallengeIssuer()
+
+	// Attested hosts need a challenge even if the server does not require
+	// them.
+	issued, _ := challenges.issue(time.Now().Add(time.Minute))
+	if err := checkNonce("host-1", &VaultTokenInput{}, true); err == nil {
+		t.Errorf("expected a request without a nonce to be refused")
+	}
+	if err := checkNonce("host-1", &VaultTokenInput{Nonce: "made-up"}, true); err == nil {
+		t.Errorf("expected a nonce the server did not issue to be refused")
+	}
+	if err := checkNonce("host-1", &VaultTokenInput{Nonce: issued}, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNonceCoveredBySignature(t *testing.T) {
+	msg := &VaultTokenInput{Policies: "app", HostUUID: "host", TimeStamp: "now"}
+	legacy := string(msg.Prepare())
+
+	msg.Nonce = "abc"
+	if string(msg.Prepare()) == legacy || legacy != "app,host,now" {
+		t.Errorf("expected the nonce in the signed fields, got: %s", msg.Prepare())
+	}
+}
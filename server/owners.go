@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Kinds of secrets hosts register after Vault issued them.
+const (
+	SecretLease = "lease"
+	// SecretCertificate is identified by <mount>/<serial number>.
+	SecretCertificate = "certificate"
+)
+
+// secretOwners records which host registered a lease or certificate, only
+// that host may revoke it. Records are kept until the secret is revoked or
+// expires.
+var secretOwners = &ownerStore{owners: map[string]*secretOwner{}}
+
+type secretOwner struct {
+	Host    string    `json:"host"`
+	Expires time.Time `json:"expires"`
+}
+
+// ownerStore keeps the owners in memory and, if path is set, in a JSON file
+// so they survive a restart.
+type ownerStore struct {
+	mu     sync.Mutex
+	path   string
+	owners map[string]*secretOwner
+}
+
+func loadOwnerStore(path string) (*ownerStore, error) {
+	store := &ownerStore{path: path, owners: map[string]*secretOwner{}}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &store.owners); err != nil {
+			return nil, fmt.Errorf("invalid owners file: %s: %s", path, err)
+		}
+	}
+
+	return store, nil
+}
+
+// claim records host as the owner of the secret with id. A secret another
+// host registered can not be claimed again.
+func (s *ownerStore) claim(kind, id, host string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := kind + "/" + id
+	if owner, ok := s.owners[key]; ok && owner.Host != host && time.Now().Before(owner.Expires) {
+		return fmt.Errorf("%s: %s is registered to another host", kind, id)
+	}
+	s.owners[key] = &secretOwner{Host: host, Expires: expires}
+
+	return s.save()
+}
+
+// check fails unless host registered the secret with id.
+func (s *ownerStore) check(kind, id, host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owner, ok := s.owners[kind+"/"+id]
+	if !ok {
+		return fmt.Errorf("%s: %s was not registered by a host", kind, id)
+	}
+	if owner.Host != host {
+		return fmt.Errorf("%s: %s is registered to another host", kind, id)
+	}
+	return nil
+}
+
+// release forgets the owner of a revoked secret.
+func (s *ownerStore) release(kind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.owners, kind+"/"+id)
+	return s.save()
+}
+
+// save drops expired records and writes the rest, the caller holds the lock.
+func (s *ownerStore) save() error {
+	now := time.Now()
+	for key, owner := range s.owners {
+		if !now.Before(owner.Expires) {
+			delete(s.owners, key)
+		}
+	}
+
+	if s.path == "" {
+		return nil
+	}
+	return writeJSONFile(s.path, s.owners)
+}
+
+// writeJSONFile replaces name with the JSON encoding of v through a
+// temporary file, a crash never leaves a partial file behind.
+func writeJSONFile(name string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
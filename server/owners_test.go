@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+// fakeLeaseVault knows the leases under database/creds/ and the certificate
+// with serial 0a from pki, it records what was revoked.
+func fakeLeaseVault(t *testing.T, revoked *[]string) *httptest.Server {
+	certificate := testCertificatePEM(t)
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/v1/pki/cert/0a":
+			certJSON, _ := json.Marshal(certificate)
+			fmt.Fprintf(rw, `{"data": {"certificate": %s}}`, certJSON)
+		case req.URL.Path == "/v1/pki/revoke":
+			body := map[string]string{}
+			json.NewDecoder(req.Body).Decode(&body)
+			*revoked = append(*revoked, "pki/"+body["serial_number"])
+			fmt.Fprint(rw, `{"data": {}}`)
+		case req.URL.Path == "/v1/sys/leases/lookup":
+			body := map[string]string{}
+			json.NewDecoder(req.Body).Decode(&body)
+			if !strings.HasPrefix(body["lease_id"], "database/creds/") {
+				rw.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(rw, `{"errors": ["invalid lease"]}`)
+				return
+			}
+			fmt.Fprintf(rw, `{"data": {"id": %q, "expire_time": %q}}`, body["lease_id"], time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+		case strings.HasPrefix(req.URL.Path, "/v1/sys/leases/revoke/"):
+			*revoked = append(*revoked, strings.TrimPrefix(req.URL.Path, "/v1/sys/leases/revoke/"))
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func testCertificatePEM(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(10),
+		Subject:      pkix.Name{CommonName: "web.example.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// withSecretOwnerState registers host-1 and host-2 with static keys and
+// points the server at vaultAddr, it returns a function sending signed
+// requests as a host.
+func withSecretOwnerState(t *testing.T, vaultAddr string) func(method, route, hostUUID string, msg signature.CanonicalMessage) int {
+	keys := map[string]*rsa.PrivateKey{}
+	static := &staticHostKeys{keys: map[string]string{}}
+	for _, host := range []string{"host-1", "host-2"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[host] = key
+		static.keys[host] = string(publicKeyPEM(t, key))
+	}
+
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = vaultAddr
+	vClient, err := api.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedSources, savedHosts, savedSeen, savedVault, savedOwners, savedPrefixes, savedMounts := hostKeySources, knownHosts, seenNonces, vaultClient, secretOwners, revocableLeasePrefixes, revocablePKIMounts
+	t.Cleanup(func() {
+		hostKeySources, knownHosts, seenNonces, vaultClient, secretOwners, revocableLeasePrefixes, revocablePKIMounts = savedSources, savedHosts, savedSeen, savedVault, savedOwners, savedPrefixes, savedMounts
+	})
+	hostKeySources = map[string]hostKeySource{IdentityStatic: static}
+	knownHosts = &hostRegistry{hosts: map[string]*knownHost{}}
+	seenNonces = &nonceCache{}
+	vaultClient = &VaultClient{vClient: vClient}
+	revocableLeasePrefixes = []string{"database/creds/", "aws/creds/"}
+	revocablePKIMounts = []string{"pki", "pki-other"}
+	if secretOwners, err = loadOwnerStore(path.Join(t.TempDir(), "owners.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewRouter()
+	return func(method, route, hostUUID string, msg signature.CanonicalMessage) int {
+		params, sig, err := signature.SignV2(msg, method, route, keys[hostUUID])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := json.Marshal(msg)
+		req := httptest.NewRequest(method, route, bytes.NewReader(body))
+		req.Header.Set(SignatureHeaderString, base64.StdEncoding.EncodeToString(sig))
+		req.Header.Set(SignatureParamsHeader, params)
+
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw.Code
+	}
+}
+
+func TestLeaseOwnership(t *testing.T) {
+	revoked := []string{}
+	ts := fakeLeaseVault(t, &revoked)
+	defer ts.Close()
+	send := withSecretOwnerState(t, ts.URL)
+
+	register := func(hostUUID, leaseID string) int {
+		return send("POST", "/v1-vault-driver/secrets", hostUUID, &VaultSecretRegisterInput{Kind: SecretLease, ID: leaseID, HostUUID: hostUUID})
+	}
+	revoke := func(hostUUID, leaseID string) int {
+		return send("DELETE", "/v1-vault-driver/leases", hostUUID, &VaultLeaseRevokeInput{LeaseID: leaseID, HostUUID: hostUUID})
+	}
+
+	if code := register("host-1", "database/creds/app/1"); code != http.StatusCreated {
+		t.Fatalf("expected the lease to be registered, got: %d", code)
+	}
+	// Registering again is harmless, another host can not take it over.
+	if code := register("host-1", "database/creds/app/1"); code != http.StatusCreated {
+		t.Errorf("expected a repeated registration to succeed, got: %d", code)
+	}
+	if code := register("host-2", "database/creds/app/1"); code != http.StatusForbidden {
+		t.Errorf("expected another host to be refused, got: %d", code)
+	}
+
+	// Leases outside the revocable prefixes or unknown to Vault are refused.
+	if code := register("host-1", "secret/creds/app/1"); code != http.StatusForbidden {
+		t.Errorf("expected a lease outside the prefixes to be refused, got: %d", code)
+	}
+	if code := register("host-1", "aws/creds/app/1"); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown lease to be refused, got: %d", code)
+	}
+	if code := send("POST", "/v1-vault-driver/secrets", "host-1", &VaultSecretRegisterInput{Kind: "token", ID: "x", HostUUID: "host-1"}); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown kind to be refused, got: %d", code)
+	}
+
+	if code := revoke("host-2", "database/creds/app/1"); code != http.StatusForbidden {
+		t.Errorf("expected another host to be refused, got: %d", code)
+	}
+	if code := revoke("host-1", "database/creds/app/2"); code != http.StatusForbidden {
+		t.Errorf("expected an unregistered lease to be refused, got: %d", code)
+	}
+	if len(revoked) != 0 {
+		t.Fatalf("unexpected revocations: %v", revoked)
+	}
+
+	if code := revoke("host-1", "database/creds/app/1"); code != http.StatusAccepted {
+		t.Errorf("expected the owner to revoke, got: %d", code)
+	}
+	if len(revoked) != 1 || revoked[0] != "database/creds/app/1" {
+		t.Errorf("unexpected revocations: %v", revoked)
+	}
+
+	// A revoked lease is forgotten.
+	if code := revoke("host-1", "database/creds/app/1"); code != http.StatusForbidden {
+		t.Errorf("expected the revoked lease to be forgotten, got: %d", code)
+	}
+}
+
+func TestCertificateOwnership(t *testing.T) {
+	revoked := []string{}
+	ts := fakeLeaseVault(t, &revoked)
+	defer ts.Close()
+	send := withSecretOwnerState(t, ts.URL)
+
+	register := func(hostUUID, id string) int {
+		return send("POST", "/v1-vault-driver/secrets", hostUUID, &VaultSecretRegisterInput{Kind: SecretCertificate, ID: id, HostUUID: hostUUID})
+	}
+	revoke := func(hostUUID, mount, serial string) int {
+		return send("DELETE", "/v1-vault-driver/certificates", hostUUID, &VaultCertificateRevokeInput{Mount: mount, SerialNumber: serial, HostUUID: hostUUID})
+	}
+
+	if code := register("host-1", "/pki/0a"); code != http.StatusCreated {
+		t.Fatalf("expected the certificate to be registered, got: %d", code)
+	}
+	if code := register("host-2", "pki/0a"); code != http.StatusForbidden {
+		t.Errorf("expected another host to be refused, got: %d", code)
+	}
+
+	// Certificates outside the revocable mounts or unknown to Vault are refused.
+	if code := register("host-1", "root-ca/0a"); code != http.StatusForbidden {
+		t.Errorf("expected a certificate outside the mounts to be refused, got: %d", code)
+	}
+	if code := register("host-1", "pki-other/0b"); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown certificate to be refused, got: %d", code)
+	}
+
+	if code := revoke("host-2", "pki", "0a"); code != http.StatusForbidden {
+		t.Errorf("expected another host to be refused, got: %d", code)
+	}
+	if len(revoked) != 0 {
+		t.Fatalf("unexpected revocations: %v", revoked)
+	}
+
+	if code := revoke("host-1", "pki", "0a"); code != http.StatusAccepted {
+		t.Errorf("expected the owner to revoke, got: %d", code)
+	}
+	if len(revoked) != 1 || revoked[0] != "pki/0a" {
+		t.Errorf("unexpected revocations: %v", revoked)
+	}
+	if code := revoke("host-1", "pki", "0a"); code != http.StatusForbidden {
+		t.Errorf("expected the revoked certificate to be forgotten, got: %d", code)
+	}
+}
+
+func TestOwnerStore(t *testing.T) {
+	ownersFile := path.Join(t.TempDir(), "owners.json")
+	store, err := loadOwnerStore(ownersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.claim(SecretLease, "database/creds/app/1", "host-1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.claim(SecretLease, "database/creds/app/2", "host-1", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Owners survive a restart, expired ones are dropped.
+	if store, err = loadOwnerStore(ownersFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.check(SecretLease, "database/creds/app/1", "host-1"); err != nil {
+		t.Errorf("expected the owner to be kept: %s", err)
+	}
+	if err := store.check(SecretLease, "database/creds/app/2", "host-1"); err == nil {
+		t.Errorf("expected the expired owner to be dropped")
+	}
+
+	// An expired owner no longer blocks a claim.
+	store.owners[SecretLease+"/database/creds/app/1"].Expires = time.Now().Add(-time.Second)
+	if err := store.claim(SecretLease, "database/creds/app/1", "host-2", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("expected the expired lease to be claimable: %s", err)
+	}
+}
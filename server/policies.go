@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/secrets-bridge-v2/rancher"
+)
+
+// PoliciesLabel lists the Vault policies volumes of a service may request,
+// comma separated.
+const PoliciesLabel = "io.rancher.secrets-bridge.policies"
+
+const rootPolicy = "root"
+
+var (
+	// deniedPolicies are never issued, whatever the labels allow. root is
+	// denied even if it is left out.
+	deniedPolicies = []string{rootPolicy}
+	// hostPolicies may be requested by volumes of hosts outside Rancher,
+	// which have no Rancher labels.
+	hostPolicies []string
+	// volumePolicies looks up the policies the services mounting a Rancher
+	// volume allow.
+	volumePolicies = rancherVolumePolicies
+)
+
+// policyError is returned when a request asks for policies it may not have.
+type policyError struct {
+	policies []string
+	reason   string
+}
+
+func (p policyError) Error() string {
+	return fmt.Sprintf("policies: %s %s", strings.Join(p.policies, ","), p.reason)
+}
+
+// normalizePolicies trims the policy names and drops empty and repeated ones,
+// the order of the first occurrence is kept.
+func normalizePolicies(policies []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, policy := range policies {
+		policy = strings.TrimSpace(policy)
+		if policy == "" || seen[policy] {
+			continue
+		}
+		seen[policy] = true
+		normalized = append(normalized, policy)
+	}
+	return normalized
+}
+
+// authorizePolicies returns the requested policies that are allowed. Denied
+// policies and policies outside allowed fail the whole request.
+func authorizePolicies(requested string, allowed []string) ([]string, error) {
+	policies := normalizePolicies(strings.Split(requested, ","))
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("no policies requested")
+	}
+
+	denied := map[string]bool{rootPolicy: true}
+	for _, policy := range normalizePolicies(deniedPolicies) {
+		denied[policy] = true
+	}
+
+	permitted := map[string]bool{}
+	for _, policy := range normalizePolicies(allowed) {
+		permitted[policy] = !denied[policy]
+	}
+
+	var refused, notAllowed, granted []string
+	for _, policy := range policies {
+		switch {
+		case denied[policy]:
+			refused = append(refused, policy)
+		case !permitted[policy]:
+			notAllowed = append(notAllowed, policy)
+		default:
+			granted = append(granted, policy)
+		}
+	}
+
+	if len(refused) > 0 {
+		return nil, policyError{policies: refused, reason: "are never issued to hosts"}
+	}
+	if len(notAllowed) > 0 {
+		return nil, policyError{policies: notAllowed, reason: "are not allowed for this volume"}
+	}
+	return granted, nil
+}
+
+// allowedPolicies returns the policies the volume of msg may request.
+func allowedPolicies(msg *VaultTokenInput, provider string) ([]string, error) {
+	if provider != IdentityRancher {
+		return hostPolicies, nil
+	}
+	return volumePolicies(msg.VolumeName)
+}
+
+func rancherVolumePolicies(volumeName string) ([]string, error) {
+	labels, err := rancher.GetVolumeServiceLabels(rancherClient, volumeName, PoliciesLabel)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.Join(labels, ","), ","), nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizePolicies(t *testing.T) {
+	policies := normalizePolicies([]string{" app", "db ", "", "app", "  "})
+	if !reflect.DeepEqual(policies, []string{"app", "db"}) {
+		t.Errorf("unexpected policies: %v", policies)
+	}
+}
+
+func TestAuthorizePolicies(t *testing.T) {
+	saved := deniedPolicies
+	defer func() { deniedPolicies = saved }()
+	deniedPolicies = []string{"admin"}
+
+	allowed := []string{"app", " db", "admin", "root"}
+
+	granted, err := authorizePolicies("db, app,db", allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(granted, []string{"db", "app"}) {
+		t.Errorf("unexpected policies: %v", granted)
+	}
+
+	for _, requested := range []string{"app,other", "root", "admin", " , ", "app,root"} {
+		if _, err := authorizePolicies(requested, allowed); err == nil {
+			t.Errorf("expected %q to be refused", requested)
+		}
+	}
+
+	if _, err := authorizePolicies("app", nil); err == nil {
+		t.Errorf("expected everything to be refused without allowed policies")
+	}
+}
+
+func TestAllowedPolicies(t *testing.T) {
+	savedHost, savedVolume := hostPolicies, volumePolicies
+	defer func() { hostPolicies, volumePolicies = savedHost, savedVolume }()
+
+	hostPolicies = []string{"pods"}
+	volumePolicies = func(volumeName string) ([]string, error) {
+		return []string{volumeName + "-policy"}, nil
+	}
+
+	pod := &VaultTokenInput{VolumeName: "web", PodName: "web-0"}
+	if policies, _ := allowedPolicies(pod, IdentityStatic); !reflect.DeepEqual(policies, []string{"pods"}) {
+		t.Errorf("expected the host policies for pods, got: %v", policies)
+	}
+
+	volume := &VaultTokenInput{VolumeName: "web"}
+	if policies, _ := allowedPolicies(volume, IdentityStatic); !reflect.DeepEqual(policies, []string{"pods"}) {
+		t.Errorf("expected the host policies outside Rancher, got: %v", policies)
+	}
+	if policies, _ := allowedPolicies(volume, IdentityRancher); !reflect.DeepEqual(policies, []string{"web-policy"}) {
+		t.Errorf("expected the service label policies, got: %v", policies)
+	}
+}
+
+func TestPodRequestsOfRancherHosts(t *testing.T) {
+	msg := &VaultTokenInput{Policies: "app", HostUUID: "host-1", VolumeName: "web", PodName: "web-0"}
+	body, _ := json.Marshal(msg)
+
+	// Refused before anything is looked up in Rancher.
+	req, _ := http.NewRequest("POST", "http://server/v1-vault-driver/tokens", bytes.NewReader(body))
+	if _, err := newVerifiedVaultTokenInput(req); err == nil {
+		t.Errorf("expected pod fields from a Rancher host to be refused")
+	}
+}
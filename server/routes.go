@@ -43,6 +43,7 @@ func NewRouter() *mux.Router {
 
 	schemas.AddType("vaultTokenInput", VaultTokenInput{})
 	schemas.AddType("vaultIntermediateToken", VaultIntermediateTokenResponse{})
+	schemas.AddType("challenge", Challenge{})
 
 	err := schemas.AddType("error", errObj{})
 	err.CollectionMethods = []string{}
@@ -60,8 +61,12 @@ func NewRouter() *mux.Router {
 	router.Methods("GET").Path("/v1-vault-driver/schemas/{id}/").Handler(api.SchemaHandler(schemas))
 
 	// Application Routes
+	router.Methods("GET").Path("/v1-vault-driver/challenge").Handler(f(schemas, ChallengeRequest))
 	router.Methods("POST").Path("/v1-vault-driver/tokens").Handler(f(schemas, CreateTokenRequest))
 	router.Methods("DELETE").Path("/v1-vault-driver/tokens").Handler(f(schemas, RevokeTokenRequest))
+	router.Methods("DELETE").Path("/v1-vault-driver/leases").Handler(f(schemas, RevokeLeaseRequest))
+	router.Methods("POST").Path("/v1-vault-driver/secrets").Handler(f(schemas, RegisterSecretRequest))
+	router.Methods("DELETE").Path("/v1-vault-driver/certificates").Handler(f(schemas, RevokeCertificateRequest))
 
 	router.Methods("GET").Path("/healthcheck").Handler(f(schemas, HealthCheck))
 
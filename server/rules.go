@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/secrets-bridge-v2/rancher"
+	"sigs.k8s.io/yaml"
+)
+
+// accessRules are loaded from the rules file, nil without one.
+var accessRules *AccessRules
+
+// AccessRules is the rules file. The first rule matching a token request
+// decides what may be granted to it. Without a match the request falls back
+// to the policy labels, or is refused when DenyByDefault is set.
+type AccessRules struct {
+	DenyByDefault bool          `json:"denyByDefault"`
+	Rules         []*AccessRule `json:"rules"`
+}
+
+// AccessRule maps match criteria to what the server may grant. Deny refuses
+// matching requests.
+type AccessRule struct {
+	Name      string    `json:"name"`
+	Match     RuleMatch `json:"match"`
+	Deny      bool      `json:"deny,omitempty"`
+	Policies  []string  `json:"policies,omitempty"`
+	MaxTTL    string    `json:"maxTTL,omitempty"`
+	Renewable *bool     `json:"renewable,omitempty"`
+	NumUses   int       `json:"numUses,omitempty"`
+	WrapTTL   string    `json:"wrapTTL,omitempty"`
+}
+
+// RuleMatch values are globs, an empty value matches anything. Every host
+// label listed has to match.
+type RuleMatch struct {
+	Environment string            `json:"environment,omitempty"`
+	Stack       string            `json:"stack,omitempty"`
+	Service     string            `json:"service,omitempty"`
+	HostLabels  map[string]string `json:"hostLabels,omitempty"`
+	Volume      string            `json:"volume,omitempty"`
+	Provider    string            `json:"provider,omitempty"`
+}
+
+// RuleRequest is what is known about a token request to match rules against.
+// Services are the services mounting the volume, a rule matches if any does.
+type RuleRequest struct {
+	Environment string
+	Stack       string
+	Services    []string
+	HostLabels  map[string]string
+	Volume      string
+	Provider    string
+}
+
+// tokenGrant is what a request may be issued.
+type tokenGrant struct {
+	rule      *AccessRule
+	policies  []string
+	maxTTL    string
+	renewable *bool
+	numUses   int
+	wrapTTL   string
+}
+
+// LoadAccessRules reads and validates a rules file, YAML if it ends in .yaml
+// or .yml and JSON otherwise.
+func LoadAccessRules(rulesFile string) (*AccessRules, error) {
+	content, err := ioutil.ReadFile(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	unmarshal := json.Unmarshal
+	switch strings.ToLower(filepath.Ext(rulesFile)) {
+	case ".yaml", ".yml":
+		unmarshal = func(content []byte, v interface{}) error {
+			return yaml.Unmarshal(content, v)
+		}
+	}
+
+	rules := &AccessRules{}
+	if err := unmarshal(content, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %s got: %s", rulesFile, err)
+	}
+
+	return rules, rules.validate()
+}
+
+func (a *AccessRules) validate() error {
+	for i, rule := range a.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule: %d is empty", i)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		globs := []string{rule.Match.Environment, rule.Match.Stack, rule.Match.Service, rule.Match.Volume, rule.Match.Provider}
+		for _, value := range rule.Match.HostLabels {
+			globs = append(globs, value)
+		}
+		for _, glob := range globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("rule: %s has an invalid glob: %s", rule.Name, glob)
+			}
+		}
+
+		for _, ttl := range []string{rule.MaxTTL, rule.WrapTTL} {
+			if _, err := time.ParseDuration(ttl); ttl != "" && err != nil {
+				return fmt.Errorf("rule: %s has an invalid ttl: %s", rule.Name, ttl)
+			}
+		}
+
+		if rule.NumUses < 0 {
+			return fmt.Errorf("rule: %s numUses must not be negative", rule.Name)
+		}
+
+		if !rule.Deny && len(normalizePolicies(rule.Policies)) == 0 {
+			return fmt.Errorf("rule: %s grants no policies", rule.Name)
+		}
+	}
+	return nil
+}
+
+// Match returns the first rule matching the request, nil if none does.
+func (a *AccessRules) Match(req *RuleRequest) *AccessRule {
+	for _, rule := range a.Rules {
+		if rule.Match.matches(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (m *RuleMatch) matches(req *RuleRequest) bool {
+	if !globMatch(m.Environment, req.Environment) || !globMatch(m.Stack, req.Stack) ||
+		!globMatch(m.Volume, req.Volume) || !globMatch(m.Provider, req.Provider) {
+		return false
+	}
+
+	if m.Service != "" {
+		matched := false
+		for _, service := range req.Services {
+			matched = matched || globMatch(m.Service, service)
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for key, glob := range m.HostLabels {
+		value, ok := req.HostLabels[key]
+		if !ok || !globMatch(glob, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func globMatch(glob, value string) bool {
+	if glob == "" {
+		return true
+	}
+	matched, _ := path.Match(glob, value)
+	return matched
+}
+
+// grant returns what the matched rule allows.
+func (r *AccessRule) grant() *tokenGrant {
+	return &tokenGrant{
+		rule:      r,
+		policies:  r.Policies,
+		maxTTL:    r.MaxTTL,
+		renewable: r.Renewable,
+		numUses:   r.NumUses,
+		wrapTTL:   r.WrapTTL,
+	}
+}
+
+// grantFor works out what a verified token request may be issued, from the
+// access rules if there are any and the policy labels otherwise.
+func grantFor(req *http.Request, msg *VaultTokenInput) (*tokenGrant, error) {
+	provider := hostProvider(req, msg.HostUUID)
+
+	if accessRules != nil {
+		ruleReq, err := ruleRequestFor(msg, provider)
+		if err != nil {
+			return nil, err
+		}
+
+		rule := accessRules.Match(ruleReq)
+		switch {
+		case rule != nil && rule.Deny:
+			return nil, policyError{policies: []string{msg.Policies}, reason: fmt.Sprintf("are denied by rule: %s", rule.Name)}
+		case rule != nil:
+			return rule.grant(), nil
+		case accessRules.DenyByDefault:
+			return nil, policyError{policies: []string{msg.Policies}, reason: "are denied, no access rule matches the request"}
+		}
+	}
+
+	policies, err := allowedPolicies(msg, provider)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenGrant{policies: policies}, nil
+}
+
+// ruleRequestFor looks up what Rancher knows about the volume and the host.
+// Hosts outside Rancher only have their volume name and provider.
+func ruleRequestFor(msg *VaultTokenInput, provider string) (*RuleRequest, error) {
+	ruleReq := &RuleRequest{
+		Volume:   msg.VolumeName,
+		Provider: provider,
+	}
+
+	if provider != IdentityRancher {
+		return ruleReq, nil
+	}
+
+	host, err := rancher.GetHost(rancherClient, msg.HostUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleReq.HostLabels = map[string]string{}
+	for key, value := range host.Labels {
+		if value, ok := value.(string); ok {
+			ruleReq.HostLabels[key] = value
+		}
+	}
+
+	if ruleReq.Environment, err = rancher.GetEnvironmentName(rancherClient, host); err != nil {
+		return nil, err
+	}
+
+	stack, services, err := rancher.GetVolumeServices(rancherClient, msg.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleReq.Stack = stack.Name
+	for _, service := range services {
+		ruleReq.Services = append(ruleReq.Services, service.Name)
+	}
+	return ruleReq, nil
+}
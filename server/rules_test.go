@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRules = `{
+	"rules": [
+		{"name": "no-prod-db", "match": {"environment": "prod", "service": "db*"}, "deny": true},
+		{"name": "web", "match": {"stack": "web-*", "hostLabels": {"zone": "eu-*"}}, "policies": ["web", "logs"], "maxTTL": "1h", "renewable": false, "numUses": 5, "wrapTTL": "30s"},
+		{"name": "static", "match": {"provider": "static", "volume": "batch-?"}, "policies": ["batch"]}
+	]
+}`
+
+const testRulesYAML = `
+rules:
+  - name: no-prod-db
+    match: {environment: prod, service: "db*"}
+    deny: true
+  - name: web
+    match:
+      stack: "web-*"
+      hostLabels:
+        zone: "eu-*"
+    policies: [web, logs]
+    maxTTL: 1h
+    renewable: false
+    numUses: 5
+    wrapTTL: 30s
+  - name: static
+    match: {provider: static, volume: "batch-?"}
+    policies: [batch]
+`
+
+func writeRules(t *testing.T, content string) string {
+	return writeRulesFile(t, "rules.json", content)
+}
+
+func writeRulesFile(t *testing.T, name, content string) string {
+	rulesFile := path.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(rulesFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return rulesFile
+}
+
+func TestAccessRulesMatch(t *testing.T) {
+	rules, err := LoadAccessRules(writeRules(t, testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		req  *RuleRequest
+		rule string
+	}{
+		{&RuleRequest{Environment: "prod", Services: []string{"app", "db-main"}}, "no-prod-db"},
+		{&RuleRequest{Environment: "prod", Stack: "web-1", Services: []string{"app"}, HostLabels: map[string]string{"zone": "eu-west"}}, "web"},
+		{&RuleRequest{Stack: "web-1", HostLabels: map[string]string{"zone": "us-east"}}, ""},
+		{&RuleRequest{Stack: "web-1"}, ""},
+		{&RuleRequest{Provider: IdentityStatic, Volume: "batch-1"}, "static"},
+		{&RuleRequest{Provider: IdentityStatic, Volume: "batch-10"}, ""},
+	} {
+		name := ""
+		if rule := rules.Match(test.req); rule != nil {
+			name = rule.Name
+		}
+		if name != test.rule {
+			t.Errorf("expected rule: %q for %#v, got: %q", test.rule, test.req, name)
+		}
+	}
+}
+
+func TestLoadAccessRulesYAML(t *testing.T) {
+	expected, err := LoadAccessRules(writeRules(t, testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"rules.yaml", "rules.YML"} {
+		rules, err := LoadAccessRules(writeRulesFile(t, name, testRulesYAML))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(rules, expected) {
+			t.Errorf("%s: expected the rules of the JSON file, got: %#v", name, rules)
+		}
+	}
+
+	// YAML is a superset of JSON.
+	if _, err := LoadAccessRules(writeRulesFile(t, "rules.yaml", testRules)); err != nil {
+		t.Errorf("expected JSON in a .yaml file to load: %s", err)
+	}
+
+	for _, content := range []string{
+		"rules:\n  - name: bad\n    policies: [a]\n    maxTTL: forever\n",
+		"rules:\n  - name: bad\n    policies: [a]\n    numUses: many\n",
+		"rules: [\n",
+	} {
+		if _, err := LoadAccessRules(writeRulesFile(t, "rules.yml", content)); err == nil {
+			t.Errorf("expected error for: %s", content)
+		}
+	}
+}
+
+func TestLoadAccessRulesInvalid(t *testing.T) {
+	for _, content := range []string{
+		`{"rules": [{"name": "bad", "match": {"stack": "["}, "policies": ["a"]}]}`,
+		`{"rules": [{"name": "bad", "policies": ["a"], "maxTTL": "forever"}]}`,
+		`{"rules": [{"name": "bad", "policies": [" "]}]}`,
+		`{"rules": [{"name": "bad", "policies": ["a"], "numUses": -1}]}`,
+		`{"rules": [null]}`,
+		`rules: []`,
+	} {
+		if _, err := LoadAccessRules(writeRules(t, content)); err == nil {
+			t.Errorf("expected error for: %s", content)
+		}
+	}
+}
+
+func TestGrantForRules(t *testing.T) {
+	saved := accessRules
+	defer func() { accessRules = saved }()
+
+	var err error
+	if accessRules, err = LoadAccessRules(writeRules(t, testRules)); err != nil {
+		t.Fatal(err)
+	}
+
+	savedSources := hostKeySources
+	defer func() { hostKeySources = savedSources }()
+	hostKeySources = map[string]hostKeySource{
+		IdentityStatic: &staticHostKeys{keys: map[string]string{"host-1": "PEM"}},
+	}
+
+	req, _ := http.NewRequest("POST", "/v1-vault-driver/tokens", nil)
+
+	grant, err := grantFor(req, &VaultTokenInput{VolumeName: "batch-1", Policies: "batch", HostUUID: "host-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.rule == nil || grant.rule.Name != "static" || !reflect.DeepEqual(grant.policies, []string{"batch"}) {
+		t.Errorf("unexpected grant: %#v", grant)
+	}
+
+	accessRules.DenyByDefault = true
+	if _, err := grantFor(req, &VaultTokenInput{VolumeName: "other", Policies: "batch", HostUUID: "host-1"}); err == nil {
+		t.Errorf("expected the request to be denied by default")
+	} else if _, ok := err.(policyError); !ok {
+		t.Errorf("expected a policy error, got: %s", err)
+	}
+}
+
+func TestPrintRuleMatch(t *testing.T) {
+	rules, err := LoadAccessRules(writeRules(t, testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	req := &RuleRequest{Stack: "web-2", HostLabels: map[string]string{"zone": "eu-north"}}
+	if err := printRuleMatch(out, rules, req, "web,admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"rule: web matches", "maxTTL:    1h", "renewable: false", "numUses:   5", "request refused: policies: admin"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	rules.DenyByDefault = true
+	printRuleMatch(out, rules, &RuleRequest{}, "")
+	if !strings.Contains(out.String(), "denied") {
+		t.Errorf("expected the request to be denied, got: %s", out.String())
+	}
+}
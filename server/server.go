@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	"fmt"
 	"github.com/Sirupsen/logrus"
@@ -12,6 +13,8 @@ import (
 var listenAddress = ":8080"
 var vaultClient *VaultClient
 var rancherClient *client.RancherClient
+var revocableLeasePrefixes []string
+var revocablePKIMounts []string
 
 // Config contains config info for server setup.
 type Config struct {
@@ -21,6 +24,34 @@ type Config struct {
 	RancherURL    string
 	RancherAccess string
 	RancherSecret string
+	LeasePrefixes []string
+	PKIMounts     []string
+	// OwnersFile keeps the hosts leases and certificates were registered
+	// to across restarts.
+	OwnersFile string
+	// HostRegistryFile keeps the provider each host was verified with and
+	// the keys pinned to cloud hosts across restarts.
+	HostRegistryFile string
+	// HostKeysFile registers hosts outside Rancher, CloudIdentityCert
+	// verifies cloud instance identity documents. Both are optional.
+	HostKeysFile      string
+	CloudIdentityCert string
+	// HostPolicies may be requested by volumes without Rancher labels,
+	// DeniedPolicies are never issued.
+	HostPolicies   []string
+	DeniedPolicies []string
+	// RulesFile holds the access rules, DenyByDefault refuses requests no
+	// rule matches even without one.
+	RulesFile     string
+	DenyByDefault bool
+	// SignatureSkew bounds the clock difference of signed requests,
+	// RequireNonce and RequireChallenge refuse requests without a nonce or
+	// without a server issued one.
+	SignatureSkew    time.Duration
+	RequireNonce     bool
+	RequireChallenge bool
+	// RequireSignatureV2 refuses requests signed with v1.
+	RequireSignatureV2 bool
 }
 
 type ConfigError struct {
@@ -51,6 +82,61 @@ func startServer(config *Config) error {
 		return err
 	}
 
+	hostKeySources[IdentityRancher] = &rancherHostKeys{client: rancherClient}
+
+	if config.HostKeysFile != "" {
+		if hostKeySources[IdentityStatic], err = newStaticHostKeys(config.HostKeysFile); err != nil {
+			logrus.Errorf("failed to load host keys: %s", err)
+			return err
+		}
+	}
+
+	if config.CloudIdentityCert != "" {
+		if hostKeySources[IdentityCloud], err = newCloudHostKeys(config.CloudIdentityCert); err != nil {
+			logrus.Errorf("failed to load cloud identity certificate: %s", err)
+			return err
+		}
+	}
+
+	if config.HostRegistryFile != "" {
+		if knownHosts, err = loadHostRegistry(config.HostRegistryFile); err != nil {
+			logrus.Errorf("failed to load host registry: %s", err)
+			return err
+		}
+	}
+
+	if config.OwnersFile != "" {
+		if secretOwners, err = loadOwnerStore(config.OwnersFile); err != nil {
+			logrus.Errorf("failed to load secret owners: %s", err)
+			return err
+		}
+	}
+
+	revocableLeasePrefixes = config.LeasePrefixes
+	revocablePKIMounts = config.PKIMounts
+	hostPolicies = config.HostPolicies
+	deniedPolicies = config.DeniedPolicies
+
+	if config.SignatureSkew > 0 {
+		signatureSkew = config.SignatureSkew
+	}
+	requireNonce = config.RequireNonce
+	requireChallenge = config.RequireChallenge
+	requireSignatureV2 = config.RequireSignatureV2
+
+	if config.RulesFile != "" {
+		if accessRules, err = LoadAccessRules(config.RulesFile); err != nil {
+			logrus.Errorf("failed to load access rules: %s", err)
+			return err
+		}
+	}
+	if config.DenyByDefault {
+		if accessRules == nil {
+			accessRules = &AccessRules{}
+		}
+		accessRules.DenyByDefault = true
+	}
+
 	router := NewRouter()
 	logrus.Infof("Starting server on: %s", listenAddress)
 	return http.ListenAndServe(listenAddress, router)
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+func TestVerifySignatureVersions(t *testing.T) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedSources, savedHosts, savedSeen := hostKeySources, knownHosts, seenNonces
+	defer func() { hostKeySources, knownHosts, seenNonces = savedSources, savedHosts, savedSeen }()
+	knownHosts = &hostRegistry{hosts: map[string]*knownHost{}}
+	hostKeySources = map[string]hostKeySource{
+		IdentityStatic: &staticHostKeys{keys: map[string]string{"host-1": string(publicKeyPEM(t, hostKey))}},
+	}
+	seenNonces = &nonceCache{}
+
+	newRequest := func(msg *VaultTokenInput, version int) *http.Request {
+		var sig []byte
+		var params string
+		var err error
+		if version == signature.Version2 {
+			params, sig, err = signature.SignV2(msg, "POST", "/v1-vault-driver/tokens", hostKey)
+		} else {
+			sig, err = signature.Sign(msg, hostKey)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := json.Marshal(msg)
+		req, _ := http.NewRequest("POST", "http://server/v1-vault-driver/tokens", bytes.NewReader(body))
+		req.Header.Set(SignatureHeaderString, base64.StdEncoding.EncodeToString(sig))
+		if params != "" {
+			req.Header.Set(SignatureParamsHeader, params)
+		}
+		return req
+	}
+
+	for _, version := range []int{1, signature.Version2} {
+		msg := &VaultTokenInput{Policies: "app", HostUUID: "host-1", VolumeName: "web"}
+		if _, verified, err := verifySignature(newRequest(msg, version), "host-1", msg); !verified || err != nil {
+			t.Errorf("v%d signature was not verified: %v", version, err)
+		}
+	}
+
+	// Only v2 covers the volume name.
+	msg := &VaultTokenInput{Policies: "app", HostUUID: "host-1", VolumeName: "web"}
+	req := newRequest(msg, signature.Version2)
+	msg.VolumeName = "other"
+	if _, verified, _ := verifySignature(req, "host-1", msg); verified {
+		t.Errorf("expected a retargeted v2 request to be refused")
+	}
+
+	// v2 covers the encryption key, the token can not be redirected to
+	// another key.
+	msg = &VaultTokenInput{Policies: "app", HostUUID: "host-1", VolumeName: "web", EncryptionKey: "host"}
+	req = newRequest(msg, signature.Version2)
+	msg.EncryptionKey = "attacker"
+	if _, verified, _ := verifySignature(req, "host-1", msg); verified {
+		t.Errorf("expected a request with another encryption key to be refused")
+	}
+
+	requireSignatureV2 = true
+	defer func() { requireSignatureV2 = false }()
+
+	msg = &VaultTokenInput{Policies: "app", HostUUID: "host-1", VolumeName: "web"}
+	if _, verified, err := verifySignature(newRequest(msg, 1), "host-1", msg); verified || err == nil {
+		t.Errorf("expected v1 signatures to be refused")
+	}
+}
+
+func TestCheckTokenSignatureVersion(t *testing.T) {
+	v1, _ := http.NewRequest("POST", "/v1-vault-driver/tokens", nil)
+	v2, _ := http.NewRequest("POST", "/v1-vault-driver/tokens", nil)
+	v2.Header.Set(SignatureParamsHeader, "params")
+
+	plain := &VaultTokenInput{Policies: "app", HostUUID: "host-1", VolumeName: "web"}
+	if err := checkTokenSignatureVersion(v1, plain, IdentityStatic); err != nil {
+		t.Errorf("expected v1 to be accepted for a static host, got: %s", err)
+	}
+
+	for _, msg := range []*VaultTokenInput{
+		{Policies: "app", HostUUID: "host-1", PodName: "web-0"},
+		{Policies: "app", HostUUID: "host-1", EncryptionKey: "key"},
+	} {
+		if err := checkTokenSignatureVersion(v1, msg, IdentityStatic); err == nil {
+			t.Errorf("expected v1 to be refused for: %#v", msg)
+		}
+		if err := checkTokenSignatureVersion(v2, msg, IdentityStatic); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Rancher hosts are authorized by the service labels of the volume.
+	if err := checkTokenSignatureVersion(v1, plain, IdentityRancher); err == nil {
+		t.Errorf("expected v1 to be refused for a rancher host")
+	}
+
+	savedRules := accessRules
+	defer func() { accessRules = savedRules }()
+	accessRules = &AccessRules{}
+	if err := checkTokenSignatureVersion(v1, plain, IdentityStatic); err == nil {
+		t.Errorf("expected v1 to be refused with access rules")
+	}
+	if err := checkTokenSignatureVersion(v2, plain, IdentityRancher); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenEncryptionKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecDER}))
+
+	encryptionKey, err := signature.NewEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := signature.EncodeEncryptionKey(encryptionKey.PublicKey())
+
+	if key, err := tokenEncryptionKey(string(publicKeyPEM(t, rsaKey)), ""); err != nil {
+		t.Errorf("expected the RSA host key: %s", err)
+	} else if _, ok := key.(*rsa.PublicKey); !ok {
+		t.Errorf("expected the RSA host key, got: %T", key)
+	}
+
+	// Keys that only sign need a separate encryption key.
+	if _, err := tokenEncryptionKey(ecPEM, ""); err == nil {
+		t.Errorf("expected an ECDSA host key without an encryption key to be refused")
+	}
+
+	key, err := tokenEncryptionKey(ecPEM, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewVaultTokenResponse(&IntermediateToken{Token: "token", Accessor: "abc"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := signature.Decrypt(encryptionKey, resp.EncryptedToken); err != nil || string(token) != "token" {
+		t.Errorf("expected the token back, got: %q %v", token, err)
+	}
+
+	if _, err := tokenEncryptionKey(ecPEM, "not a key"); err == nil {
+		t.Errorf("expected an invalid encryption key to be refused")
+	}
+}
@@ -1,12 +1,34 @@
 package server
 
 import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+
 	"github.com/rancher/go-rancher/client"
-	"github.com/rancher/secrets-api/pkg/rsautils"
+	"github.com/rancher/secrets-bridge-v2/signature"
 )
 
+// tokenEncryptionKey is the key the token of a request is encrypted to, the
+// encryption key the host sent or else its RSA key. Other host keys only
+// sign.
+func tokenEncryptionKey(pubKey, encryptionKey string) (crypto.PublicKey, error) {
+	if encryptionKey != "" {
+		return signature.ParseEncryptionKey(encryptionKey)
+	}
+
+	hostKey, err := signature.LoadPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := hostKey.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("hosts with a key other than RSA must send an encryption key")
+	}
+	return hostKey, nil
+}
+
 // NewVaultTokenResponse returns a VaultIntermedateTokenResponse object
-func NewVaultTokenResponse(intermediateToken *IntermediateToken, pubKey string) (*VaultIntermediateTokenResponse, error) {
+func NewVaultTokenResponse(intermediateToken *IntermediateToken, key crypto.PublicKey) (*VaultIntermediateTokenResponse, error) {
 	resp := &VaultIntermediateTokenResponse{
 		Resource: client.Resource{
 			Type: "vaultIntermediateToken",
@@ -14,11 +36,7 @@ func NewVaultTokenResponse(intermediateToken *IntermediateToken, pubKey string)
 		Accessor: intermediateToken.Accessor,
 	}
 
-	pubKeyEncryptor, err := rsautils.PublicKeyFromString(pubKey)
-	if err != nil {
-		return resp, err
-	}
-
-	resp.EncryptedToken, err = pubKeyEncryptor.Encrypt(intermediateToken.Token)
+	var err error
+	resp.EncryptedToken, err = signature.Encrypt(key, []byte(intermediateToken.Token))
 	return resp, err
 }
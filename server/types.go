@@ -18,34 +18,184 @@ type VaultTokenInput struct {
 	HostUUID   string `json:"hostUUID"`
 	TimeStamp  string `json:"timestamp"`
 	VolumeName string `json:"volumeName"`
+	// The pod fields are set for Kubernetes volumes, they are recorded in
+	// the token metadata. They are reported by the host and not verified,
+	// Rancher hosts can not send them.
+	PodName        string `json:"podName,omitempty"`
+	PodNamespace   string `json:"podNamespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// Nonce is signed with the request, the server refuses to see it twice.
+	Nonce string `json:"nonce,omitempty"`
+	// EncryptionKey is the X25519 key the token is encrypted to for hosts
+	// whose key can only sign, the host key is used without it.
+	EncryptionKey string `json:"encryptionKey,omitempty"`
 }
 
 type verifiedVaultTokenInput struct {
 	Policies  string
 	PublicKey string
+	Metadata  map[string]string
+	// Input is the verified request, access is decided from it.
+	Input *VaultTokenInput
 }
 
 type VaultIntermediateTokenResponse struct {
 	client.Resource
-	// EncryptedToken is the Vault Token RSA Encrypted with the hosts public key.
-	// This prevents replay attacks from another host.
+	// EncryptedToken is the Vault Token RSA Encrypted with the hosts public key,
+	// or encrypted to the encryption key of the request. This prevents replay
+	// attacks from another host.
 	EncryptedToken string `json:"encryptedToken"`
 	Accessor       string `json:"accessor"`
 }
 
+// Challenge is a nonce issued by the server, hosts sign it into their next
+// request when the server requires challenges.
+type Challenge struct {
+	client.Resource
+	Nonce     string `json:"nonce"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
 type VaultTokenExpireInput struct {
 	client.Resource
 	Accessor  string `json:"accessor"`
 	TimeStamp string `json:"timestamp"`
 	HostUUID  string `json:"hostUUID"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+type VaultLeaseRevokeInput struct {
+	client.Resource
+	LeaseID   string `json:"leaseId"`
+	TimeStamp string `json:"timestamp"`
+	HostUUID  string `json:"hostUUID"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+type VaultCertificateRevokeInput struct {
+	client.Resource
+	Mount        string `json:"mount"`
+	SerialNumber string `json:"serialNumber"`
+	TimeStamp    string `json:"timestamp"`
+	HostUUID     string `json:"hostUUID"`
+	Nonce        string `json:"nonce,omitempty"`
+}
+
+// VaultSecretRegisterInput registers a secret Vault issued to the host, only
+// the host that registered it may revoke it.
+type VaultSecretRegisterInput struct {
+	client.Resource
+	Kind      string `json:"kind"`
+	ID        string `json:"id"`
+	TimeStamp string `json:"timestamp"`
+	HostUUID  string `json:"hostUUID"`
+	Nonce     string `json:"nonce,omitempty"`
 }
 
+// Prepare is the v1 format, it leaves out the volume name, the pod fields
+// and the encryption key. Token requests that need them are refused unless
+// they are signed with v2, see checkTokenSignatureVersion.
 func (vti *VaultTokenInput) Prepare() []byte {
-	return []byte(strings.Join([]string{vti.Policies, vti.HostUUID, vti.TimeStamp}, ","))
+	return []byte(strings.Join(withNonce([]string{vti.Policies, vti.HostUUID, vti.TimeStamp}, vti.Nonce), ","))
+}
+
+func (vti *VaultTokenInput) isPod() bool {
+	return vti.PodName != "" || vti.PodNamespace != "" || vti.ServiceAccount != ""
+}
+
+// metadata is recorded on the token so the Vault audit log shows which pod
+// it was issued to.
+func (vti *VaultTokenInput) metadata() map[string]string {
+	if !vti.isPod() {
+		return nil
+	}
+
+	return map[string]string{
+		"pod":            vti.PodName,
+		"namespace":      vti.PodNamespace,
+		"serviceAccount": vti.ServiceAccount,
+		"host":           vti.HostUUID,
+	}
 }
 
 func (vte *VaultTokenExpireInput) Prepare() []byte {
-	return []byte(strings.Join([]string{vte.Accessor, vte.TimeStamp, vte.HostUUID}, ","))
+	return []byte(strings.Join(withNonce([]string{vte.Accessor, vte.TimeStamp, vte.HostUUID}, vte.Nonce), ","))
+}
+
+func (vlr *VaultLeaseRevokeInput) Prepare() []byte {
+	return []byte(strings.Join(withNonce([]string{vlr.LeaseID, vlr.TimeStamp, vlr.HostUUID}, vlr.Nonce), ","))
+}
+
+func (vcr *VaultCertificateRevokeInput) Prepare() []byte {
+	return []byte(strings.Join(withNonce([]string{vcr.Mount, vcr.SerialNumber, vcr.TimeStamp, vcr.HostUUID}, vcr.Nonce), ","))
+}
+
+// Prepare starts with register, a v1 signature of a registration can not
+// be replayed as a revocation.
+func (vsr *VaultSecretRegisterInput) Prepare() []byte {
+	return []byte(strings.Join(withNonce([]string{"register", vsr.Kind, vsr.ID, vsr.TimeStamp, vsr.HostUUID}, vsr.Nonce), ","))
+}
+
+// Fields are signed by v2 signatures.
+func (vti *VaultTokenInput) Fields() map[string]string {
+	return map[string]string{
+		"policies":       vti.Policies,
+		"hostUUID":       vti.HostUUID,
+		"timestamp":      vti.TimeStamp,
+		"volumeName":     vti.VolumeName,
+		"podName":        vti.PodName,
+		"podNamespace":   vti.PodNamespace,
+		"serviceAccount": vti.ServiceAccount,
+		"nonce":          vti.Nonce,
+		"encryptionKey":  vti.EncryptionKey,
+	}
+}
+
+func (vte *VaultTokenExpireInput) Fields() map[string]string {
+	return map[string]string{
+		"accessor":  vte.Accessor,
+		"timestamp": vte.TimeStamp,
+		"hostUUID":  vte.HostUUID,
+		"nonce":     vte.Nonce,
+	}
+}
+
+func (vlr *VaultLeaseRevokeInput) Fields() map[string]string {
+	return map[string]string{
+		"leaseId":   vlr.LeaseID,
+		"timestamp": vlr.TimeStamp,
+		"hostUUID":  vlr.HostUUID,
+		"nonce":     vlr.Nonce,
+	}
+}
+
+func (vcr *VaultCertificateRevokeInput) Fields() map[string]string {
+	return map[string]string{
+		"mount":        vcr.Mount,
+		"serialNumber": vcr.SerialNumber,
+		"timestamp":    vcr.TimeStamp,
+		"hostUUID":     vcr.HostUUID,
+		"nonce":        vcr.Nonce,
+	}
+}
+
+func (vsr *VaultSecretRegisterInput) Fields() map[string]string {
+	return map[string]string{
+		"kind":      vsr.Kind,
+		"id":        vsr.ID,
+		"timestamp": vsr.TimeStamp,
+		"hostUUID":  vsr.HostUUID,
+		"nonce":     vsr.Nonce,
+	}
+}
+
+// withNonce appends the nonce, requests of drivers without nonces are signed
+// as before.
+func withNonce(fields []string, nonce string) []string {
+	if nonce == "" {
+		return fields
+	}
+	return append(fields, nonce)
 }
 
 func (vti *VaultTokenInput) SetTimeStamp() {
@@ -56,6 +206,18 @@ func (vte *VaultTokenExpireInput) SetTimeStamp() {
 	vte.TimeStamp = setTimeStamp()
 }
 
+func (vlr *VaultLeaseRevokeInput) SetTimeStamp() {
+	vlr.TimeStamp = setTimeStamp()
+}
+
+func (vcr *VaultCertificateRevokeInput) SetTimeStamp() {
+	vcr.TimeStamp = setTimeStamp()
+}
+
+func (vsr *VaultSecretRegisterInput) SetTimeStamp() {
+	vsr.TimeStamp = setTimeStamp()
+}
+
 func (vti *VaultTokenInput) GetTimeStamp() (*time.Time, error) {
 	return getTimeStampTime(vti.TimeStamp)
 }
@@ -64,6 +226,58 @@ func (vte *VaultTokenExpireInput) GetTimeStamp() (*time.Time, error) {
 	return getTimeStampTime(vte.TimeStamp)
 }
 
+func (vlr *VaultLeaseRevokeInput) GetTimeStamp() (*time.Time, error) {
+	return getTimeStampTime(vlr.TimeStamp)
+}
+
+func (vcr *VaultCertificateRevokeInput) GetTimeStamp() (*time.Time, error) {
+	return getTimeStampTime(vcr.TimeStamp)
+}
+
+func (vsr *VaultSecretRegisterInput) GetTimeStamp() (*time.Time, error) {
+	return getTimeStampTime(vsr.TimeStamp)
+}
+
+func (vti *VaultTokenInput) GetNonce() string {
+	return vti.Nonce
+}
+
+func (vte *VaultTokenExpireInput) GetNonce() string {
+	return vte.Nonce
+}
+
+func (vlr *VaultLeaseRevokeInput) GetNonce() string {
+	return vlr.Nonce
+}
+
+func (vcr *VaultCertificateRevokeInput) GetNonce() string {
+	return vcr.Nonce
+}
+
+func (vsr *VaultSecretRegisterInput) GetNonce() string {
+	return vsr.Nonce
+}
+
+func (vti *VaultTokenInput) SetNonce(nonce string) {
+	vti.Nonce = nonce
+}
+
+func (vte *VaultTokenExpireInput) SetNonce(nonce string) {
+	vte.Nonce = nonce
+}
+
+func (vlr *VaultLeaseRevokeInput) SetNonce(nonce string) {
+	vlr.Nonce = nonce
+}
+
+func (vcr *VaultCertificateRevokeInput) SetNonce(nonce string) {
+	vcr.Nonce = nonce
+}
+
+func (vsr *VaultSecretRegisterInput) SetNonce(nonce string) {
+	vsr.Nonce = nonce
+}
+
 func setTimeStamp() string {
 	timeByte, _ := time.Now().UTC().MarshalText()
 	return string(timeByte)
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -58,16 +61,32 @@ func NewVaultClient(url, token, role string) (*VaultClient, error) {
 	return client, nil
 }
 
-func (vc *VaultClient) NewWrappedVaultToken(policies []string) (*IntermediateToken, error) {
+func (vc *VaultClient) NewWrappedVaultToken(policies []string, metadata map[string]string, grant *tokenGrant) (*IntermediateToken, error) {
 	token := &IntermediateToken{}
 
+	renewable := vc.instanceTokenConfig.Renewable
+	wrapTTL := vc.instanceTokenConfig.IntermediateTTL
+
 	tokenCreateRequest := &api.TokenCreateRequest{
 		Policies:  policies,
+		Metadata:  metadata,
 		TTL:       vc.instanceTokenConfig.TTL,
-		Renewable: &vc.instanceTokenConfig.Renewable,
+		Renewable: &renewable,
 	}
 
-	sec, err := vc.createVaultToken(tokenCreateRequest)
+	// A matched access rule limits the token further.
+	if grant != nil {
+		tokenCreateRequest.ExplicitMaxTTL = grant.maxTTL
+		tokenCreateRequest.NumUses = grant.numUses
+		if grant.renewable != nil {
+			renewable = *grant.renewable
+		}
+		if grant.wrapTTL != "" {
+			wrapTTL = grant.wrapTTL
+		}
+	}
+
+	sec, err := vc.createVaultToken(tokenCreateRequest, wrapTTL)
 	if err != nil {
 		return token, err
 	}
@@ -82,12 +101,70 @@ func (vc *VaultClient) RevokeToken(accessor string) error {
 	return vc.vClient.Auth().Token().RevokeAccessor(accessor)
 }
 
-func (vc *VaultClient) createVaultToken(tcr *api.TokenCreateRequest) (*api.Secret, error) {
+func (vc *VaultClient) RevokeLease(leaseID string) error {
+	return vc.vClient.Sys().Revoke(leaseID)
+}
+
+// LeaseExpiry looks the lease up, an unknown lease is an error.
+func (vc *VaultClient) LeaseExpiry(leaseID string) (time.Time, error) {
+	secret, err := vc.vClient.Logical().Write("sys/leases/lookup", map[string]interface{}{
+		"lease_id": leaseID,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if secret == nil || secret.Data == nil {
+		return time.Time{}, fmt.Errorf("lease: %s not found", leaseID)
+	}
+
+	expires, _ := secret.Data["expire_time"].(string)
+	return time.Parse(time.RFC3339Nano, expires)
+}
+
+// CertificateExpiry reads the certificate from the PKI mount, an unknown
+// serial number is an error.
+func (vc *VaultClient) CertificateExpiry(mount, serialNumber string) (time.Time, error) {
+	secret, err := vc.vClient.Logical().Read(strings.Trim(mount, "/") + "/cert/" + serialNumber)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if secret == nil || secret.Data == nil {
+		return time.Time{}, fmt.Errorf("certificate: %s not found", serialNumber)
+	}
+
+	certPEM, _ := secret.Data["certificate"].(string)
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return time.Time{}, fmt.Errorf("certificate: %s has no PEM data", serialNumber)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+func (vc *VaultClient) RevokeCertificate(mount, serialNumber string) error {
+	_, err := vc.vClient.Logical().Write(strings.Trim(mount, "/")+"/revoke", map[string]interface{}{
+		"serial_number": serialNumber,
+	})
+	return err
+}
+
+func (vc *VaultClient) createVaultToken(tcr *api.TokenCreateRequest, wrapTTL string) (*api.Secret, error) {
+	// The wrap TTL differs between requests, a clone keeps the header off
+	// the shared client.
+	client, err := vc.vClient.Clone()
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(vc.vClient.Token())
+
 	header := http.Header{}
-	header.Add("X-Vault-Wrap-TTL", vc.instanceTokenConfig.IntermediateTTL)
-	vc.vClient.SetHeaders(header)
+	header.Add("X-Vault-Wrap-TTL", wrapTTL)
+	client.SetHeaders(header)
 
-	return vc.vClient.Auth().Token().CreateWithRole(tcr, vc.role)
+	return client.Auth().Token().CreateWithRole(tcr, vc.role)
 }
 
 func (vc *VaultClient) vaultClient() error {
@@ -0,0 +1,114 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+)
+
+// Signature algorithms, named as in JWS. ECDSA signatures are ASN.1 DER
+// encoded.
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmPS256 = "PS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmES384 = "ES384"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// DefaultAlgorithm is the algorithm used for a key. RSA keys use PKCS #1
+// v1.5, the only algorithm v1 signatures have.
+func DefaultAlgorithm(key crypto.PublicKey) (string, error) {
+	name, err := keyType(key)
+	if err != nil {
+		return "", err
+	}
+
+	switch name {
+	case "RSA":
+		return AlgorithmRS256, nil
+	case "ECDSA P-256":
+		return AlgorithmES256, nil
+	case "ECDSA P-384":
+		return AlgorithmES384, nil
+	}
+	return AlgorithmEdDSA, nil
+}
+
+// checkAlgorithm fails if the algorithm can not be used with the key.
+func checkAlgorithm(algorithm string, key crypto.PublicKey) error {
+	name, err := keyType(key)
+	if err != nil {
+		return err
+	}
+
+	if algorithm == AlgorithmPS256 && name == "RSA" {
+		return nil
+	}
+	if defaultAlgorithm, _ := DefaultAlgorithm(key); algorithm == defaultAlgorithm {
+		return nil
+	}
+
+	switch algorithm {
+	case AlgorithmRS256, AlgorithmPS256, AlgorithmES256, AlgorithmES384, AlgorithmEdDSA:
+		return &UnsupportedAlgorithmError{Algorithm: algorithm, Key: name}
+	}
+	return &UnsupportedAlgorithmError{Algorithm: algorithm}
+}
+
+// digest hashes the input for the algorithm, EdDSA signs the input itself.
+func digest(algorithm string, input []byte) ([]byte, crypto.Hash) {
+	switch algorithm {
+	case AlgorithmES384:
+		hashed := sha512.Sum384(input)
+		return hashed[:], crypto.SHA384
+	case AlgorithmEdDSA:
+		return input, crypto.Hash(0)
+	}
+	hashed := sha256.Sum256(input)
+	return hashed[:], crypto.SHA256
+}
+
+func signWith(algorithm string, signer crypto.Signer, input []byte) ([]byte, error) {
+	if err := checkAlgorithm(algorithm, signer.Public()); err != nil {
+		return nil, err
+	}
+
+	hashed, hash := digest(algorithm, input)
+	switch algorithm {
+	case AlgorithmPS256:
+		return signer.Sign(rand.Reader, hashed, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	default:
+		// PKCS #1 v1.5 for RSA, ASN.1 DER for ECDSA and plain Ed25519.
+		return signer.Sign(rand.Reader, hashed, hash)
+	}
+}
+
+func verifyWith(algorithm string, key crypto.PublicKey, input, signature []byte) error {
+	if err := checkAlgorithm(algorithm, key); err != nil {
+		return err
+	}
+
+	hashed, hash := digest(algorithm, input)
+	switch algorithm {
+	case AlgorithmRS256:
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), hash, hashed, signature)
+	case AlgorithmPS256:
+		return rsa.VerifyPSS(key.(*rsa.PublicKey), hash, hashed, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case AlgorithmES256, AlgorithmES384:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hashed, signature) {
+			return fmt.Errorf("ecdsa: verification error")
+		}
+		return nil
+	}
+
+	if !ed25519.Verify(key.(ed25519.PublicKey), hashed, signature) {
+		return fmt.Errorf("ed25519: verification error")
+	}
+	return nil
+}
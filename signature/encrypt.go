@@ -0,0 +1,149 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+const encryptionInfo = "secrets-bridge-v2 host encryption"
+
+// NewEncryptionKey returns an X25519 key for a host whose signing key can
+// not be used for encryption. Signing keys are never reused for key
+// agreement, the host sends the public half with its signed request.
+func NewEncryptionKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodeEncryptionKey is the base64 encoded public encryption key.
+func EncodeEncryptionKey(publicKey *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey.Bytes())
+}
+
+// ParseEncryptionKey reverses EncodeEncryptionKey.
+func ParseEncryptionKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, &KeyParseError{Type: "X25519 encryption key", Err: err}
+	}
+
+	publicKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, &KeyParseError{Type: "X25519 encryption key", Err: err}
+	}
+	return publicKey, nil
+}
+
+// Encrypt encrypts plaintext to the host, so only the host can read the
+// token the server hands out. RSA host keys use RSA-OAEP with SHA-256 as
+// before. X25519 encryption keys use an ephemeral exchange with AES-256-GCM
+// under an HKDF-SHA256 derived key; the ephemeral public key and the GCM
+// nonce are prepended to the ciphertext.
+func Encrypt(publicKey crypto.PublicKey, plaintext []byte) (string, error) {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		cipherText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k, plaintext, nil)
+		return base64.StdEncoding.EncodeToString(cipherText), err
+	case *ecdh.PublicKey:
+		return encryptECDH(k, plaintext)
+	}
+
+	keyName, err := keyType(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return "", &UnsupportedKeyError{Key: keyName + " keys can not encrypt, a separate encryption key is required"}
+}
+
+// Decrypt reverses Encrypt with the RSA host key or the X25519 encryption
+// key.
+func Decrypt(privateKey crypto.PrivateKey, cipherText string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, k, data, nil)
+	case *ecdh.PrivateKey:
+		return decryptECDH(k, data)
+	}
+	return nil, &UnsupportedKeyError{Key: fmt.Sprintf("%T can not decrypt", privateKey)}
+}
+
+func encryptECDH(recipient *ecdh.PublicKey, plaintext []byte) (string, error) {
+	if recipient.Curve() != ecdh.X25519() {
+		return "", &UnsupportedKeyError{Key: "encryption keys must be X25519"}
+	}
+
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := sharedCipher(ephemeral, recipient, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	out = aead.Seal(out, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func decryptECDH(own *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	keySize := len(own.PublicKey().Bytes())
+	if len(data) < keySize {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+
+	ephemeral, err := own.Curve().NewPublicKey(data[:keySize])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := sharedCipher(own, ephemeral, ephemeral, own.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[keySize:]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// sharedCipher derives the AES-GCM cipher from the exchange between private
+// and peer. The key is bound to the ephemeral and recipient public keys.
+func sharedCipher(private *ecdh.PrivateKey, peer, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	info := encryptionInfo + string(ephemeral.Bytes()) + string(recipient.Bytes())
+	key, err := hkdf.Key(sha256.New, shared, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,48 @@
+package signature
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoPEMBlock is returned when a key has no PEM data.
+var ErrNoPEMBlock = errors.New("no PEM data found in key")
+
+// KeyParseError is returned when the PEM block of a key can not be parsed.
+type KeyParseError struct {
+	// Type is the type of the PEM block, e.g. "PRIVATE KEY".
+	Type string
+	Err  error
+}
+
+func (e *KeyParseError) Error() string {
+	return fmt.Sprintf("failed to parse %s: %s", e.Type, e.Err)
+}
+
+func (e *KeyParseError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedKeyError is returned for key types and curves that can not be
+// used to sign requests.
+type UnsupportedKeyError struct {
+	Key string
+}
+
+func (e *UnsupportedKeyError) Error() string {
+	return fmt.Sprintf("unsupported key: %s", e.Key)
+}
+
+// UnsupportedAlgorithmError is returned when an algorithm is unknown or does
+// not fit the key.
+type UnsupportedAlgorithmError struct {
+	Algorithm string
+	Key       string
+}
+
+func (e *UnsupportedAlgorithmError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("unsupported signature algorithm: %s", e.Algorithm)
+	}
+	return fmt.Sprintf("signature algorithm: %s can not be used with a %s key", e.Algorithm, e.Key)
+}
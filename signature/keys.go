@@ -0,0 +1,91 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// LoadPrivateKey parses a PEM encoded PKCS #1 RSA, SEC 1 EC or PKCS #8 RSA,
+// ECDSA or Ed25519 private key. ECDSA keys must be on P-256 or P-384.
+func LoadPrivateKey(key string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, ErrNoPEMBlock
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, &UnsupportedKeyError{Key: block.Type}
+	}
+	if err != nil {
+		return nil, &KeyParseError{Type: block.Type, Err: err}
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, &UnsupportedKeyError{Key: fmt.Sprintf("%T", parsed)}
+	}
+
+	if _, err := keyType(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// LoadPublicKey parses a PEM encoded PKCS #1 RSA public key or a PKIX public
+// key. Like rsautils, any other block type is read as PKIX.
+func LoadPublicKey(key string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, ErrNoPEMBlock
+	}
+
+	var parsed crypto.PublicKey
+	var err error
+	if block.Type == "RSA PUBLIC KEY" {
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, &KeyParseError{Type: block.Type, Err: err}
+	}
+
+	if _, err := keyType(parsed); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// keyType names the key, it fails for keys requests can not be signed with.
+func keyType(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ECDSA P-256", nil
+		case elliptic.P384():
+			return "ECDSA P-384", nil
+		}
+		return "", &UnsupportedKeyError{Key: "ECDSA " + k.Curve.Params().Name}
+	case ed25519.PublicKey:
+		return "Ed25519", nil
+	}
+	return "", &UnsupportedKeyError{Key: fmt.Sprintf("%T", key)}
+}
@@ -0,0 +1,229 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func encodePEM(t *testing.T, blockType string, der []byte, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+// testKeys returns PEM encoded private and public keys of every supported
+// type, in every supported format, by name.
+func testKeys(t *testing.T) map[string][2]string {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkcs8 := func(key crypto.Signer) [2]string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		private := encodePEM(t, "PRIVATE KEY", der, err)
+		der, err = x509.MarshalPKIXPublicKey(key.Public())
+		return [2]string{private, encodePEM(t, "PUBLIC KEY", der, err)}
+	}
+	sec1 := func(key *ecdsa.PrivateKey) [2]string {
+		der, err := x509.MarshalECPrivateKey(key)
+		return [2]string{encodePEM(t, "EC PRIVATE KEY", der, err), pkcs8(key)[1]}
+	}
+
+	return map[string][2]string{
+		"RSA PKCS1": {
+			encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil),
+			encodePEM(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), nil),
+		},
+		"RSA PKCS8":   pkcs8(rsaKey),
+		"P-256 SEC1":  sec1(p256),
+		"P-256 PKCS8": pkcs8(p256),
+		"P-384 SEC1":  sec1(p384),
+		"Ed25519":     pkcs8(edKey),
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	for name, keys := range testKeys(t) {
+		privateKey, err := LoadPrivateKey(keys[0])
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		publicKey, err := LoadPublicKey(keys[1])
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		message := &skewedMessage{TestMessage: TestMessage{Message: "string to sign"}}
+		signature, err := Sign(message, privateKey)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if verified, err := VerifyWithin(signature, message, publicKey, time.Minute); !verified || err != nil {
+			t.Errorf("%s: expected the signature to verify: %v", name, err)
+		}
+
+		fields := &fieldsMessage{skewedMessage: skewedMessage{TestMessage: TestMessage{Message: "string to sign"}}}
+		header, signature, err := SignV2(fields, "POST", "/v1-vault-driver/tokens", privateKey)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if verified, err := VerifyV2(header, signature, fields, "POST", "/v1-vault-driver/tokens", publicKey, time.Minute); !verified || err != nil {
+			t.Errorf("%s: expected the v2 signature to verify: %v", name, err)
+		}
+		if verified, _ := VerifyV2(header, signature, fields, "PUT", "/v1-vault-driver/tokens", publicKey, time.Minute); verified {
+			t.Errorf("%s: expected the v2 signature to fail for another method", name)
+		}
+
+		// Only RSA keys encrypt, the others sign and never agree on keys.
+		cipherText, err := Encrypt(publicKey, []byte("token"))
+		if _, isRSA := publicKey.(*rsa.PublicKey); !isRSA {
+			var unsupported *UnsupportedKeyError
+			if !errors.As(err, &unsupported) {
+				t.Errorf("%s: expected encryption to be refused, got: %v", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if plainText, err := Decrypt(privateKey, cipherText); err != nil || string(plainText) != "token" {
+			t.Errorf("%s: expected the token back, got: %q %v", name, plainText, err)
+		}
+	}
+}
+
+func TestEncryptionKey(t *testing.T) {
+	key, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := ParseEncryptionKey(EncodeEncryptionKey(key.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipherText, err := Encrypt(publicKey, []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainText, err := Decrypt(key, cipherText); err != nil || string(plainText) != "token" {
+		t.Errorf("expected the token back, got: %q %v", plainText, err)
+	}
+
+	other, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(other, cipherText); err == nil {
+		t.Errorf("expected another key to fail to decrypt")
+	}
+
+	for _, encoded := range []string{"", "not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseEncryptionKey(encoded); err == nil {
+			t.Errorf("expected an error for: %q", encoded)
+		}
+	}
+
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypt(p256.PublicKey(), []byte("token")); err == nil {
+		t.Errorf("expected a P-256 encryption key to be refused")
+	}
+}
+
+func TestSignV2PSS(t *testing.T) {
+	keys := testKeys(t)
+	privateKey, err := LoadPrivateKey(keys["RSA PKCS8"][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := LoadPublicKey(keys["RSA PKCS8"][1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &fieldsMessage{skewedMessage: skewedMessage{TestMessage: TestMessage{Message: "string to sign"}}}
+	header, signature, err := SignV2WithAlgorithm(message, "POST", "/tokens", privateKey, AlgorithmPS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := DecodeHeader(header); decoded == nil || decoded.Algorithm != AlgorithmPS256 {
+		t.Errorf("expected a PS256 header: %+v", decoded)
+	}
+	if verified, err := VerifyV2(header, signature, message, "POST", "/tokens", publicKey, time.Minute); !verified || err != nil {
+		t.Errorf("expected the PS256 signature to verify: %v", err)
+	}
+
+	ecKey, err := LoadPrivateKey(keys["P-256 SEC1"][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var algorithmErr *UnsupportedAlgorithmError
+	if _, _, err := SignV2WithAlgorithm(message, "POST", "/tokens", ecKey, AlgorithmPS256); !errors.As(err, &algorithmErr) {
+		t.Errorf("expected PS256 to be refused for an ECDSA key, got: %v", err)
+	}
+	if _, _, err := SignV2WithAlgorithm(message, "POST", "/tokens", privateKey, "HS256"); !errors.As(err, &algorithmErr) {
+		t.Errorf("expected HS256 to be refused, got: %v", err)
+	}
+}
+
+func TestKeyErrors(t *testing.T) {
+	if _, err := LoadPrivateKey("not a key"); err != ErrNoPEMBlock {
+		t.Errorf("expected ErrNoPEMBlock, got: %v", err)
+	}
+	if _, err := LoadPublicKey(""); err != ErrNoPEMBlock {
+		t.Errorf("expected ErrNoPEMBlock, got: %v", err)
+	}
+
+	var parseErr *KeyParseError
+	if _, err := LoadPrivateKey(encodePEM(t, "PRIVATE KEY", []byte("garbage"), nil)); !errors.As(err, &parseErr) || parseErr.Type != "PRIVATE KEY" {
+		t.Errorf("expected a KeyParseError, got: %v", err)
+	}
+
+	var keyErr *UnsupportedKeyError
+	if _, err := LoadPrivateKey(encodePEM(t, "DSA PRIVATE KEY", []byte("garbage"), nil)); !errors.As(err, &keyErr) {
+		t.Errorf("expected an UnsupportedKeyError, got: %v", err)
+	}
+
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(p224)
+	if _, err := LoadPrivateKey(encodePEM(t, "EC PRIVATE KEY", der, err)); !errors.As(err, &keyErr) {
+		t.Errorf("expected P-224 to be refused, got: %v", err)
+	}
+
+	// The RSA only loader keeps refusing other key types.
+	if _, err := LoadPrivateKeyFromString(testKeys(t)["Ed25519"][0]); !errors.As(err, &keyErr) {
+		t.Errorf("expected an UnsupportedKeyError, got: %v", err)
+	}
+}
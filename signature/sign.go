@@ -4,9 +4,8 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/hex"
+	"fmt"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -23,48 +22,116 @@ type Message interface {
 	SetTimeStamp()
 }
 
-func Sign(message Message, privateKey *rsa.PrivateKey) ([]byte, error) {
-	rand := rand.Reader
+// NoncedMessage is a message with a nonce covered by Prepare, so the
+// verifier can reject a message it has seen before.
+type NoncedMessage interface {
+	Message
+	GetNonce() string
+	SetNonce(nonce string)
+}
+
+// NewNonce returns a random nonce.
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// Sign timestamps and signs the message with the default algorithm of the
+// key. A NoncedMessage without a nonce gets a new one, a nonce already set,
+// e.g. a server challenge, is kept.
+func Sign(message Message, privateKey crypto.Signer) ([]byte, error) {
+	algorithm, err := DefaultAlgorithm(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := prepareMessage(message); err != nil {
+		return nil, err
+	}
+
+	return signWith(algorithm, privateKey, message.Prepare())
+}
+
+// prepareMessage timestamps the message and sets its nonce.
+func prepareMessage(message Message) error {
 	message.SetTimeStamp()
 
-	hashed := sha256.Sum256(message.Prepare())
+	if nonced, ok := message.(NoncedMessage); ok && nonced.GetNonce() == "" {
+		nonce, err := NewNonce()
+		if err != nil {
+			return err
+		}
+		nonced.SetNonce(nonce)
+	}
+	return nil
+}
 
-	return rsa.SignPKCS1v15(rand, privateKey, crypto.SHA256, hashed[:])
+// Verify checks the signature and that the message was signed within
+// TimeWindow of now.
+func Verify(signature []byte, message Message, publicKey crypto.PublicKey) (bool, error) {
+	return VerifyWithin(signature, message, publicKey, TimeWindow)
 }
 
-func Verify(signature []byte, message Message, publicKey *rsa.PublicKey) (bool, error) {
-	time, err := message.GetTimeStamp()
+// VerifyWithin checks the signature, made with the default algorithm of the
+// key, and that the timestamp of the message is at most skew away from now,
+// in the past or the future.
+func VerifyWithin(signature []byte, message Message, publicKey crypto.PublicKey, skew time.Duration) (bool, error) {
+	algorithm, err := DefaultAlgorithm(publicKey)
 	if err != nil {
 		return false, err
 	}
 
-	if timeWindowExpired(time) {
+	if err := checkTimeStamp(message, skew); err != nil {
 		return false, err
 	}
 
-	hashed := sha256.Sum256(message.Prepare())
-
-	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature); err != nil {
+	if err := verifyWith(algorithm, publicKey, message.Prepare(), signature); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// LoadPrivateKeyFromString parses an RSA private key in any format
+// LoadPrivateKey reads.
 func LoadPrivateKeyFromString(key string) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode([]byte(key))
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	signer, err := LoadPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := signer.(*rsa.PrivateKey)
+	if !ok {
+		name, _ := keyType(signer.Public())
+		return nil, &UnsupportedKeyError{Key: name + ", expected an RSA key"}
+	}
+	return rsaKey, nil
 }
 
 func LoadRSAPublicKey(key string) (*rsa.PublicKey, error) {
 	rsakey, err := rsautils.PublicKeyFromString(key)
-	return rsakey.PublicKey, err
+	if err != nil {
+		return nil, err
+	}
+	return rsakey.PublicKey, nil
 }
 
-func timeWindowExpired(ts *time.Time) bool {
+func checkTimeStamp(message Message, skew time.Duration) error {
+	ts, err := message.GetTimeStamp()
+	if err != nil {
+		return err
+	}
+
+	if outsideSkew(ts, skew) {
+		return fmt.Errorf("signature timestamp: %s is more than %s from now", ts, skew)
+	}
+	return nil
+}
+
+func outsideSkew(ts *time.Time, skew time.Duration) bool {
 	duration := time.Since(*ts)
 	logrus.Debugf("signature timestamp lapsed time: %s", duration)
-	if duration > TimeWindow {
-		return true
-	}
-	return false
+	return duration > skew || duration < -skew
 }
@@ -112,3 +112,78 @@ func TestSignVerificationFailure(t *testing.T) {
 	}
 
 }
+
+type skewedMessage struct {
+	TestMessage
+	offset time.Duration
+	nonce  string
+}
+
+func (sm *skewedMessage) GetTimeStamp() (*time.Time, error) {
+	t := time.Now().Add(sm.offset)
+	return &t, nil
+}
+
+func (sm *skewedMessage) GetNonce() string {
+	return sm.nonce
+}
+
+func (sm *skewedMessage) SetNonce(nonce string) {
+	sm.nonce = nonce
+}
+
+func TestVerifySkew(t *testing.T) {
+	privateKey, err := LoadPrivateKeyFromString(privateKeyString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := LoadRSAPublicKey(publicKeyString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		offset   time.Duration
+		verified bool
+	}{
+		{0, true},
+		{-30 * time.Second, true},
+		{30 * time.Second, true},
+		{-2 * time.Minute, false},
+		{2 * time.Minute, false},
+	} {
+		message := &skewedMessage{TestMessage: TestMessage{Message: "string to sign"}, offset: test.offset}
+		signature, err := Sign(message, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verified, err := VerifyWithin(signature, message, publicKey, time.Minute)
+		if verified != test.verified || (err == nil) != test.verified {
+			t.Errorf("offset: %s expected verified: %t got: %t %v", test.offset, test.verified, verified, err)
+		}
+	}
+}
+
+func TestSignSetsNonce(t *testing.T) {
+	privateKey, err := LoadPrivateKeyFromString(privateKeyString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &skewedMessage{TestMessage: TestMessage{Message: "string to sign"}}
+	if _, err := Sign(message, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(message.nonce) != 32 {
+		t.Errorf("expected a new nonce, got: %q", message.nonce)
+	}
+
+	message.nonce = "challenge"
+	if _, err := Sign(message, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if message.nonce != "challenge" {
+		t.Errorf("expected the challenge to be kept, got: %q", message.nonce)
+	}
+}
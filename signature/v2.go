@@ -0,0 +1,168 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Version2 signatures cover every field of the message, the HTTP method and
+// path, and their own header.
+const Version2 = 2
+
+// CanonicalMessage lists every field of the message by name, a v2 signature
+// covers all of them.
+type CanonicalMessage interface {
+	Message
+	Fields() map[string]string
+}
+
+// Header describes a v2 signature. It is sent JWS style, base64url encoded
+// JSON, and signed with the message.
+type Header struct {
+	Version   int    `json:"v"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Encode returns the header as sent with the request.
+func (h *Header) Encode() (string, error) {
+	content, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(content), nil
+}
+
+// DecodeHeader parses a header sent with a request.
+func DecodeHeader(encoded string) (*Header, error) {
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature header: %s", err)
+	}
+
+	header := &Header{}
+	if err := json.Unmarshal(content, header); err != nil {
+		return nil, fmt.Errorf("invalid signature header: %s", err)
+	}
+	return header, nil
+}
+
+// KeyID identifies a public key, the hex SHA-256 of its PKIX encoding.
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CanonicalEncoding is the length prefixed encoding of parts, every part is
+// preceded by its length as a big endian uint32 so no value can run into the
+// next.
+func CanonicalEncoding(parts ...string) []byte {
+	encoded := []byte{}
+	length := make([]byte, 4)
+	for _, part := range parts {
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		encoded = append(encoded, length...)
+		encoded = append(encoded, part...)
+	}
+	return encoded
+}
+
+// signingInput is what a v2 signature signs: the encoded header, the method,
+// the path and the fields of the message sorted by name.
+func signingInput(encodedHeader string, message CanonicalMessage, method, path string) []byte {
+	fields := message.Fields()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{encodedHeader, method, path}
+	for _, name := range names {
+		parts = append(parts, name, fields[name])
+	}
+	return CanonicalEncoding(parts...)
+}
+
+// SignV2 timestamps the message, sets its nonce like Sign, and signs it for a
+// request of method to path with the default algorithm of the key. The
+// encoded header is sent with the signature.
+func SignV2(message CanonicalMessage, method, path string, privateKey crypto.Signer) (string, []byte, error) {
+	algorithm, err := DefaultAlgorithm(privateKey.Public())
+	if err != nil {
+		return "", nil, err
+	}
+	return SignV2WithAlgorithm(message, method, path, privateKey, algorithm)
+}
+
+// SignV2WithAlgorithm is SignV2 with an algorithm other than the default of
+// the key, e.g. PS256 for an RSA key.
+func SignV2WithAlgorithm(message CanonicalMessage, method, path string, privateKey crypto.Signer, algorithm string) (string, []byte, error) {
+	if err := checkAlgorithm(algorithm, privateKey.Public()); err != nil {
+		return "", nil, err
+	}
+
+	if err := prepareMessage(message); err != nil {
+		return "", nil, err
+	}
+
+	keyID, err := KeyID(privateKey.Public())
+	if err != nil {
+		return "", nil, err
+	}
+
+	header := &Header{Version: Version2, Algorithm: algorithm, KeyID: keyID}
+	encodedHeader, err := header.Encode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	signature, err := signWith(algorithm, privateKey, signingInput(encodedHeader, message, method, path))
+	return encodedHeader, signature, err
+}
+
+// VerifyV2 checks a v2 signature of a request of method to path, that it was
+// made with publicKey in an algorithm fitting the key, and that the message
+// was signed within skew of now.
+func VerifyV2(encodedHeader string, signature []byte, message CanonicalMessage, method, path string, publicKey crypto.PublicKey, skew time.Duration) (bool, error) {
+	header, err := DecodeHeader(encodedHeader)
+	if err != nil {
+		return false, err
+	}
+
+	if header.Version != Version2 {
+		return false, fmt.Errorf("unsupported signature version: %d", header.Version)
+	}
+	if err := checkAlgorithm(header.Algorithm, publicKey); err != nil {
+		return false, err
+	}
+
+	keyID, err := KeyID(publicKey)
+	if err != nil {
+		return false, err
+	}
+	if header.KeyID != keyID {
+		return false, fmt.Errorf("signed with key: %s, expected key: %s", header.KeyID, keyID)
+	}
+
+	if err := checkTimeStamp(message, skew); err != nil {
+		return false, err
+	}
+
+	if err := verifyWith(header.Algorithm, publicKey, signingInput(encodedHeader, message, method, path), signature); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,83 @@
+package signature
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type fieldsMessage struct {
+	skewedMessage
+	fields map[string]string
+}
+
+func (fm *fieldsMessage) Fields() map[string]string {
+	fields := map[string]string{"nonce": fm.nonce}
+	for name, value := range fm.fields {
+		fields[name] = value
+	}
+	return fields
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	if bytes.Equal(CanonicalEncoding("a,b", "c"), CanonicalEncoding("a", "b,c")) {
+		t.Errorf("expected different parts to encode differently")
+	}
+	if bytes.Equal(CanonicalEncoding("ab", ""), CanonicalEncoding("a", "b")) {
+		t.Errorf("expected different parts to encode differently")
+	}
+}
+
+func TestSignV2(t *testing.T) {
+	privateKey, err := LoadPrivateKeyFromString(privateKeyString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := LoadRSAPublicKey(publicKeyString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &fieldsMessage{fields: map[string]string{"volumeName": "web", "policies": "app"}}
+	params, signature, err := SignV2(message, "POST", "/v1-vault-driver/tokens", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := DecodeHeader(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID, _ := KeyID(publicKey); header.Version != Version2 || header.Algorithm != AlgorithmRS256 || header.KeyID != keyID {
+		t.Errorf("unexpected header: %#v", header)
+	}
+
+	if verified, err := VerifyV2(params, signature, message, "POST", "/v1-vault-driver/tokens", publicKey, time.Minute); !verified || err != nil {
+		t.Fatalf("signature verification failed: %v", err)
+	}
+
+	if verified, _ := VerifyV2(params, signature, message, "DELETE", "/v1-vault-driver/tokens", publicKey, time.Minute); verified {
+		t.Errorf("expected the method to be signed")
+	}
+	if verified, _ := VerifyV2(params, signature, message, "POST", "/v1-vault-driver/leases", publicKey, time.Minute); verified {
+		t.Errorf("expected the path to be signed")
+	}
+
+	message.fields["volumeName"] = "other"
+	if verified, _ := VerifyV2(params, signature, message, "POST", "/v1-vault-driver/tokens", publicKey, time.Minute); verified {
+		t.Errorf("expected every field to be signed")
+	}
+	message.fields["volumeName"] = "web"
+
+	forged := &Header{Version: Version2, Algorithm: "none", KeyID: header.KeyID}
+	forgedParams, _ := forged.Encode()
+	if verified, _ := VerifyV2(forgedParams, signature, message, "POST", "/v1-vault-driver/tokens", publicKey, time.Minute); verified {
+		t.Errorf("expected an unsupported algorithm to be refused")
+	}
+
+	other := &Header{Version: Version2, Algorithm: AlgorithmRS256, KeyID: "other"}
+	otherParams, _ := other.Encode()
+	if _, err := VerifyV2(otherParams, signature, message, "POST", "/v1-vault-driver/tokens", publicKey, time.Minute); err == nil {
+		t.Errorf("expected a signature of another key to be refused")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultAgentSocket = "/var/run/secrets-bridge-v2/agent.sock"
+	// agentCallTimeout bounds a forwarded call, the agent bounds its own
+	// token server requests well below it.
+	agentCallTimeout = 2 * time.Minute
+)
+
+// agentRequest carries the arguments of a flexvol verb to the agent.
+type agentRequest struct {
+	Options map[string]interface{} `json:"options,omitempty"`
+	Device  string                 `json:"device,omitempty"`
+	Dir     string                 `json:"dir,omitempty"`
+}
+
+type agentResponse struct {
+	Device  string                 `json:"device,omitempty"`
+	Options map[string]interface{} `json:"options,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// AgentCommand runs the host agent. It holds the host key, caches host
+// metadata and keeps token server connections alive, the flexvol binary
+// forwards its verbs to it.
+func AgentCommand() cli.Command {
+	return cli.Command{
+		Name:   "agent",
+		Usage:  "Run the host agent the driver forwards its calls to",
+		Action: runAgent,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "metadata-ttl",
+				Usage: "how long host metadata is cached",
+				Value: time.Minute,
+			},
+			cli.DurationFlag{
+				Name:  "retry-interval",
+				Usage: "how often queued revocations are retried",
+				Value: 30 * time.Second,
+			},
+		},
+	}
+}
+
+func runAgent(c *cli.Context) error {
+	socket := config.AgentSocket
+	if err := os.MkdirAll(path.Dir(socket), 0700); err != nil {
+		return err
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// Only root may ask the agent for tokens.
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+
+	hostMetadata.ttl = c.Duration("metadata-ttl")
+
+	go func() {
+		for {
+			time.Sleep(c.Duration("retry-interval"))
+			retryDueRevocations()
+		}
+	}()
+
+	logrus.Infof("serving host agent on: %s", socket)
+	return http.Serve(listener, newAgentHandler(&FlexVol{}))
+}
+
+// newAgentHandler serves the flexvol verbs of backend, one POST route per
+// verb.
+func newAgentHandler(backend flexBackend) http.Handler {
+	verbs := map[string]func(req *agentRequest) (*agentResponse, error){
+		"init": func(req *agentRequest) (*agentResponse, error) {
+			return &agentResponse{}, backend.Init()
+		},
+		"create": func(req *agentRequest) (*agentResponse, error) {
+			options, err := backend.Create(req.Options)
+			return &agentResponse{Options: options}, err
+		},
+		"delete": func(req *agentRequest) (*agentResponse, error) {
+			return &agentResponse{}, backend.Delete(req.Options)
+		},
+		"attach": func(req *agentRequest) (*agentResponse, error) {
+			device, err := backend.Attach(req.Options)
+			return &agentResponse{Device: device}, err
+		},
+		"detach": func(req *agentRequest) (*agentResponse, error) {
+			return &agentResponse{}, backend.Detach(req.Device)
+		},
+		"mount": func(req *agentRequest) (*agentResponse, error) {
+			return &agentResponse{}, backend.Mount(req.Dir, req.Device, req.Options)
+		},
+		"unmount": func(req *agentRequest) (*agentResponse, error) {
+			return &agentResponse{}, backend.Unmount(req.Dir)
+		},
+	}
+
+	mux := http.NewServeMux()
+	for verb, fn := range verbs {
+		fn := fn
+		mux.HandleFunc("/v1/"+verb, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			req := &agentRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Options == nil {
+				req.Options = map[string]interface{}{}
+			}
+
+			resp, err := fn(req)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		})
+	}
+	return mux
+}
+
+// agentBackend forwards the flexvol verbs to the host agent.
+type agentBackend struct {
+	client *http.Client
+}
+
+func newAgentBackend(socket string) *agentBackend {
+	return &agentBackend{
+		client: &http.Client{
+			Timeout: agentCallTimeout,
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// newBackend returns the agent if it is running, the driver runs in process
+// otherwise.
+func newBackend() flexBackend {
+	conn, err := net.DialTimeout("unix", config.AgentSocket, time.Second)
+	if err != nil {
+		return &FlexVol{}
+	}
+	conn.Close()
+
+	return newAgentBackend(config.AgentSocket)
+}
+
+func (a *agentBackend) call(verb string, req *agentRequest) (*agentResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := a.client.Post("http://agent/v1/"+verb, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("agent %s request status was: %d", verb, httpResp.StatusCode)
+	}
+
+	resp := &agentResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return resp, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+func (a *agentBackend) Init() error {
+	_, err := a.call("init", &agentRequest{})
+	return err
+}
+
+func (a *agentBackend) Create(options map[string]interface{}) (map[string]interface{}, error) {
+	resp, err := a.call("create", &agentRequest{Options: options})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Options, nil
+}
+
+func (a *agentBackend) Delete(options map[string]interface{}) error {
+	_, err := a.call("delete", &agentRequest{Options: options})
+	return err
+}
+
+func (a *agentBackend) Attach(options map[string]interface{}) (string, error) {
+	resp, err := a.call("attach", &agentRequest{Options: options})
+	if err != nil {
+		return "", err
+	}
+	return resp.Device, nil
+}
+
+func (a *agentBackend) Detach(device string) error {
+	_, err := a.call("detach", &agentRequest{Device: device})
+	return err
+}
+
+func (a *agentBackend) Mount(dir, device string, options map[string]interface{}) error {
+	_, err := a.call("mount", &agentRequest{Dir: dir, Device: device, Options: options})
+	return err
+}
+
+func (a *agentBackend) Unmount(dir string) error {
+	_, err := a.call("unmount", &agentRequest{Dir: dir})
+	return err
+}
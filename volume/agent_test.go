@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type failingMountBackend struct {
+	fakeBackend
+}
+
+func (f *failingMountBackend) Mount(dir, device string, options map[string]interface{}) error {
+	return fmt.Errorf("mount failed: %s", dir)
+}
+
+func TestAgentForwarding(t *testing.T) {
+	socket := path.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	backend := &failingMountBackend{}
+	go http.Serve(listener, newAgentHandler(backend))
+
+	agent := newAgentBackend(socket)
+
+	if err := agent.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := agent.Create(map[string]interface{}{"name": "web", "policies": "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options["device"] == nil || options["policies"] != "app" {
+		t.Errorf("expected the created options back, got: %v", options)
+	}
+
+	device, err := agent.Attach(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := getDeviceValues(device)
+	if err != nil || values.Get("accessor") != "abc" {
+		t.Errorf("unexpected device: %s %v", device, err)
+	}
+
+	if err := agent.Mount("/tmp/target", device, options); err == nil || err.Error() != "mount failed: /tmp/target" {
+		t.Errorf("expected the backend error, got: %v", err)
+	}
+
+	if err := agent.Detach(device); err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.attached != 1 || backend.detached != 1 {
+		t.Errorf("expected one attach and detach, got: %d %d", backend.attached, backend.detached)
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config = defaultDriverConfig()
+	config.AgentSocket = path.Join(t.TempDir(), "agent.sock")
+
+	if _, ok := newBackend().(*FlexVol); !ok {
+		t.Errorf("expected the driver to run in process without an agent")
+	}
+
+	listener, err := net.Listen("unix", config.AgentSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, ok := newBackend().(*agentBackend); !ok {
+		t.Errorf("expected calls to be forwarded to the running agent")
+	}
+}
+
+func TestHostKeyCache(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "host.key")
+	writeKey := func(modTime time.Time) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(keyFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := &hostKeyCache{}
+	writeKey(time.Now().Add(-time.Hour))
+	first, err := cache.get(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, err := cache.get(keyFile); err != nil || again != first {
+		t.Errorf("expected the cached key, got: %v", err)
+	}
+
+	writeKey(time.Now())
+	if rotated, err := cache.get(keyFile); err != nil || rotated == first {
+		t.Errorf("expected a rotated key to be read again, got: %v", err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&hostKeyCache{}).get(keyFile); err == nil {
+		t.Errorf("expected an error for a file without a key")
+	}
+}
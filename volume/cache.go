@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+var (
+	hostKey      = &hostKeyCache{}
+	hostMetadata = &metadataCache{}
+	// tokenServerTransport is shared by every token server request so the
+	// agent keeps its connections alive.
+	tokenServerTransport = http.DefaultTransport.(*http.Transport).Clone()
+)
+
+// hostKeyCache keeps the parsed host private key, RSA, ECDSA or Ed25519. The
+// file is parsed again when it changes.
+type hostKeyCache struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	key     crypto.Signer
+}
+
+func (c *hostKeyCache) get(keyFile string) (crypto.Signer, error) {
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.key != nil && c.path == keyFile && c.modTime.Equal(info.ModTime()) {
+		return c.key, nil
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := signature.LoadPrivateKey(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %s: %s", keyFile, err)
+	}
+
+	c.path = keyFile
+	c.modTime = info.ModTime()
+	c.key = key
+	return key, nil
+}
+
+// metadataCache keeps the metadata client and, when ttl is set, the host
+// metadata. Only the agent sets a ttl, a single driver call always reads
+// fresh metadata.
+type metadataCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	url     string
+	client  metadata.Client
+	host    metadata.Host
+	fetched time.Time
+}
+
+func (c *metadataCache) get(url string) (metadata.Host, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, err := c.connect(url)
+	if err != nil {
+		return metadata.Host{}, err
+	}
+
+	if c.ttl > 0 && time.Since(c.fetched) < c.ttl {
+		return c.host, nil
+	}
+
+	host, err := client.GetSelfHost()
+	if err != nil {
+		return host, err
+	}
+
+	c.host = host
+	c.fetched = time.Now()
+	return host, nil
+}
+
+// metadataClient returns the client of the cache, connecting if needed.
+func (c *metadataCache) metadataClient(url string) (metadata.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connect(url)
+}
+
+func (c *metadataCache) connect(url string) (metadata.Client, error) {
+	if c.client != nil && c.url == url {
+		return c.client, nil
+	}
+
+	client, err := metadata.NewClientAndWait(url)
+	if err != nil {
+		return nil, err
+	}
+
+	c.client = client
+	c.url = url
+	c.fetched = time.Time{}
+	return client, nil
+}
+
+// closeResponse reads what is left of the body so the connection can be
+// reused.
+func closeResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
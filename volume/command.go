@@ -9,10 +9,18 @@ import (
 var VERSION = "v0.0.0-dev"
 
 func main() {
-	backend := &FlexVol{}
+	cfg, err := loadDriverConfig(getDriverConfigPath())
+	if err != nil {
+		flexvol.Error(err).Print()
+		os.Exit(1)
+	}
+	config = cfg
+
+	backend := newBackend()
 
 	app := flexvol.NewApp(backend)
 	app.Version = VERSION
+	app.Commands = append(app.Commands, RenewCommand(), DockerCommand(), KubernetesCommand(backend), CSICommand(), GCCommand(), RevocationsCommand(), AgentCommand())
 
 	app.Run(os.Args)
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/secrets-bridge-v2/server"
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+const (
+	defaultDriverConfigFile = "/var/lib/rancher/etc/secrets-bridge-v2/driver.json"
+	defaultTokenServerURL   = "http://vault-token-server:8080/v1-vault-driver/tokens"
+)
+
+var config = defaultDriverConfig()
+
+// driverConfig are the host settings of the driver. Every field is optional
+// in the config file, missing fields keep their defaults.
+type driverConfig struct {
+	VolumeRoot     string `json:"volumeRoot"`
+	MetadataURL    string `json:"metadataURL"`
+	PrivateKeyFile string `json:"privateKeyFile"`
+	// TemplateDir holds the template files volumes may name as a template
+	// source. Empty disables template sources.
+	TemplateDir string `json:"templateDir"`
+	// VaultAddr is the Vault server the driver reads secrets from and
+	// unwraps tokens with. Empty uses VAULT_ADDR.
+	VaultAddr string `json:"vaultAddr"`
+	// VaultRole is the token role the token server creates tokens with,
+	// wrapping tokens created by another role are refused. Empty accepts
+	// any role.
+	VaultRole string `json:"vaultRole"`
+	// SkipProvenanceCheck attaches tokens without checking they were
+	// created by the token create endpoint, for tokens that are not
+	// response wrapped.
+	SkipProvenanceCheck bool `json:"skipProvenanceCheck"`
+	// TokenServerURLs are the tokens endpoints of the token servers, tried in
+	// order until one answers.
+	TokenServerURLs []string `json:"tokenServerURLs"`
+	// RequestTimeout bounds every request to a token server, e.g. "10s".
+	RequestTimeout string `json:"requestTimeout"`
+	// Retries is how many more times the list of token servers is tried
+	// after every server failed, waiting RetryWait in between.
+	Retries   int    `json:"retries"`
+	RetryWait string `json:"retryWait"`
+	// HostIdentity is how the host proves who it is to the token server:
+	// rancher, static or cloud.
+	HostIdentity string `json:"hostIdentity"`
+	// HostIdentityFile holds the host UUID of a static identity.
+	HostIdentityFile string `json:"hostIdentityFile"`
+	// CloudIdentityURL serves the instance identity document and signature
+	// of a cloud identity.
+	CloudIdentityURL string `json:"cloudIdentityURL"`
+	// AgentSocket is where the host agent listens, the driver forwards its
+	// calls there while the agent runs.
+	AgentSocket string `json:"agentSocket"`
+	// LockTimeout is how long an operation waits for another operation on
+	// the same volume to finish.
+	LockTimeout string `json:"lockTimeout"`
+	// NonceChallenge fetches a nonce from the token server before every
+	// signed request, for servers that require challenges. Cloud identities
+	// always use one.
+	NonceChallenge bool `json:"nonceChallenge"`
+	// SignatureVersion is 2, signing every field with the method and path,
+	// or 1 for token servers that only verify the old format. Current
+	// token servers refuse v1 token requests of Rancher hosts, of pods and
+	// of hosts without an RSA key, see the README.
+	SignatureVersion int `json:"signatureVersion"`
+	// SignatureAlgorithm overrides the algorithm of v2 signatures, PS256 for
+	// RSA-PSS. Empty uses the algorithm of the host key type.
+	SignatureAlgorithm string `json:"signatureAlgorithm"`
+
+	requestTimeout time.Duration
+	retryWait      time.Duration
+	lockTimeout    time.Duration
+	hostIdentity   HostIdentity
+}
+
+func defaultDriverConfig() *driverConfig {
+	return &driverConfig{
+		VolumeRoot:       "/var/lib/rancher/volumes/secrets-bridge-v2",
+		MetadataURL:      "http://169.254.169.250/2016-07-29",
+		PrivateKeyFile:   "/var/lib/rancher/etc/ssl/host.key",
+		TokenServerURLs:  []string{defaultTokenServerURL},
+		RequestTimeout:   "10s",
+		Retries:          1,
+		RetryWait:        "1s",
+		HostIdentity:     server.IdentityRancher,
+		HostIdentityFile: "/var/lib/rancher/etc/secrets-bridge-v2/host.json",
+		CloudIdentityURL: "http://169.254.169.254/latest/dynamic/instance-identity",
+		AgentSocket:      defaultAgentSocket,
+		LockTimeout:      "30s",
+		SignatureVersion: signature.Version2,
+		requestTimeout:   10 * time.Second,
+		retryWait:        time.Second,
+		lockTimeout:      30 * time.Second,
+		hostIdentity:     &rancherIdentity{},
+	}
+}
+
+func getDriverConfigPath() string {
+	if envPath := os.Getenv("VAULT_DRIVER_CONFIG"); envPath != "" {
+		return envPath
+	}
+	return defaultDriverConfigFile
+}
+
+// loadDriverConfig reads the config file, a missing file is the default
+// config. VAULT_TOKEN_SERVER_URL, a comma separated list, overrides the token
+// servers of the file, VAULT_ADDR is used if the file sets no vaultAddr.
+func loadDriverConfig(configPath string) (*driverConfig, error) {
+	cfg := defaultDriverConfig()
+
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, cfg); err != nil {
+			return nil, fmt.Errorf("invalid driver config: %s: %s", configPath, err)
+		}
+	}
+
+	if envURLs := os.Getenv("VAULT_TOKEN_SERVER_URL"); envURLs != "" {
+		cfg.TokenServerURLs = strings.Split(envURLs, ",")
+	}
+
+	if cfg.VaultAddr == "" {
+		cfg.VaultAddr = os.Getenv("VAULT_ADDR")
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c *driverConfig) validate() error {
+	urls := []string{}
+	for _, url := range c.TokenServerURLs {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("no token server configured")
+	}
+	c.TokenServerURLs = urls
+
+	if c.VolumeRoot == "" || c.MetadataURL == "" || c.PrivateKeyFile == "" || c.AgentSocket == "" {
+		return fmt.Errorf("volumeRoot, metadataURL, privateKeyFile and agentSocket can not be empty")
+	}
+
+	if c.SignatureVersion != 1 && c.SignatureVersion != signature.Version2 {
+		return fmt.Errorf("signatureVersion must be 1 or 2")
+	}
+
+	switch c.SignatureAlgorithm {
+	case "":
+	case signature.AlgorithmRS256, signature.AlgorithmPS256, signature.AlgorithmES256, signature.AlgorithmES384, signature.AlgorithmEdDSA:
+		if c.SignatureVersion != signature.Version2 {
+			return fmt.Errorf("signatureAlgorithm requires signatureVersion 2")
+		}
+	default:
+		return fmt.Errorf("unsupported signatureAlgorithm: %s", c.SignatureAlgorithm)
+	}
+
+	if c.Retries < 0 {
+		return fmt.Errorf("retries can not be negative")
+	}
+
+	var err error
+	if c.requestTimeout, err = time.ParseDuration(c.RequestTimeout); err != nil || c.requestTimeout <= 0 {
+		return fmt.Errorf("invalid requestTimeout: %q", c.RequestTimeout)
+	}
+
+	if c.retryWait, err = time.ParseDuration(c.RetryWait); err != nil || c.retryWait < 0 {
+		return fmt.Errorf("invalid retryWait: %q", c.RetryWait)
+	}
+
+	if c.lockTimeout, err = time.ParseDuration(c.LockTimeout); err != nil || c.lockTimeout < 0 {
+		return fmt.Errorf("invalid lockTimeout: %q", c.LockTimeout)
+	}
+
+	c.hostIdentity, err = newHostIdentity(c)
+	return err
+}
+
+// checkVaultAddr fails unless the Vault server is configured. Attach checks
+// the provenance of every token, and unwraps and reads secrets, against
+// Vault, so a host without vaultAddr would fail every attach. It is not part
+// of validate, the gc and revocations commands do not need Vault.
+func (c *driverConfig) checkVaultAddr() error {
+	if c.VaultAddr == "" && !c.SkipProvenanceCheck {
+		return fmt.Errorf("vaultAddr is not set in the driver config and VAULT_ADDR is empty, it is required to check token provenance")
+	}
+	return nil
+}
+
+// tokenServerEndpoint is the endpoint, e.g. leases, next to the tokens
+// endpoint tokensURL of a token server.
+func tokenServerEndpoint(tokensURL, endpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(tokensURL, "/"), "/tokens") + "/" + endpoint
+}
+
+// doTokenServerRequest sends the signed message to endpoint, failing over to
+// the next token server when a server can not be reached, times out or
+// answers with a server error. The response of the first server that handles
+// the request is returned, the caller closes its body.
+//
+// A token request that timed out may still have created a token, it expires
+// with its TTL.
+func doTokenServerRequest(method, endpoint string, msg signature.Message) (*http.Response, error) {
+	client := &http.Client{Timeout: config.requestTimeout, Transport: tokenServerTransport}
+
+	var lastErr error
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(config.retryWait)
+		}
+
+		for _, tokensURL := range config.TokenServerURLs {
+			url := tokenServerEndpoint(tokensURL, endpoint)
+
+			// Every attempt is signed with a new nonce, a server that saw
+			// the last one would refuse it as a replay.
+			req, err := newSignedRequest(client, method, url, tokensURL, msg)
+			if err != nil {
+				lastErr = err
+				logrus.Warnf("token server request failed: %s", err)
+				continue
+			}
+			proof, err := config.hostIdentity.Proof(requestNonce(msg))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set(server.IdentityProviderHeader, config.hostIdentity.Provider())
+			for name, values := range proof {
+				req.Header[name] = values
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				lastErr = err
+				logrus.Warnf("token server request failed: %s", err)
+				continue
+			}
+
+			if resp.StatusCode >= http.StatusInternalServerError {
+				msg, _ := ioutil.ReadAll(resp.Body)
+				closeResponse(resp)
+				lastErr = fmt.Errorf("%s %s received status code: %d msg: %s", method, url, resp.StatusCode, msg)
+				logrus.Warnf("token server request failed: %s", lastErr)
+				continue
+			}
+
+			return resp, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// newSignedRequest sets the nonce of msg, a challenge of the token server at
+// tokensURL if configured or the host identity is attested, and returns the
+// request signed in the configured signature version.
+func newSignedRequest(client *http.Client, method, url, tokensURL string, msg signature.Message) (*http.Request, error) {
+	if nonced, ok := msg.(signature.NoncedMessage); ok {
+		nonce := ""
+		if config.NonceChallenge || config.hostIdentity.Provider() == server.IdentityCloud {
+			var err error
+			if nonce, err = getChallenge(client, tokensURL); err != nil {
+				return nil, err
+			}
+		}
+		nonced.SetNonce(nonce)
+	}
+
+	// The body is only known once the message is signed, the path is needed
+	// to sign it.
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical, v2 := msg.(signature.CanonicalMessage)
+	if config.SignatureVersion == signature.Version2 && v2 {
+		params, sig, err := getSignatureV2(canonical, method, req.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(server.SignatureHeaderString, sig)
+		req.Header.Set(server.SignatureParamsHeader, params)
+	} else {
+		sig, err := getSignature(msg)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(server.SignatureHeaderString, sig)
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return req, nil
+}
+
+// requestNonce is the nonce newSignedRequest set on msg.
+func requestNonce(msg signature.Message) string {
+	if nonced, ok := msg.(signature.NoncedMessage); ok {
+		return nonced.GetNonce()
+	}
+	return ""
+}
+
+func getChallenge(client *http.Client, tokensURL string) (string, error) {
+	url := tokenServerEndpoint(tokensURL, "challenge")
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer closeResponse(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s received status code: %d", url, resp.StatusCode)
+	}
+
+	challenge := &server.Challenge{}
+	if err := json.NewDecoder(resp.Body).Decode(challenge); err != nil {
+		return "", err
+	}
+	if challenge.Nonce == "" {
+		return "", fmt.Errorf("GET %s returned no nonce", url)
+	}
+	return challenge.Nonce, nil
+}
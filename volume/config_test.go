@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rancher/secrets-bridge-v2/server"
+	"github.com/rancher/secrets-bridge-v2/signature"
+)
+
+func TestLoadDriverConfig(t *testing.T) {
+	defer os.Setenv("VAULT_TOKEN_SERVER_URL", os.Getenv("VAULT_TOKEN_SERVER_URL"))
+	defer os.Setenv("VAULT_ADDR", os.Getenv("VAULT_ADDR"))
+	os.Unsetenv("VAULT_TOKEN_SERVER_URL")
+	os.Setenv("VAULT_ADDR", "http://env-vault:8200")
+
+	dir := t.TempDir()
+	cfg, err := loadDriverConfig(path.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TokenServerURLs[0] != defaultTokenServerURL || cfg.requestTimeout != 10*time.Second || cfg.VaultAddr != "http://env-vault:8200" || cfg.SkipProvenanceCheck {
+		t.Errorf("expected the default config, got: %#v", cfg)
+	}
+
+	configPath := path.Join(dir, "driver.json")
+	content := `{"volumeRoot": "/tmp/volumes", "vaultAddr": "https://vault:8200", "vaultRole": "vault-driver", "tokenServerURLs": ["http://a/v1-vault-driver/tokens", " http://b/v1-vault-driver/tokens"], "requestTimeout": "2s", "retries": 3}`
+	if err := ioutil.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err = loadDriverConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.VolumeRoot != "/tmp/volumes" || cfg.VaultAddr != "https://vault:8200" || cfg.VaultRole != "vault-driver" || cfg.MetadataURL == "" || cfg.Retries != 3 || cfg.requestTimeout != 2*time.Second {
+		t.Errorf("unexpected config: %#v", cfg)
+	}
+	if len(cfg.TokenServerURLs) != 2 || cfg.TokenServerURLs[1] != "http://b/v1-vault-driver/tokens" {
+		t.Errorf("unexpected token servers: %v", cfg.TokenServerURLs)
+	}
+
+	os.Setenv("VAULT_TOKEN_SERVER_URL", "http://c/tokens,http://d/tokens")
+	if cfg, err = loadDriverConfig(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TokenServerURLs) != 2 || cfg.TokenServerURLs[0] != "http://c/tokens" {
+		t.Errorf("expected the environment to override the token servers: %v", cfg.TokenServerURLs)
+	}
+
+	for _, invalid := range []string{
+		`{"requestTimeout": "soon"}`,
+		`{"retries": -1}`,
+		`{"volumeRoot": ""}`,
+		`{"signatureVersion": 3}`,
+		`{"signatureAlgorithm": "HS256"}`,
+		`{"signatureVersion": 1, "signatureAlgorithm": "PS256"}`,
+		`{"tokenServerURLs": [`,
+	} {
+		if err := ioutil.WriteFile(configPath, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDriverConfig(configPath); err == nil {
+			t.Errorf("expected an error for: %s", invalid)
+		}
+	}
+}
+
+func TestCheckVaultAddr(t *testing.T) {
+	cfg := defaultDriverConfig()
+	if err := cfg.checkVaultAddr(); err == nil {
+		t.Errorf("expected a missing vaultAddr to fail")
+	}
+
+	cfg.SkipProvenanceCheck = true
+	if err := cfg.checkVaultAddr(); err != nil {
+		t.Errorf("expected skipProvenanceCheck not to need vaultAddr, got: %s", err)
+	}
+
+	cfg.SkipProvenanceCheck = false
+	cfg.VaultAddr = "https://vault:8200"
+	if err := cfg.checkVaultAddr(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenServerEndpoint(t *testing.T) {
+	for tokensURL, expected := range map[string]string{
+		"http://server:8080/v1-vault-driver/tokens":  "http://server:8080/v1-vault-driver/leases",
+		"http://server:8080/v1-vault-driver/tokens/": "http://server:8080/v1-vault-driver/leases",
+	} {
+		if url := tokenServerEndpoint(tokensURL, "leases"); url != expected {
+			t.Errorf("expected: %s got: %s", expected, url)
+		}
+	}
+}
+
+func writeHostKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(t.TempDir(), "host.key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile
+}
+
+func TestTokenServerFailover(t *testing.T) {
+	keyFile := writeHostKey(t)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection is only watched for the client going away once
+		// the body is read.
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "vault sealed", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	var paths []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(server.SignatureHeaderString) == "" || r.Header.Get(server.SignatureParamsHeader) == "" {
+			t.Errorf("request is not signed with v2")
+		}
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer healthy.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config = defaultDriverConfig()
+	config.PrivateKeyFile = keyFile
+	config.requestTimeout = 100 * time.Millisecond
+	config.retryWait = 0
+	config.TokenServerURLs = []string{
+		slow.URL + "/v1-vault-driver/tokens",
+		failing.URL + "/v1-vault-driver/tokens",
+		healthy.URL + "/v1-vault-driver/tokens",
+	}
+
+	if err := makeSignedRevokeRequest("leases", &server.VaultLeaseRevokeInput{LeaseID: "lease"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/v1-vault-driver/leases" {
+		t.Errorf("expected the healthy server to be used once, got: %v", paths)
+	}
+
+	config.TokenServerURLs = config.TokenServerURLs[:2]
+	config.Retries = 2
+	start := time.Now()
+	if err := makeSignedRevokeRequest("leases", &server.VaultLeaseRevokeInput{LeaseID: "lease"}); err == nil {
+		t.Errorf("expected an error when no token server is healthy")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("retries are not bounded, took: %s", elapsed)
+	}
+}
+
+func TestTokenServerNonceChallenge(t *testing.T) {
+	issued, failed := 0, false
+	var nonces []string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1-vault-driver/challenge" {
+			issued++
+			json.NewEncoder(w).Encode(&server.Challenge{Nonce: fmt.Sprintf("challenge-%d", issued)})
+			return
+		}
+
+		msg := &server.VaultLeaseRevokeInput{}
+		json.NewDecoder(r.Body).Decode(msg)
+		nonces = append(nonces, msg.Nonce)
+
+		// The first request fails after the server saw its nonce.
+		if !failed {
+			failed = true
+			http.Error(w, "vault sealed", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer tokenServer.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config = defaultDriverConfig()
+	config.PrivateKeyFile = writeHostKey(t)
+	config.retryWait = 0
+	config.TokenServerURLs = []string{tokenServer.URL + "/v1-vault-driver/tokens"}
+
+	config.NonceChallenge = true
+	if err := makeSignedRevokeRequest("leases", &server.VaultLeaseRevokeInput{LeaseID: "lease"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(nonces) != 2 || nonces[0] != "challenge-1" || nonces[1] != "challenge-2" {
+		t.Errorf("expected every attempt to sign a new challenge, got: %v", nonces)
+	}
+
+	config.NonceChallenge = false
+	nonces = nil
+	if err := makeSignedRevokeRequest("leases", &server.VaultLeaseRevokeInput{LeaseID: "lease"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(nonces) != 1 || nonces[0] == "" || issued != 2 {
+		t.Errorf("expected a nonce of the driver without a challenge, got: %v", nonces)
+	}
+}
+
+func TestTokenDecryptionKey(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	// RSA host keys decrypt the token themselves.
+	config.PrivateKeyFile = writeHostKey(t)
+	req := &server.VaultTokenInput{}
+	key, err := tokenDecryptionKey(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok || req.EncryptionKey != "" {
+		t.Errorf("expected the RSA host key, got: %T %q", key, req.EncryptionKey)
+	}
+
+	// ECDSA host keys only sign, the request carries an encryption key.
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.PrivateKeyFile = path.Join(t.TempDir(), "host.key")
+	if err := ioutil.WriteFile(config.PrivateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	req = &server.VaultTokenInput{}
+	if key, err = tokenDecryptionKey(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.EncryptionKey == "" {
+		t.Fatalf("expected an encryption key in the request")
+	}
+
+	encryptionKey, err := signature.ParseEncryptionKey(req.EncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := signature.Encrypt(encryptionKey, []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := decryptToken(key, encrypted); err != nil || token != "token" {
+		t.Errorf("expected the token back, got: %q %v", token, err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// volumeContent is everything beyond the token that is written into a
+// volume during attach.
+type volumeContent struct {
+	secrets   []*secretSpec
+	templates []*templateSpec
+	database  *databaseSpec
+	pki       *pkiSpec
+	files     *fileOptions
+	sinks     []sink
+	// name is the volume name, certificates are issued for the service
+	// using it.
+	name string
+}
+
+// contentOptionKeys are the driver options needed to render the volume
+// content again after attach.
+var contentOptionKeys = []string{
+	"name", "secrets", "templates", "databaseRole", "databaseMount", "uid", "gid", "fileMode", "formats",
+	"pkiRole", "pkiMount", "pkiCommonName", "pkiAltNames", "pkiIPSans", "pkiTTL", "pkiService", "pkiBundles", "pkiBundlePassword", "pkiKeyMode",
+	"storage", "mountOpts",
+}
+
+// getVolumeContent parses and validates the secrets, templates and file
+// driver options so errors are reported before a token is requested.
+func getVolumeContent(options map[string]interface{}) (*volumeContent, error) {
+	content := &volumeContent{}
+	content.name, _ = options["name"].(string)
+
+	var err error
+	if content.files, err = getFileOptions(options); err != nil {
+		return content, err
+	}
+
+	if content.secrets, err = getSecretSpecs(options); err != nil {
+		return content, err
+	}
+
+	if content.templates, err = getTemplateSpecs(options); err != nil {
+		return content, err
+	}
+
+	if content.database, err = getDatabaseSpec(options); err != nil {
+		return content, err
+	}
+
+	if content.pki, err = getPKISpec(options); err != nil {
+		return content, err
+	}
+
+	if content.sinks, err = getSinks(options); err != nil {
+		return content, err
+	}
+
+	files := map[string]bool{}
+	for _, file := range content.fileNames() {
+		if files[file] {
+			return content, fmt.Errorf("file: %s is defined more than once", file)
+		}
+		files[file] = true
+	}
+
+	if err := content.checkKeys(); err != nil {
+		return content, err
+	}
+
+	return content, nil
+}
+
+// checkKeys makes sure the secrets do not collide with each other or the
+// token in the key/value formats.
+func (c *volumeContent) checkKeys() error {
+	names := []string{}
+	for _, spec := range c.secrets {
+		names = append(names, spec.File)
+	}
+	if c.database != nil {
+		names = append(names, c.database.fileNames()...)
+	}
+
+	for _, s := range c.sinks {
+		if keyed, ok := s.(keyedSink); ok {
+			if err := keyed.checkKeys(names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *volumeContent) empty() bool {
+	return len(c.secrets) == 0 && len(c.templates) == 0 && c.database == nil && c.pki == nil
+}
+
+func (c *volumeContent) fileNames() []string {
+	files := []string{}
+	for _, s := range c.sinks {
+		files = append(files, s.fileNames(c.secrets)...)
+	}
+	for _, spec := range c.templates {
+		files = append(files, spec.File)
+	}
+	if c.database != nil {
+		files = append(files, c.database.fileNames()...)
+	}
+	if c.pki != nil {
+		files = append(files, c.pki.fileNames()...)
+	}
+	return files
+}
+
+// read fetches the secrets and renders the templates with vClient. Nothing
+// is written until everything was read successfully. Database credentials
+// and certificates already in creds are reused.
+func (c *volumeContent) read(vClient *api.Client, creds *credentials) error {
+	var err error
+	if creds.secrets, err = readSecrets(vClient, c.secrets); err != nil {
+		return err
+	}
+
+	if c.database != nil {
+		if creds.database == nil {
+			if creds.database, err = c.database.read(vClient); err != nil {
+				return err
+			}
+		}
+		creds.secrets = append(creds.secrets, creds.database.files()...)
+	}
+
+	if creds.files, err = renderTemplates(vClient, c.templates); err != nil {
+		return err
+	}
+
+	if c.pki != nil {
+		if creds.certificate == nil {
+			if creds.certificate, err = c.pki.issue(vClient, c.name); err != nil {
+				return err
+			}
+		}
+
+		// A certificate that is kept is already in the volume, its key
+		// is not recorded to write it again.
+		if creds.certificate.PrivateKey != "" {
+			certFiles, err := c.pki.files(creds.certificate)
+			if err != nil {
+				return err
+			}
+			creds.files = append(creds.files, certFiles...)
+		}
+	}
+
+	return nil
+}
+
+// write passes the credentials through every sink and writes the rendered
+// templates and certificates into devPath.
+func (c *volumeContent) write(creds *credentials, devPath string) error {
+	for _, s := range c.sinks {
+		if err := s.write(devPath, creds, c.files); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range creds.files {
+		if err := c.files.writeFile(devPath, file.name, file.content, file.mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// contentOptions returns the subset of the driver options needed to render
+// the volume content again.
+func contentOptions(options map[string]interface{}) map[string]interface{} {
+	subset := map[string]interface{}{}
+	for _, key := range contentOptionKeys {
+		if value, ok := options[key]; ok {
+			subset[key] = value
+		}
+	}
+	return subset
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/moby/moby/pkg/mount"
+	"github.com/rancher/secrets-bridge-v2/csi"
+	"github.com/urfave/cli"
+)
+
+const (
+	csiPluginName      = "secrets-bridge-v2.rancher.io"
+	defaultCSIEndpoint = "unix:///var/lib/kubelet/plugins/secrets-bridge-v2/csi.sock"
+)
+
+// csiPodKeys maps the pod information kubelet adds to the volume context onto
+// the FlexVolume option keys sent with the token request.
+var csiPodKeys = map[string]string{
+	"csi.storage.k8s.io/pod.name":            kubePodName,
+	"csi.storage.k8s.io/pod.namespace":       kubePodNamespace,
+	"csi.storage.k8s.io/serviceAccount.name": kubeServiceAccount,
+}
+
+var invalidVolumeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// CSICommand serves the CSI Identity and Node services.
+func CSICommand() cli.Command {
+	return cli.Command{
+		Name:   "csi",
+		Usage:  "Run as a CSI node plugin",
+		Action: serveCSIPlugin,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "endpoint",
+				Usage:  "unix socket to serve the CSI services on",
+				EnvVar: "CSI_ENDPOINT",
+				Value:  defaultCSIEndpoint,
+			},
+			cli.StringFlag{
+				Name:   "node-id",
+				Usage:  "node ID reported to the orchestrator, defaults to the host UUID",
+				EnvVar: "CSI_NODE_ID",
+			},
+		},
+	}
+}
+
+func serveCSIPlugin(c *cli.Context) error {
+	socket := strings.TrimPrefix(c.String("endpoint"), "unix://")
+	if err := os.MkdirAll(path.Dir(socket), 0755); err != nil {
+		return err
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	node := &csiNode{backend: &FlexVol{}, nodeID: c.String("node-id")}
+	if err := node.backend.Init(); err != nil {
+		return err
+	}
+
+	server := &csi.Server{
+		Name:    csiPluginName,
+		Version: VERSION,
+		Node:    node,
+	}
+
+	logrus.Infof("serving CSI node plugin on: %s", socket)
+	return server.Serve(listener)
+}
+
+// csiNode publishes volumes through the flexvol driver, a new token is
+// issued every time a volume is published.
+type csiNode struct {
+	backend flexBackend
+	nodeID  string
+}
+
+func (n *csiNode) NodeID() (string, error) {
+	if n.nodeID != "" {
+		return n.nodeID, nil
+	}
+
+	return config.hostIdentity.HostUUID()
+}
+
+// Ready is called for every probe, the backend is initialized once when the
+// plugin starts.
+func (n *csiNode) Ready() error {
+	return nil
+}
+
+func (n *csiNode) Publish(req *csi.NodePublishVolumeRequest) error {
+	if mounted, err := mount.Mounted(req.TargetPath); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	options := map[string]interface{}{}
+	for key, value := range req.VolumeContext {
+		if podKey, ok := csiPodKeys[key]; ok {
+			key = podKey
+		}
+		options[key] = value
+	}
+	options["name"] = csiVolumeName(req.VolumeID)
+
+	if _, err := getVolumeContent(options); err != nil {
+		return csi.Errorf(csi.CodeInvalidArgument, "%s", err)
+	}
+
+	created, err := n.backend.Create(options)
+	if err != nil {
+		return err
+	}
+
+	device, err := n.backend.Attach(created)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(req.TargetPath, 0750); err != nil {
+		n.backend.Detach(device)
+		return err
+	}
+
+	if err := n.backend.Mount(req.TargetPath, device, options); err != nil {
+		logrus.Errorf("failed to mount: %s got: %s. calling detach.", req.TargetPath, err)
+		n.backend.Detach(device)
+		return err
+	}
+
+	if req.Readonly {
+		if err := mount.Mount("none", req.TargetPath, "none", "bind,remount,ro"); err != nil {
+			logrus.Errorf("failed to remount read only: %s got: %s. calling detach.", req.TargetPath, err)
+			n.backend.Unmount(req.TargetPath)
+			n.backend.Detach(device)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unpublish revokes the volume and removes it, unpublishing a volume that is
+// not mounted succeeds.
+func (n *csiNode) Unpublish(req *csi.NodeUnpublishVolumeRequest) error {
+	mounted, err := mount.Mounted(req.TargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if mounted {
+		if err := n.backend.Unmount(req.TargetPath); err != nil {
+			return err
+		}
+	}
+
+	removeVolume(path.Join(config.VolumeRoot, csiVolumeName(req.VolumeID)))
+
+	if err := os.Remove(req.TargetPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// csiVolumeName makes the volume ID safe to use as a directory name.
+func csiVolumeName(volumeID string) string {
+	return "csi_" + invalidVolumeNameChars.ReplaceAllString(volumeID, "_")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"path"
+	"testing"
+
+	"github.com/rancher/secrets-bridge-v2/csi"
+	"github.com/rancher/secrets-bridge-v2/csi/csitest"
+)
+
+func TestCSISanity(t *testing.T) {
+	socket := path.Join(t.TempDir(), "csi.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	backend := &fakeBackend{}
+	server := &csi.Server{
+		Name:    csiPluginName,
+		Version: VERSION,
+		Node:    &csiNode{backend: backend, nodeID: "host-uuid"},
+	}
+	go server.Serve(listener)
+
+	csitest.Sanity(t, socket, map[string]string{
+		"policies":                    "app",
+		"csi.storage.k8s.io/pod.name": "web-0",
+	})
+
+	if backend.attached != 1 {
+		t.Errorf("expected one attach, got: %d", backend.attached)
+	}
+}
+
+func TestCSIVolumeName(t *testing.T) {
+	if name := csiVolumeName("pvc-1/../x"); name != "csi_pvc-1_.._x" {
+		t.Errorf("unexpected volume name: %s", name)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+const defaultDatabaseMount = "database"
+
+// databaseSpec is the database secrets engine role to request dynamic
+// credentials from.
+type databaseSpec struct {
+	mount string
+	role  string
+}
+
+// databaseCreds are the dynamic credentials issued for a volume. They are
+// kept in the volume state so renewals don't mint new credentials.
+type databaseCreds struct {
+	LeaseID  string `json:"leaseId"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// getDatabaseSpec parses the databaseRole and databaseMount driver options.
+func getDatabaseSpec(options map[string]interface{}) (*databaseSpec, error) {
+	role, _ := options["databaseRole"].(string)
+	if role == "" {
+		return nil, nil
+	}
+
+	mount, _ := options["databaseMount"].(string)
+	if mount == "" {
+		mount = defaultDatabaseMount
+	}
+
+	spec := &databaseSpec{
+		mount: strings.Trim(mount, "/"),
+		role:  role,
+	}
+
+	if strings.Contains(spec.role, "/") || spec.mount == "" {
+		return spec, fmt.Errorf("invalid database role: %s", spec.credsPath())
+	}
+
+	return spec, nil
+}
+
+func (d *databaseSpec) credsPath() string {
+	return path.Join(d.mount, "creds", d.role)
+}
+
+// read requests new dynamic credentials.
+func (d *databaseSpec) read(vClient *api.Client) (*databaseCreds, error) {
+	logrus.Debugf("requesting database credentials from: %s", d.credsPath())
+	secret, err := vClient.Logical().Read(d.credsPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no credentials returned from: %s", d.credsPath())
+	}
+
+	creds := &databaseCreds{
+		LeaseID: secret.LeaseID,
+	}
+	creds.Username, _ = secret.Data["username"].(string)
+	creds.Password, _ = secret.Data["password"].(string)
+
+	if creds.Username == "" || creds.Password == "" {
+		return creds, fmt.Errorf("incomplete credentials returned from: %s", d.credsPath())
+	}
+
+	return creds, nil
+}
+
+func (d *databaseSpec) fileNames() []string {
+	return []string{"db_username", "db_password"}
+}
+
+func (c *databaseCreds) files() []*volumeFile {
+	return []*volumeFile{
+		{name: "db_username", content: []byte(c.Username)},
+		{name: "db_password", content: []byte(c.Password)},
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/rancher/secrets-bridge-v2/server"
+)
+
+func TestGetDatabaseSpec(t *testing.T) {
+	if spec, err := getDatabaseSpec(map[string]interface{}{}); spec != nil || err != nil {
+		t.Errorf("expected no spec without a role, got: %#v %v", spec, err)
+	}
+
+	spec, err := getDatabaseSpec(map[string]interface{}{"databaseRole": "app"})
+	if err != nil || spec.credsPath() != "database/creds/app" {
+		t.Errorf("unexpected default spec: %#v %v", spec, err)
+	}
+
+	spec, err = getDatabaseSpec(map[string]interface{}{"databaseRole": "app", "databaseMount": "/team/db/"})
+	if err != nil || spec.credsPath() != "team/db/creds/app" {
+		t.Errorf("unexpected spec: %#v %v", spec, err)
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"databaseRole": "../app"},
+		{"databaseRole": "app", "databaseMount": "/"},
+	} {
+		if _, err := getDatabaseSpec(options); err == nil {
+			t.Errorf("expected error for: %#v", options)
+		}
+	}
+}
+
+func TestDatabaseRead(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/database/creds/app":
+			fmt.Fprint(rw, `{"lease_id": "database/creds/app/abc", "lease_duration": 300, "data": {"username": "v-app", "password": "secret"}}`)
+		case "/v1/database/creds/broken":
+			fmt.Fprint(rw, `{"lease_id": "database/creds/broken/abc", "data": {"username": "v-broken"}}`)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	vClient := newTestVaultClient(t, ts.URL, "client-token")
+
+	creds, err := (&databaseSpec{mount: "database", role: "app"}).read(vClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.LeaseID != "database/creds/app/abc" || creds.Username != "v-app" || creds.Password != "secret" {
+		t.Errorf("unexpected credentials: %#v", creds)
+	}
+
+	files := creds.files()
+	if len(files) != 2 || files[0].name != "db_username" || string(files[1].content) != "secret" {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	if _, err := (&databaseSpec{mount: "database", role: "broken"}).read(vClient); err == nil {
+		t.Errorf("expected incomplete credentials to be refused")
+	}
+	if _, err := (&databaseSpec{mount: "database", role: "missing"}).read(vClient); err == nil {
+		t.Errorf("expected an error for a missing role")
+	}
+}
+
+// withRegisteringTokenServer points the driver at a token server that
+// answers registrations with status, the registrations are collected.
+func withRegisteringTokenServer(t *testing.T, status *int) *[]*server.VaultSecretRegisterInput {
+	registered := &[]*server.VaultSecretRegisterInput{}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1-vault-driver/secrets" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		msg := &server.VaultSecretRegisterInput{}
+		json.NewDecoder(r.Body).Decode(msg)
+		*registered = append(*registered, msg)
+		w.WriteHeader(*status)
+	}))
+	t.Cleanup(tokenServer.Close)
+
+	identityFile := path.Join(t.TempDir(), "host.json")
+	if err := ioutil.WriteFile(identityFile, []byte(`{"hostUUID": "static-host"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config = defaultDriverConfig()
+	config.PrivateKeyFile = writeHostKey(t)
+	config.HostIdentity = server.IdentityStatic
+	config.HostIdentityFile = identityFile
+	config.TokenServerURLs = []string{tokenServer.URL + "/v1-vault-driver/tokens"}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return registered
+}
+
+func TestRegisterSecrets(t *testing.T) {
+	status := http.StatusCreated
+	registered := withRegisteringTokenServer(t, &status)
+
+	if err := registerSecrets(&credentials{token: "client-token"}); err != nil || len(*registered) != 0 {
+		t.Errorf("expected nothing to register, got: %v %v", *registered, err)
+	}
+
+	creds := &credentials{
+		token:       "client-token",
+		database:    &databaseCreds{LeaseID: "database/creds/app/abc"},
+		certificate: &certificateCreds{Mount: "pki", SerialNumber: "0a"},
+	}
+	if err := registerSecrets(creds); err != nil {
+		t.Fatal(err)
+	}
+	if len(*registered) != 2 {
+		t.Fatalf("expected the lease and the certificate to be registered, got: %v", *registered)
+	}
+	if lease := (*registered)[0]; lease.Kind != server.SecretLease || lease.ID != "database/creds/app/abc" || lease.HostUUID != "static-host" {
+		t.Errorf("unexpected lease registration: %#v", lease)
+	}
+	if certificate := (*registered)[1]; certificate.Kind != server.SecretCertificate || certificate.ID != "pki/0a" {
+		t.Errorf("unexpected certificate registration: %#v", certificate)
+	}
+
+	// A secret the server refuses to register fails the attach.
+	status = http.StatusForbidden
+	if err := registerSecrets(creds); err == nil {
+		t.Errorf("expected a refused registration to fail")
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	flexvol "github.com/rancher/rancher-flexvol"
+	"github.com/urfave/cli"
+)
+
+const (
+	dockerPluginContentType = "application/vnd.docker.plugins.v1.2+json"
+	defaultDockerSocket     = "/run/docker/plugins/secrets-bridge-v2.sock"
+	// dockerMountPrefix marks the record mounts of Docker containers, Docker
+	// does not bind mount the volume so there is no target path.
+	dockerMountPrefix = "docker:"
+)
+
+// flexBackend is the driver the Docker and Kubernetes frontends translate
+// requests to, FlexVol under normal operation.
+type flexBackend interface {
+	flexvol.FlexDriver
+	flexvol.RancherFlexDriver
+}
+
+// dockerVolume is kept in the state store record of a volume created
+// through the Docker plugin API, Docker only passes the volume name after
+// create. The containers using it are the docker:<id> record mounts.
+type dockerVolume struct {
+	Options map[string]interface{} `json:"options"`
+}
+
+type dockerDriver struct {
+	backend flexBackend
+
+	mu sync.Mutex
+}
+
+type dockerRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+}
+
+type dockerVolumeInfo struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type dockerResponse struct {
+	Err          string
+	Mountpoint   string              `json:",omitempty"`
+	Volume       *dockerVolumeInfo   `json:",omitempty"`
+	Volumes      []*dockerVolumeInfo `json:",omitempty"`
+	Capabilities *dockerCapabilities `json:",omitempty"`
+}
+
+type dockerCapabilities struct {
+	Scope string
+}
+
+// DockerCommand serves the Docker volume plugin protocol on a unix socket.
+func DockerCommand() cli.Command {
+	return cli.Command{
+		Name:   "docker",
+		Usage:  "Run as a Docker volume plugin",
+		Action: serveDockerPlugin,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "socket",
+				Usage: "unix socket to serve the plugin API on",
+				Value: defaultDockerSocket,
+			},
+		},
+	}
+}
+
+func serveDockerPlugin(c *cli.Context) error {
+	driver, err := newDockerDriver(&FlexVol{})
+	if err != nil {
+		return err
+	}
+
+	socket := c.String("socket")
+	if err := os.MkdirAll(path.Dir(socket), 0755); err != nil {
+		return err
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	logrus.Infof("serving Docker volume plugin on: %s", socket)
+	return http.Serve(listener, driver.handler())
+}
+
+func newDockerDriver(backend flexBackend) (*dockerDriver, error) {
+	if err := backend.Init(); err != nil {
+		return nil, err
+	}
+	return &dockerDriver{backend: backend}, nil
+}
+
+func (d *dockerDriver) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", dockerPluginContentType)
+		json.NewEncoder(rw).Encode(map[string][]string{"Implements": {"VolumeDriver"}})
+	})
+
+	handlers := map[string]func(*dockerRequest) (*dockerResponse, error){
+		"/VolumeDriver.Create":       d.create,
+		"/VolumeDriver.Remove":       d.remove,
+		"/VolumeDriver.Mount":        d.mount,
+		"/VolumeDriver.Unmount":      d.unmount,
+		"/VolumeDriver.Get":          d.get,
+		"/VolumeDriver.List":         d.list,
+		"/VolumeDriver.Path":         d.path,
+		"/VolumeDriver.Capabilities": d.capabilities,
+	}
+
+	for route, handle := range handlers {
+		mux.HandleFunc(route, dockerHandler(handle))
+	}
+
+	return mux
+}
+
+func dockerHandler(handle func(*dockerRequest) (*dockerResponse, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", dockerPluginContentType)
+
+		request := &dockerRequest{}
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(rw).Encode(&dockerResponse{Err: err.Error()})
+				return
+			}
+		}
+
+		resp, err := handle(request)
+		if err != nil {
+			logrus.Errorf("%s %s failed: %s", req.URL.Path, request.Name, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			resp = &dockerResponse{Err: err.Error()}
+		}
+
+		json.NewEncoder(rw).Encode(resp)
+	}
+}
+
+func (d *dockerDriver) create(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if req.Name == "" {
+		return nil, fmt.Errorf("no name was passed to driver")
+	}
+
+	if volPath, _, err := lookupDockerVolume(req.Name); err != nil || volPath != "" {
+		return &dockerResponse{}, err
+	}
+
+	options := map[string]interface{}{}
+	for key, value := range req.Opts {
+		options[key] = value
+	}
+	options["name"] = req.Name
+
+	// Fail early on bad options, attach happens on the first mount.
+	content, err := getVolumeContent(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Docker bind mounts the volume itself, it can not be made read only
+	// for the unbounded ramfs volumes.
+	if content.files.storage.mode != storageTmpfs {
+		return nil, fmt.Errorf("storage: %s is not supported by the Docker plugin, only %s", content.files.storage.mode, storageTmpfs)
+	}
+
+	resp, err := d.backend.Create(options)
+	if err != nil {
+		return nil, err
+	}
+
+	device, _ := resp["device"].(string)
+	values, err := getDeviceValues(device)
+	if err != nil {
+		return nil, err
+	}
+	delete(options, "device")
+
+	return &dockerResponse{}, volumeStore.modify(values.Get("device"), func(record *volumeRecord) {
+		record.Name = req.Name
+		if record.State == "" {
+			record.State = volumeCreated
+		}
+		record.Docker = &dockerVolume{Options: options}
+	})
+}
+
+func (d *dockerDriver) remove(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	volPath, record, err := lookupDockerVolume(req.Name)
+	if err != nil || volPath == "" {
+		return &dockerResponse{}, err
+	}
+
+	if len(dockerMounts(record)) > 0 {
+		return nil, fmt.Errorf("volume: %s is in use", req.Name)
+	}
+
+	if err := d.backend.Delete(map[string]interface{}{"name": record.Name, "device": recordDevice(volPath, record)}); err != nil {
+		return nil, err
+	}
+
+	return &dockerResponse{}, volumeStore.remove(volPath)
+}
+
+func (d *dockerDriver) mount(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	volPath, record, err := lookupDockerVolume(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if volPath == "" {
+		return nil, fmt.Errorf("no such volume: %s", req.Name)
+	}
+
+	mounts := dockerMounts(record)
+	if len(mounts) == 0 {
+		options := map[string]interface{}{}
+		for key, value := range record.Docker.Options {
+			options[key] = value
+		}
+		options["device"] = recordDevice(volPath, record)
+
+		if _, err := d.backend.Attach(options); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := recordDockerMounts(volPath, mergeStrings(mounts, []string{dockerMountPrefix + req.ID})); err != nil {
+		return nil, err
+	}
+
+	return &dockerResponse{Mountpoint: volPath}, nil
+}
+
+func (d *dockerDriver) unmount(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	volPath, record, err := lookupDockerVolume(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if volPath == "" {
+		return nil, fmt.Errorf("no such volume: %s", req.Name)
+	}
+
+	mounts := dockerMounts(record)
+	if !containsString(mounts, dockerMountPrefix+req.ID) {
+		return &dockerResponse{}, nil
+	}
+
+	if len(mounts) == 1 {
+		if err := d.backend.Detach(recordDevice(volPath, record)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dockerResponse{}, recordDockerMounts(volPath, removeString(mounts, dockerMountPrefix+req.ID))
+}
+
+func (d *dockerDriver) get(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	volPath, record, err := lookupDockerVolume(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if volPath == "" {
+		return nil, fmt.Errorf("no such volume: %s", req.Name)
+	}
+
+	return &dockerResponse{
+		Volume: &dockerVolumeInfo{Name: record.Name, Mountpoint: dockerMountpoint(volPath, record)},
+	}, nil
+}
+
+func (d *dockerDriver) list(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	resp := &dockerResponse{Volumes: []*dockerVolumeInfo{}}
+	err := volumeStore.view(func(volumes map[string]*volumeRecord) error {
+		for volPath, record := range volumes {
+			if record.Docker != nil {
+				resp.Volumes = append(resp.Volumes, &dockerVolumeInfo{Name: record.Name, Mountpoint: dockerMountpoint(volPath, record)})
+			}
+		}
+		return nil
+	})
+	sort.Slice(resp.Volumes, func(i, j int) bool {
+		return resp.Volumes[i].Name < resp.Volumes[j].Name
+	})
+
+	return resp, err
+}
+
+func (d *dockerDriver) path(req *dockerRequest) (*dockerResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	volPath, record, err := lookupDockerVolume(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if volPath == "" {
+		return nil, fmt.Errorf("no such volume: %s", req.Name)
+	}
+
+	return &dockerResponse{Mountpoint: dockerMountpoint(volPath, record)}, nil
+}
+
+func (d *dockerDriver) capabilities(req *dockerRequest) (*dockerResponse, error) {
+	return &dockerResponse{Capabilities: &dockerCapabilities{Scope: "local"}}, nil
+}
+
+// lookupDockerVolume returns the path and a copy of the record of the Docker
+// volume name, an empty path if there is none.
+func lookupDockerVolume(name string) (string, *volumeRecord, error) {
+	var volPath string
+	var record *volumeRecord
+	err := volumeStore.view(func(volumes map[string]*volumeRecord) error {
+		for p, r := range volumes {
+			if r.Docker != nil && r.Name == name {
+				copied := *r
+				volPath, record = p, &copied
+			}
+		}
+		return nil
+	})
+	return volPath, record, err
+}
+
+// dockerMounts are the docker:<id> mounts of the containers using the volume.
+func dockerMounts(record *volumeRecord) []string {
+	mounts := []string{}
+	for _, target := range record.Mounts {
+		if strings.HasPrefix(target, dockerMountPrefix) {
+			mounts = append(mounts, target)
+		}
+	}
+	return mounts
+}
+
+func dockerMountpoint(volPath string, record *volumeRecord) string {
+	if len(dockerMounts(record)) == 0 {
+		return ""
+	}
+	return volPath
+}
+
+// recordDockerMounts keeps the containers using the volume in the state
+// store, which also tells the garbage collector the tmpfs is in use.
+func recordDockerMounts(volPath string, mounts []string) error {
+	sort.Strings(mounts)
+	return volumeStore.modify(volPath, func(record *volumeRecord) {
+		record.Mounts = mounts
+		if len(mounts) > 0 {
+			record.State = volumeMounted
+		}
+	})
+}
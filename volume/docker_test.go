@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+type fakeBackend struct {
+	attached int
+	detached int
+}
+
+func (f *fakeBackend) Init() error { return nil }
+
+func (f *fakeBackend) Create(options map[string]interface{}) (map[string]interface{}, error) {
+	options["device"] = newDeviceString(path.Join("/tmp/volumes", options["name"].(string)))
+	return options, nil
+}
+
+func (f *fakeBackend) Delete(options map[string]interface{}) error { return nil }
+
+func (f *fakeBackend) Attach(options map[string]interface{}) (string, error) {
+	f.attached++
+	values, err := getDeviceValues(options["device"].(string))
+	if err != nil {
+		return "", err
+	}
+	values.Set("accessor", "abc")
+	return values.Encode(), nil
+}
+
+func (f *fakeBackend) Detach(device string) error {
+	f.detached++
+	return nil
+}
+
+func (f *fakeBackend) Mount(dir, device string, options map[string]interface{}) error { return nil }
+
+func (f *fakeBackend) Unmount(dir string) error { return nil }
+
+func dockerCall(t *testing.T, ts *httptest.Server, route string, body interface{}) *dockerResponse {
+	content, _ := json.Marshal(body)
+	resp, err := http.Post(ts.URL+route, dockerPluginContentType, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result := &dockerResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDockerDriverLifecycle(t *testing.T) {
+	saved := volumeStore
+	volumeStore = newTestStateStore(t.TempDir())
+	defer func() { volumeStore = saved }()
+
+	backend := &fakeBackend{}
+	driver, err := newDockerDriver(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(driver.handler())
+	defer ts.Close()
+
+	if resp := dockerCall(t, ts, "/VolumeDriver.Create", map[string]interface{}{
+		"Name": "web",
+		"Opts": map[string]string{"policies": "app"},
+	}); resp.Err != "" {
+		t.Fatalf("create failed: %s", resp.Err)
+	}
+
+	if resp := dockerCall(t, ts, "/VolumeDriver.Create", map[string]interface{}{
+		"Name": "locked",
+		"Opts": map[string]string{"policies": "app", "storage": "mlock"},
+	}); resp.Err == "" {
+		t.Errorf("expected ramfs storage to be refused")
+	}
+
+	for _, id := range []string{"one", "two"} {
+		resp := dockerCall(t, ts, "/VolumeDriver.Mount", map[string]string{"Name": "web", "ID": id})
+		if resp.Err != "" || resp.Mountpoint != "/tmp/volumes/web" {
+			t.Fatalf("unexpected mount response: %#v", resp)
+		}
+	}
+
+	if backend.attached != 1 {
+		t.Errorf("expected one attach, got: %d", backend.attached)
+	}
+
+	if resp := dockerCall(t, ts, "/VolumeDriver.Remove", map[string]string{"Name": "web"}); resp.Err == "" {
+		t.Errorf("expected removing a mounted volume to fail")
+	}
+
+	// The volumes are in the state store, they survive a plugin restart.
+	record, err := volumeStore.get("/tmp/volumes/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Docker == nil || record.Docker.Options["policies"] != "app" || len(record.Mounts) != 2 {
+		t.Fatalf("volume was not recorded: %#v", record)
+	}
+	if resp := dockerCall(t, ts, "/VolumeDriver.Get", map[string]string{"Name": "web"}); resp.Volume == nil || resp.Volume.Mountpoint != "/tmp/volumes/web" {
+		t.Fatalf("unexpected get response: %#v", resp)
+	}
+
+	dockerCall(t, ts, "/VolumeDriver.Unmount", map[string]string{"Name": "web", "ID": "one"})
+	if backend.detached != 0 {
+		t.Errorf("detached while still in use")
+	}
+	dockerCall(t, ts, "/VolumeDriver.Unmount", map[string]string{"Name": "web", "ID": "two"})
+	if backend.detached != 1 {
+		t.Errorf("expected one detach, got: %d", backend.detached)
+	}
+
+	if resp := dockerCall(t, ts, "/VolumeDriver.Remove", map[string]string{"Name": "web"}); resp.Err != "" {
+		t.Errorf("remove failed: %s", resp.Err)
+	}
+
+	if resp := dockerCall(t, ts, "/VolumeDriver.List", nil); len(resp.Volumes) != 0 {
+		t.Errorf("expected no volumes, got: %d", len(resp.Volumes))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+const (
+	defaultDirMode = 0755
+	privateMode    = 0600
+)
+
+var seLinuxContextRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:,-]+$`)
+
+// fileOptions controls the ownership and permissions of the volume and the
+// files written into it.
+type fileOptions struct {
+	// uid and gid are -1 when the files stay owned by root.
+	uid            int
+	gid            int
+	fileMode       os.FileMode
+	dirMode        os.FileMode
+	seLinuxContext string
+	// storage is nil when only the file options were set up, nothing is
+	// checked on write then.
+	storage *storageOptions
+}
+
+// getFileOptions parses the uid, gid, fileMode, mode, seLinuxContext and
+// storage driver options.
+func getFileOptions(options map[string]interface{}) (*fileOptions, error) {
+	files := &fileOptions{}
+
+	var err error
+	if files.uid, err = getIDOption(options, "uid"); err != nil {
+		return files, err
+	}
+
+	if files.gid, err = getIDOption(options, "gid"); err != nil {
+		return files, err
+	}
+
+	if files.fileMode, err = getModeOption(options, "fileMode", defaultFileMode); err != nil {
+		return files, err
+	}
+
+	// mode has always been the mode of the volume directory.
+	if files.dirMode, err = getModeOption(options, "mode", defaultDirMode); err != nil {
+		return files, err
+	}
+
+	if context, ok := options["seLinuxContext"].(string); ok && context != "" {
+		if !seLinuxContextRegexp.MatchString(context) {
+			return files, fmt.Errorf("invalid seLinuxContext: %s", context)
+		}
+		files.seLinuxContext = context
+	}
+
+	if files.storage, err = getStorageOptions(options); err != nil {
+		return files, err
+	}
+
+	return files, nil
+}
+
+// mountOpts adds the SELinux label to the storage mount options.
+func (f *fileOptions) mountOpts() string {
+	mountOpts := f.storage.mountOpts()
+	if f.seLinuxContext == "" {
+		return mountOpts
+	}
+	return fmt.Sprintf("%s,context=\"%s\"", mountOpts, f.seLinuxContext)
+}
+
+// setupDir applies the directory mode and ownership to the mounted volume.
+// Like the files, the directory is changed through an open descriptor that
+// did not follow a symlink.
+func (f *fileOptions) setupDir(dir string) error {
+	d, err := os.OpenFile(dir, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Chmod(f.dirMode); err != nil {
+		return err
+	}
+	return d.Chown(f.uid, f.gid)
+}
+
+// writeFile writes a file the workload should be able to read. A zero mode
+// uses the volume fileMode.
+func (f *fileOptions) writeFile(dir, name string, content []byte, mode os.FileMode) error {
+	if mode == 0 {
+		mode = f.fileMode
+	}
+
+	if f.storage != nil {
+		if err := f.storage.checkWrite(dir, name, len(content)); err != nil {
+			return err
+		}
+	}
+
+	return writeVolumeFile(dir, name, content, mode, f.uid, f.gid)
+}
+
+// writePrivateFile writes a file for the driver only, owned by root and not
+// readable by non-root workloads.
+func writePrivateFile(dir, name string, content []byte) error {
+	return writeVolumeFile(dir, name, content, privateMode, 0, 0)
+}
+
+// writeVolumeFile replaces name in dir with content. The volume is bind
+// mounted read-write into the workload, which can put a symlink where the
+// driver writes next, so nothing here follows one: the content goes to a new
+// temporary file opened with O_NOFOLLOW, its mode and owner are set on the
+// open file, and it is renamed over name. A uid or gid of -1 is left alone.
+func writeVolumeFile(dir, name string, content []byte, mode os.FileMode, uid, gid int) error {
+	fullPath := path.Join(dir, name)
+	if info, err := os.Lstat(fullPath); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to write: %s, it is not a regular file", fullPath)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpPath := path.Join(dir, fmt.Sprintf(".%s.%x.tmp", name, suffix))
+
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, privateMode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := writeOpenFile(tmp, content, mode, uid, gid); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, fullPath)
+}
+
+// writeOpenFile sets the mode and owner before the content is written, the
+// file is created private so it is never readable with the wrong owner.
+func writeOpenFile(f *os.File, content []byte, mode os.FileMode, uid, gid int) error {
+	if err := f.Chown(uid, gid); err != nil {
+		return err
+	}
+
+	// OpenFile is subject to the umask.
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// getModeOption parses an octal mode. Rancher passes options as strings, a
+// JSON number is read as if its digits were octal, so 755 means 0755, and
+// must be a whole number.
+func getModeOption(options map[string]interface{}, key string, defaultMode os.FileMode) (os.FileMode, error) {
+	var mode string
+	switch value := options[key].(type) {
+	case nil:
+		return defaultMode, nil
+	case string:
+		mode = value
+	case float64:
+		if value != math.Trunc(value) {
+			return defaultMode, fmt.Errorf("option: %s must be an octal mode", key)
+		}
+		mode = strconv.FormatInt(int64(value), 10)
+	case int:
+		mode = strconv.Itoa(value)
+	default:
+		return defaultMode, fmt.Errorf("option: %s must be an octal mode", key)
+	}
+
+	parsed, err := parseFileMode(mode, defaultMode)
+	if err != nil {
+		return defaultMode, fmt.Errorf("option: %s is invalid: %s", key, err)
+	}
+	return parsed, nil
+}
+
+// getIDOption parses a uid or gid, -1 is returned when it is not set.
+func getIDOption(options map[string]interface{}, key string) (int, error) {
+	var id int
+	switch value := options[key].(type) {
+	case nil:
+		return -1, nil
+	case string:
+		if value == "" {
+			return -1, nil
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return -1, fmt.Errorf("option: %s must be a number", key)
+		}
+		id = parsed
+	case float64:
+		if value != math.Trunc(value) {
+			return -1, fmt.Errorf("option: %s must be a number", key)
+		}
+		id = int(value)
+	case int:
+		id = value
+	default:
+		return -1, fmt.Errorf("option: %s must be a number", key)
+	}
+
+	if id < 0 {
+		return -1, fmt.Errorf("option: %s must not be negative", key)
+	}
+	return id, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetFileOptions(t *testing.T) {
+	files, err := getFileOptions(map[string]interface{}{
+		"uid":            "1000",
+		"gid":            float64(1000),
+		"fileMode":       "0400",
+		"mode":           float64(750),
+		"seLinuxContext": "system_u:object_r:svirt_sandbox_file_t:s0:c1,c2",
+	})
+	if err != nil {
+		t.Fatalf("failed to parse file options: %s", err)
+	}
+
+	if files.uid != 1000 || files.gid != 1000 {
+		t.Errorf("unexpected ownership: %d:%d", files.uid, files.gid)
+	}
+
+	if files.fileMode != os.FileMode(0400) || files.dirMode != os.FileMode(0750) {
+		t.Errorf("unexpected modes: %s %s", files.fileMode, files.dirMode)
+	}
+
+	expected := `noexec,nosuid,nodev,size=10485760,context="system_u:object_r:svirt_sandbox_file_t:s0:c1,c2"`
+	if opts := files.mountOpts(); opts != expected {
+		t.Errorf("expected: %s got: %s", expected, opts)
+	}
+}
+
+func TestGetFileOptionsDefaults(t *testing.T) {
+	files, err := getFileOptions(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("failed to parse file options: %s", err)
+	}
+
+	if files.uid != -1 || files.gid != -1 || files.fileMode != defaultFileMode || files.dirMode != defaultDirMode {
+		t.Errorf("unexpected defaults: %#v", files)
+	}
+}
+
+func TestGetFileOptionsInvalid(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"uid": "root"},
+		{"gid": float64(-5)},
+		{"fileMode": "0999"},
+		{"mode": "17777"},
+		{"mode": float64(1.5)},
+		{"fileMode": float64(640.9)},
+		{"uid": float64(1000.5)},
+		{"seLinuxContext": `system_u" ,rw`},
+	} {
+		if _, err := getFileOptions(options); err == nil {
+			t.Errorf("expected error for: %#v", options)
+		}
+	}
+}
+
+func TestWriteFileRefusesSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, []byte("host file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	volDir := filepath.Join(dir, "volume")
+	if err := os.Mkdir(volDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(volDir, "token")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(volDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := &fileOptions{uid: -1, gid: -1, fileMode: 0640}
+	for _, name := range []string{"token", "dir"} {
+		if err := files.writeFile(volDir, name, []byte("secret"), 0); err == nil {
+			t.Errorf("expected writing over: %s to fail", name)
+		}
+	}
+
+	if content, _ := ioutil.ReadFile(target); string(content) != "host file" {
+		t.Errorf("symlink target was written: %q", content)
+	}
+
+	if err := files.writeFile(volDir, "password", []byte("secret"), 0); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	info, err := os.Lstat(filepath.Join(volDir, "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0640 {
+		t.Errorf("expected a regular 0640 file got: %s", info.Mode())
+	}
+
+	names, _ := filepath.Glob(filepath.Join(volDir, ".*.tmp"))
+	if len(names) != 0 {
+		t.Errorf("temporary files were left: %v", names)
+	}
+}
+
+func TestSetupDirRefusesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "volume")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := &fileOptions{uid: -1, gid: -1, dirMode: 0755}
+	if err := files.setupDir(filepath.Join(dir, "volume")); err == nil {
+		t.Errorf("expected a symlinked volume directory to fail")
+	}
+
+	if err := files.setupDir(target); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("expected mode 0755, got: %v %v", info, err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/moby/moby/pkg/mount"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/secrets-bridge-v2/server"
+	"github.com/urfave/cli"
+)
+
+// Garbage collection outcomes reported per volume.
+const (
+	gcKept      = "kept"
+	gcCollected = "collected"
+	gcWould     = "would collect"
+	gcFailed    = "failed"
+)
+
+// gcResult is the outcome for a single volume.
+type gcResult struct {
+	path   string
+	action string
+	reason string
+}
+
+// collector finds volumes no running container uses, revokes their secrets
+// and removes them. Both tmpfs mounts under the volume root and state store
+// records of volumes that are gone, e.g. after a reboot, are collected.
+type collector struct {
+	root   string
+	dryRun bool
+	// containers returns the host UUID and the containers known to Rancher.
+	containers func() (string, []metadata.Container, error)
+	mounts     func() ([]*mount.Info, error)
+	revoke     func(secrets *volumeSecrets) error
+}
+
+// GCCommand collects orphaned volumes and their tokens.
+func GCCommand() cli.Command {
+	return cli.Command{
+		Name:   "gc",
+		Usage:  "Remove orphaned volumes and revoke their tokens",
+		Action: collectGarbage,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "report what would be collected without changing anything",
+			},
+		},
+	}
+}
+
+func collectGarbage(c *cli.Context) error {
+	gc := newCollector(c.Bool("dry-run"))
+
+	results, err := gc.run()
+	printGCReport(os.Stdout, results)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.action == gcFailed {
+			return fmt.Errorf("failed to collect: %s: %s", result.path, result.reason)
+		}
+	}
+	return nil
+}
+
+func newCollector(dryRun bool) *collector {
+	return &collector{
+		root:       config.VolumeRoot,
+		dryRun:     dryRun,
+		containers: getHostContainers,
+		mounts:     mount.GetMounts,
+		revoke: func(secrets *volumeSecrets) error {
+			return secrets.revoke()
+		},
+	}
+}
+
+func (gc *collector) run() ([]*gcResult, error) {
+	hostUUID, containers, err := gc.containers()
+	if err != nil {
+		return nil, fmt.Errorf("can not tell which volumes are in use: %s", err)
+	}
+
+	mounts, err := gc.mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]*volumeRecord{}
+	if err := volumeStore.view(func(volumes map[string]*volumeRecord) error {
+		for volPath, record := range volumes {
+			copied := *record
+			records[volPath] = &copied
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	results := []*gcResult{}
+
+	volumeMounts := map[string]*mount.Info{}
+	for _, info := range mounts {
+		if isVolumeFstype(info.Fstype) && path.Dir(info.Mountpoint) == gc.root {
+			volumeMounts[info.Mountpoint] = info
+		}
+	}
+
+	for volPath, info := range volumeMounts {
+		record := records[volPath]
+		if reason := gc.inUse(volPath, info, record, mounts, hostUUID, containers); reason != "" {
+			results = append(results, &gcResult{path: volPath, action: gcKept, reason: reason})
+			continue
+		}
+
+		results = append(results, gc.collect(volPath, recordSecrets(record), record, "no container uses the volume"))
+	}
+
+	// Records of volumes whose tmpfs is gone still hold live tokens.
+	for volPath, record := range records {
+		if _, ok := volumeMounts[volPath]; ok {
+			continue
+		}
+		if reason := gc.inUse(volPath, nil, record, mounts, hostUUID, containers); reason != "" {
+			results = append(results, &gcResult{path: volPath, action: gcKept, reason: reason})
+			continue
+		}
+
+		results = append(results, gc.collect(volPath, recordSecrets(record), record, "volume is no longer mounted"))
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].path < results[j].path
+	})
+
+	return results, nil
+}
+
+// inUse returns why the volume must be kept, empty if it is an orphan.
+func (gc *collector) inUse(volPath string, info *mount.Info, record *volumeRecord, mounts []*mount.Info, hostUUID string, containers []metadata.Container) string {
+	if record != nil {
+		switch record.State {
+		case volumeCreated, volumeDetached:
+			if record.Accessor == "" && info == nil {
+				return "volume is not attached"
+			}
+		}
+
+		for _, target := range record.Mounts {
+			// Frontends that do not bind mount record an ID instead of a path.
+			if !strings.HasPrefix(target, "/") {
+				return fmt.Sprintf("in use by: %s", target)
+			}
+			for _, m := range mounts {
+				if m.Mountpoint == target {
+					return fmt.Sprintf("mounted at: %s", target)
+				}
+			}
+		}
+	}
+
+	if info != nil {
+		for _, m := range mounts {
+			if m.Mountpoint != info.Mountpoint && m.Major == info.Major && m.Minor == info.Minor {
+				return fmt.Sprintf("mounted at: %s", m.Mountpoint)
+			}
+		}
+	}
+
+	if container := volumeContainer(path.Base(volPath), hostUUID, containers); container != "" {
+		return fmt.Sprintf("used by container: %s", container)
+	}
+
+	return ""
+}
+
+func (gc *collector) collect(volPath string, secrets *volumeSecrets, record *volumeRecord, reason string) *gcResult {
+	result := &gcResult{path: volPath, action: gcCollected, reason: reason}
+	if gc.dryRun {
+		result.action = gcWould
+		return result
+	}
+
+	unlock, err := lockVolume(volPath)
+	if err != nil {
+		result.action = gcFailed
+		result.reason = err.Error()
+		return result
+	}
+	defer unlock()
+
+	if err := gc.revoke(secrets); err != nil {
+		result.action = gcFailed
+		result.reason = fmt.Sprintf("failed to revoke: %s", err)
+		return result
+	}
+
+	if record != nil {
+		for _, target := range record.Mounts {
+			if strings.HasPrefix(target, "/") {
+				if err := mount.Unmount(target); err != nil {
+					logrus.Errorf("failed to unmount: %s got: %s", target, err)
+				}
+			}
+		}
+	}
+
+	if path.Dir(volPath) == gc.root {
+		cleanupTmpfs(volPath)
+	}
+
+	if err := volumeStore.remove(volPath); err != nil {
+		result.action = gcFailed
+		result.reason = err.Error()
+	}
+
+	return result
+}
+
+// volumeContainer returns the running container on the host a per container
+// volume belongs to. Rancher names those volumes
+// <stack>_<volume>_<service index>_<first 5 characters of the container UUID>.
+func volumeContainer(name, hostUUID string, containers []metadata.Container) string {
+	for _, container := range containers {
+		if container.HostUUID != hostUUID || container.StackName == "" || len(container.UUID) < 5 {
+			continue
+		}
+		if container.State != "running" && container.State != "starting" && container.State != "restarting" {
+			continue
+		}
+
+		suffix := fmt.Sprintf("_%s_%s", container.ServiceIndex, container.UUID[:5])
+		if strings.HasPrefix(name, container.StackName+"_") && strings.HasSuffix(name, suffix) {
+			return container.Name
+		}
+	}
+	return ""
+}
+
+// getHostContainers lists the containers of Rancher hosts, volumes on other
+// hosts are only kept by their mounts.
+func getHostContainers() (string, []metadata.Container, error) {
+	if config.hostIdentity.Provider() != server.IdentityRancher {
+		return "", nil, nil
+	}
+
+	client, err := hostMetadata.metadataClient(config.MetadataURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	host, err := client.GetSelfHost()
+	if err != nil {
+		return "", nil, err
+	}
+
+	containers, err := client.GetContainers()
+	return host.UUID, containers, err
+}
+
+func printGCReport(out io.Writer, results []*gcResult) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tACTION\tREASON")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.path, result.action, result.reason)
+	}
+	w.Flush()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/moby/moby/pkg/mount"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func newTestCollector(t *testing.T, mounts []*mount.Info, containers []metadata.Container) (*collector, *[]string) {
+	revoked := &[]string{}
+	return &collector{
+		root: path.Join(t.TempDir(), "volumes"),
+		containers: func() (string, []metadata.Container, error) {
+			return "host-uuid", containers, nil
+		},
+		mounts: func() ([]*mount.Info, error) {
+			return mounts, nil
+		},
+		revoke: func(secrets *volumeSecrets) error {
+			*revoked = append(*revoked, secrets.accessor)
+			return nil
+		},
+	}, revoked
+}
+
+func TestCollectorRun(t *testing.T) {
+	saved := volumeStore
+	volumeStore = newTestStateStore(t.TempDir())
+	defer func() { volumeStore = saved }()
+
+	gc, revoked := newTestCollector(t, nil, []metadata.Container{
+		{Name: "web-1", UUID: "abcdef123", StackName: "web", ServiceIndex: "1", HostUUID: "host-uuid", State: "running"},
+		{Name: "db-1", UUID: "0123456789", StackName: "db", ServiceIndex: "1", HostUUID: "other-host", State: "running"},
+	})
+
+	orphan := path.Join(gc.root, "db_secrets_1_01234")
+	used := path.Join(gc.root, "web_secrets_1_abcde")
+	ramfsOrphan := path.Join(gc.root, "db_secrets_2_56789")
+	stale := path.Join(gc.root, "stale")
+	docker := path.Join(gc.root, "docker")
+	created := path.Join(gc.root, "created")
+
+	for _, dir := range []string{orphan, used, ramfsOrphan} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the state store is trusted, not what the workload wrote.
+	if err := ioutil.WriteFile(path.Join(orphan, ".accessor"), []byte("forged-accessor"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gc.mounts = func() ([]*mount.Info, error) {
+		return []*mount.Info{
+			{Mountpoint: orphan, Fstype: "tmpfs", Major: 0, Minor: 50},
+			{Mountpoint: used, Fstype: "tmpfs", Major: 0, Minor: 51},
+			// ramfs and mlock volumes.
+			{Mountpoint: ramfsOrphan, Fstype: "ramfs", Major: 0, Minor: 52},
+			{Mountpoint: "/", Fstype: "ext4", Major: 8, Minor: 1},
+		}, nil
+	}
+
+	records := map[string]func(record *volumeRecord){
+		orphan: func(record *volumeRecord) {
+			record.State = volumeAttached
+			record.Accessor = "orphan-accessor"
+		},
+		ramfsOrphan: func(record *volumeRecord) {
+			record.State = volumeAttached
+			record.Accessor = "ramfs-accessor"
+		},
+		stale: func(record *volumeRecord) {
+			record.State = volumeMounted
+			record.Accessor = "stale-accessor"
+			record.Mounts = []string{"/var/lib/kubelet/pods/gone"}
+		},
+		docker: func(record *volumeRecord) {
+			record.State = volumeMounted
+			record.Accessor = "docker-accessor"
+			record.Mounts = []string{"docker:container"}
+		},
+		created: func(record *volumeRecord) {
+			record.State = volumeCreated
+		},
+	}
+	for volPath, fn := range records {
+		if err := volumeStore.modify(volPath, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc.dryRun = true
+	results, err := gc.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*revoked) != 0 {
+		t.Errorf("dry run revoked: %v", *revoked)
+	}
+
+	expected := map[string]string{
+		orphan:      gcWould,
+		ramfsOrphan: gcWould,
+		used:        gcKept,
+		stale:       gcWould,
+		docker:      gcKept,
+		created:     gcKept,
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got: %d", len(expected), len(results))
+	}
+	for _, result := range results {
+		if result.action != expected[result.path] {
+			t.Errorf("%s: expected: %s got: %s (%s)", result.path, expected[result.path], result.action, result.reason)
+		}
+	}
+
+	gc.dryRun = false
+	if _, err := gc.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*revoked) != 3 || !containsString(*revoked, "orphan-accessor") || !containsString(*revoked, "ramfs-accessor") || !containsString(*revoked, "stale-accessor") {
+		t.Errorf("unexpected revoked accessors: %v", *revoked)
+	}
+	for _, volPath := range []string{orphan, ramfsOrphan} {
+		if _, err := os.Stat(volPath); !os.IsNotExist(err) {
+			t.Errorf("orphaned volume was not removed: %s", volPath)
+		}
+	}
+	if _, err := os.Stat(used); err != nil {
+		t.Errorf("volume in use was removed: %s", err)
+	}
+	for volPath, keep := range map[string]bool{stale: false, docker: true, created: true} {
+		record, err := volumeStore.get(volPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (record != nil) != keep {
+			t.Errorf("%s: expected record kept: %v", volPath, keep)
+		}
+	}
+}
+
+func TestVolumeContainer(t *testing.T) {
+	containers := []metadata.Container{
+		{Name: "web-1", UUID: "abcdef123", StackName: "web", ServiceIndex: "1", HostUUID: "host", State: "stopped"},
+		{Name: "web-2", UUID: "12345abcd", StackName: "web", ServiceIndex: "2", HostUUID: "host", State: "running"},
+	}
+
+	if name := volumeContainer("web_secrets_1_abcde", "host", containers); name != "" {
+		t.Errorf("stopped container matched: %s", name)
+	}
+	if name := volumeContainer("web_secrets_2_12345", "host", containers); name != "web-2" {
+		t.Errorf("expected web-2, got: %q", name)
+	}
+	if name := volumeContainer("web_secrets_2_12345", "other", containers); name != "" {
+		t.Errorf("container on another host matched: %s", name)
+	}
+}
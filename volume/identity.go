@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/secrets-bridge-v2/server"
+)
+
+// HostIdentity tells the token server which host a request comes from.
+type HostIdentity interface {
+	// Provider names how the token server verifies the host.
+	Provider() string
+	// HostUUID identifies the host in signed requests.
+	HostUUID() (string, error)
+	// Proof returns the headers the token server needs to verify the host
+	// for the request with nonce, none if the server looks the host up
+	// itself.
+	Proof(nonce string) (http.Header, error)
+}
+
+// newHostIdentity returns the identity provider named in the driver config.
+func newHostIdentity(cfg *driverConfig) (HostIdentity, error) {
+	switch cfg.HostIdentity {
+	case server.IdentityRancher:
+		return &rancherIdentity{}, nil
+	case server.IdentityStatic:
+		return &staticIdentity{path: cfg.HostIdentityFile}, nil
+	case server.IdentityCloud:
+		return &cloudIdentity{url: cfg.CloudIdentityURL, timeout: cfg.requestTimeout, privateKeyFile: cfg.PrivateKeyFile}, nil
+	}
+	return nil, fmt.Errorf("unknown host identity provider: %s", cfg.HostIdentity)
+}
+
+// rancherIdentity is the host UUID from Rancher metadata, the token server
+// reads the host key from Rancher.
+type rancherIdentity struct{}
+
+func (r *rancherIdentity) Provider() string {
+	return server.IdentityRancher
+}
+
+func (r *rancherIdentity) HostUUID() (string, error) {
+	host, err := getHostMetadata()
+	return host.UUID, err
+}
+
+func (r *rancherIdentity) Proof(nonce string) (http.Header, error) {
+	return nil, nil
+}
+
+// staticIdentity reads the host UUID from a file, {"hostUUID": "..."}. The
+// host key must be registered in the host keys file of the token server.
+type staticIdentity struct {
+	path string
+}
+
+func (s *staticIdentity) Provider() string {
+	return server.IdentityStatic
+}
+
+func (s *staticIdentity) HostUUID() (string, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+
+	identity := struct {
+		HostUUID string `json:"hostUUID"`
+	}{}
+	if err := json.Unmarshal(content, &identity); err != nil {
+		return "", fmt.Errorf("invalid host identity file: %s: %s", s.path, err)
+	}
+	if identity.HostUUID == "" {
+		return "", fmt.Errorf("no hostUUID in host identity file: %s", s.path)
+	}
+
+	return identity.HostUUID, nil
+}
+
+func (s *staticIdentity) Proof(nonce string) (http.Header, error) {
+	return nil, nil
+}
+
+// cloudIdentity uses the instance identity document the cloud provider
+// signs. The instance metadata service serves the document and its base64
+// encoded signature under url as document and signature. For a request the
+// document is asked for with the hostKeySha256 and nonce parameters, it then
+// names the host key and the challenge of the request. The host key is sent
+// along, the token server pins it to the instance.
+type cloudIdentity struct {
+	url            string
+	timeout        time.Duration
+	privateKeyFile string
+}
+
+func (c *cloudIdentity) Provider() string {
+	return server.IdentityCloud
+}
+
+func (c *cloudIdentity) HostUUID() (string, error) {
+	content, err := c.get("document", nil)
+	if err != nil {
+		return "", err
+	}
+
+	doc := &server.InstanceIdentityDocument{}
+	if err := json.Unmarshal(content, doc); err != nil {
+		return "", fmt.Errorf("invalid instance identity document: %s", err)
+	}
+	if doc.InstanceID == "" {
+		return "", fmt.Errorf("instance identity document has no instance ID")
+	}
+
+	return doc.InstanceID, nil
+}
+
+func (c *cloudIdentity) Proof(nonce string) (http.Header, error) {
+	publicKey, err := hostPublicKey(c.privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("hostKeySha256", server.HostKeyFingerprint(publicKey))
+	query.Set("nonce", nonce)
+
+	doc, err := c.get("document", query)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := c.get("signature", query)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set(server.IdentityDocumentHeader, base64.StdEncoding.EncodeToString(doc))
+	header.Set(server.IdentitySignatureHeader, strings.TrimSpace(string(sig)))
+	header.Set(server.HostPublicKeyHeader, base64.StdEncoding.EncodeToString(publicKey))
+	return header, nil
+}
+
+func (c *cloudIdentity) get(name string, query url.Values) ([]byte, error) {
+	getURL := strings.TrimSuffix(c.url, "/") + "/" + name
+	if len(query) > 0 {
+		getURL += "?" + query.Encode()
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+	resp, err := client.Get(getURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("instance identity %s request status was: %d", name, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// hostPublicKey is the PEM encoded public key of the host private key.
+func hostPublicKey(privateKeyFile string) ([]byte, error) {
+	key, err := hostKey.get(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/secrets-bridge-v2/server"
+)
+
+func TestStaticIdentity(t *testing.T) {
+	identityFile := path.Join(t.TempDir(), "host.json")
+	if err := ioutil.WriteFile(identityFile, []byte(`{"hostUUID": "static-host"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultDriverConfig()
+	cfg.HostIdentity = server.IdentityStatic
+	cfg.HostIdentityFile = identityFile
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if hostUUID, err := cfg.hostIdentity.HostUUID(); err != nil || hostUUID != "static-host" {
+		t.Errorf("expected static-host, got: %q %v", hostUUID, err)
+	}
+	if proof, err := cfg.hostIdentity.Proof("nonce"); err != nil || len(proof) != 0 {
+		t.Errorf("static identities need no proof, got: %v %v", proof, err)
+	}
+
+	cfg.HostIdentity = "unknown"
+	if err := cfg.validate(); err == nil {
+		t.Errorf("expected an unknown provider to be rejected")
+	}
+}
+
+// TestCloudIdentity runs the cloud identity against a stand-in for the
+// instance metadata service.
+func TestCloudIdentity(t *testing.T) {
+	providerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stand-in signs a document for the key and nonce it is asked for.
+	sign := func(r *http.Request) ([]byte, []byte) {
+		document, _ := json.Marshal(&server.InstanceIdentityDocument{
+			InstanceID:    "i-0123456789",
+			AccountID:     "1234",
+			Region:        "eu-west-1",
+			HostKeySHA256: r.URL.Query().Get("hostKeySha256"),
+			Nonce:         r.URL.Query().Get("nonce"),
+		})
+		hashed := sha256.Sum256(document)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, providerKey, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return document, sig
+	}
+
+	metadataService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/dynamic/instance-identity/document":
+			document, _ := sign(r)
+			w.Write(document)
+		case "/latest/dynamic/instance-identity/signature":
+			_, sig := sign(r)
+			w.Write([]byte(base64.StdEncoding.EncodeToString(sig) + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer metadataService.Close()
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(t.TempDir(), "host.key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(hostKey)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := &cloudIdentity{
+		url:            metadataService.URL + "/latest/dynamic/instance-identity",
+		timeout:        time.Second,
+		privateKeyFile: keyFile,
+	}
+
+	if hostUUID, err := identity.HostUUID(); err != nil || hostUUID != "i-0123456789" {
+		t.Fatalf("expected the instance ID, got: %q %v", hostUUID, err)
+	}
+
+	proof, err := identity.Proof("challenge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, _ := base64.StdEncoding.DecodeString(proof.Get(server.HostPublicKeyHeader))
+	if !strings.HasPrefix(string(publicKey), "-----BEGIN PUBLIC KEY-----") {
+		t.Errorf("expected a PEM public key, got: %s", publicKey)
+	}
+
+	// The document names the host key and the nonce, and the signature is
+	// the one of that document.
+	content, _ := base64.StdEncoding.DecodeString(proof.Get(server.IdentityDocumentHeader))
+	doc := &server.InstanceIdentityDocument{}
+	if err := json.Unmarshal(content, doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Nonce != "challenge-1" || doc.HostKeySHA256 != server.HostKeyFingerprint(publicKey) {
+		t.Errorf("expected the document to be bound to the key and nonce, got: %#v", doc)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(proof.Get(server.IdentitySignatureHeader))
+	hashed := sha256.Sum256(content)
+	if err := rsa.VerifyPKCS1v15(&providerKey.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Errorf("unexpected signature: %s", err)
+	}
+
+	identity.url = metadataService.URL + "/missing"
+	if _, err := identity.HostUUID(); err == nil {
+		t.Errorf("expected an error when the metadata service has no document")
+	}
+}
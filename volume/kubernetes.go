@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	flexvol "github.com/rancher/rancher-flexvol"
+	"github.com/urfave/cli"
+)
+
+// Options kubelet adds to every FlexVolume call.
+const (
+	kubePodName        = "kubernetes.io/pod.name"
+	kubePodNamespace   = "kubernetes.io/pod.namespace"
+	kubeServiceAccount = "kubernetes.io/serviceAccount.name"
+)
+
+// kubeOutput is the Kubernetes FlexVolume driver response, a superset of the
+// Rancher one.
+type kubeOutput struct {
+	Status       string            `json:"status"`
+	Message      string            `json:"message,omitempty"`
+	Device       string            `json:"device,omitempty"`
+	VolumeName   string            `json:"volumeName,omitempty"`
+	Attached     *bool             `json:"attached,omitempty"`
+	Capabilities *kubeCapabilities `json:"capabilities,omitempty"`
+}
+
+type kubeCapabilities struct {
+	Attach bool `json:"attach"`
+}
+
+func (o *kubeOutput) Print() {
+	b, _ := json.Marshal(o)
+	fmt.Printf("%s\n", string(b))
+}
+
+// KubernetesCommand speaks the Kubernetes FlexVolume protocol. Kubelet runs
+// the driver file directly, so it is installed as a wrapper running
+// `secrets-bridge-v2 kubernetes "$@"`.
+func KubernetesCommand(backend flexBackend) cli.Command {
+	driver := &kubeDriver{backend: backend}
+
+	return cli.Command{
+		Name:  "kubernetes",
+		Usage: "Kubernetes FlexVolume driver",
+		Subcommands: []cli.Command{
+			kubeCommand("init", 0, driver.init),
+			kubeCommand("getvolumename", 1, driver.getVolumeName),
+			kubeCommand("attach", 1, driver.attach),
+			kubeCommand("detach", 1, driver.detach),
+			kubeCommand("isattached", 1, driver.isAttached),
+			kubeCommand("waitforattach", 1, driver.waitForAttach),
+			kubeCommand("mountdevice", 1, driver.mountDevice),
+			kubeCommand("unmountdevice", 1, driver.unmountDevice),
+			kubeCommand("mount", 2, driver.mount),
+			kubeCommand("unmount", 1, driver.unmount),
+		},
+	}
+}
+
+func kubeCommand(name string, args int, action func([]string) (*kubeOutput, error)) cli.Command {
+	return cli.Command{
+		Name: name,
+		Action: func(c *cli.Context) error {
+			if len(c.Args()) < args {
+				return printKubeError(flexvol.ErrIncorrectArgNumber)
+			}
+
+			output, err := action(c.Args())
+			if err != nil {
+				return printKubeError(err)
+			}
+
+			output.Print()
+			return nil
+		},
+	}
+}
+
+func printKubeError(err error) error {
+	output := &kubeOutput{Status: flexvol.StatusFailure, Message: err.Error()}
+	if err == flexvol.ErrNotSupported {
+		output.Status = flexvol.StatusNotSupported
+	}
+	output.Print()
+	return err
+}
+
+// kubeDriver maps the Kubernetes calls onto the flexvol driver. Tokens are
+// issued per pod, so there is nothing to attach to a node ahead of the pod
+// mount and the attach calls are not supported.
+type kubeDriver struct {
+	backend flexBackend
+}
+
+func (k *kubeDriver) init(args []string) (*kubeOutput, error) {
+	if err := k.backend.Init(); err != nil {
+		return nil, err
+	}
+
+	return &kubeOutput{
+		Status:       flexvol.StatusSuccess,
+		Capabilities: &kubeCapabilities{Attach: false},
+	}, nil
+}
+
+// getVolumeName is not supported, every pod mount needs its own volume.
+func (k *kubeDriver) getVolumeName(args []string) (*kubeOutput, error) {
+	return nil, flexvol.ErrNotSupported
+}
+
+func (k *kubeDriver) attach(args []string) (*kubeOutput, error) {
+	return nil, flexvol.ErrNotSupported
+}
+
+func (k *kubeDriver) detach(args []string) (*kubeOutput, error) {
+	return nil, flexvol.ErrNotSupported
+}
+
+func (k *kubeDriver) isAttached(args []string) (*kubeOutput, error) {
+	attached := true
+	return &kubeOutput{Status: flexvol.StatusSuccess, Attached: &attached}, nil
+}
+
+func (k *kubeDriver) waitForAttach(args []string) (*kubeOutput, error) {
+	return &kubeOutput{Status: flexvol.StatusSuccess, Device: args[0]}, nil
+}
+
+func (k *kubeDriver) mountDevice(args []string) (*kubeOutput, error) {
+	return nil, flexvol.ErrNotSupported
+}
+
+func (k *kubeDriver) unmountDevice(args []string) (*kubeOutput, error) {
+	return nil, flexvol.ErrNotSupported
+}
+
+// mount attaches a new volume for the pod and bind mounts it to dir.
+func (k *kubeDriver) mount(args []string) (*kubeOutput, error) {
+	dir := args[0]
+
+	options := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(args[1]), &options); err != nil {
+		return nil, err
+	}
+
+	name, err := kubeVolumeName(dir)
+	if err != nil {
+		return nil, err
+	}
+	options["name"] = name
+
+	created, err := k.backend.Create(options)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := k.backend.Attach(created)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		k.backend.Detach(device)
+		return nil, err
+	}
+
+	if err := k.backend.Mount(dir, device, options); err != nil {
+		logrus.Errorf("failed to mount: %s got: %s. calling detach.", dir, err)
+		k.backend.Detach(device)
+		return nil, err
+	}
+
+	return &kubeOutput{Status: flexvol.StatusSuccess}, nil
+}
+
+// unmount revokes the pod volume and removes its backing tmpfs.
+func (k *kubeDriver) unmount(args []string) (*kubeOutput, error) {
+	dir := args[0]
+
+	name, err := kubeVolumeName(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.backend.Unmount(dir); err != nil {
+		return nil, err
+	}
+
+	removeVolume(path.Join(config.VolumeRoot, name))
+
+	return &kubeOutput{Status: flexvol.StatusSuccess}, nil
+}
+
+// kubeVolumeName names the volume after the pod UID and volume name in the
+// kubelet mount directory, .../pods/<uid>/volumes/<driver>/<volume>, so
+// unmount, which is only given the directory, finds it again.
+func kubeVolumeName(dir string) (string, error) {
+	parts := strings.Split(path.Clean(dir), "/")
+	if len(parts) < 5 || parts[len(parts)-3] != "volumes" {
+		return "", fmt.Errorf("unexpected kubelet mount directory: %s", dir)
+	}
+
+	return fmt.Sprintf("%s_%s", parts[len(parts)-4], parts[len(parts)-1]), nil
+}
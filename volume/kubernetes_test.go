@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestKubeVolumeName(t *testing.T) {
+	name, err := kubeVolumeName("/var/lib/kubelet/pods/1234-abcd/volumes/rancher~secrets-bridge-v2/vault/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "1234-abcd_vault" {
+		t.Errorf("unexpected volume name: %s", name)
+	}
+
+	if _, err := kubeVolumeName("/mnt/vault"); err == nil {
+		t.Errorf("expected error for a directory outside of kubelet")
+	}
+}
+
+func TestKubeMount(t *testing.T) {
+	backend := &fakeBackend{}
+	driver := &kubeDriver{backend: backend}
+
+	dir := path.Join(t.TempDir(), "pods/1234/volumes/rancher~secrets-bridge-v2/vault")
+	output, err := driver.mount([]string{dir, `{"policies": "app", "kubernetes.io/pod.name": "web-0"}`})
+	if err != nil {
+		t.Fatalf("mount failed: %s", err)
+	}
+
+	if output.Status != "Success" || backend.attached != 1 {
+		t.Errorf("unexpected mount result: %#v attached: %d", output, backend.attached)
+	}
+
+	if _, err := driver.attach(nil); err == nil {
+		t.Errorf("expected attach to be unsupported")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/moby/moby/pkg/mount"
+)
+
+const lockRetryInterval = 50 * time.Millisecond
+
+var errLockTimeout = fmt.Errorf("timed out waiting for lock")
+
+// lockVolume serializes the driver operations on the volume at volPath
+// across driver processes and agent requests, waiting at most the configured
+// lock timeout. The lock files live next to the state store, the volume
+// directory comes and goes with its tmpfs.
+func lockVolume(volPath string) (func(), error) {
+	return lockVolumeTimeout(volPath, config.lockTimeout)
+}
+
+func lockVolumeTimeout(volPath string, timeout time.Duration) (func(), error) {
+	name := path.Join(path.Dir(volumeStore.path), "locks", path.Base(volPath)+".lock")
+	unlock, err := tryLockFile(name, timeout)
+	if err == errLockTimeout {
+		return nil, fmt.Errorf("timed out waiting for another operation on volume: %s", volPath)
+	}
+	return unlock, err
+}
+
+// tryLockFile takes an exclusive flock on name, giving up after timeout.
+func tryLockFile(name string, timeout time.Duration) (func(), error) {
+	if err := os.MkdirAll(path.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, errLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// mountedVolume returns the volume bind mounted at dir, found by the device
+// number the bind mount shares with the tmpfs of the volume. Empty if there
+// is none.
+func mountedVolume(dir string) string {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return ""
+	}
+
+	return findMountedVolume(mounts, dir)
+}
+
+func findMountedVolume(mounts []*mount.Info, dir string) string {
+	var target *mount.Info
+	for _, m := range mounts {
+		if m.Mountpoint == dir {
+			target = m
+		}
+	}
+	if target == nil {
+		return ""
+	}
+
+	for _, m := range mounts {
+		if isVolumeFstype(m.Fstype) && path.Dir(m.Mountpoint) == config.VolumeRoot && m.Major == target.Major && m.Minor == target.Minor {
+			return m.Mountpoint
+		}
+	}
+	return ""
+}
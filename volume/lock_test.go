@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/pkg/mount"
+)
+
+func TestLockVolume(t *testing.T) {
+	volPath := path.Join(config.VolumeRoot, "locked")
+
+	unlock, err := lockVolume(volPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lockVolumeTimeout(volPath, 100*time.Millisecond); err == nil {
+		t.Fatalf("expected a second lock on the volume to time out")
+	}
+
+	other, err := lockVolumeTimeout(path.Join(config.VolumeRoot, "other"), 0)
+	if err != nil {
+		t.Fatalf("volumes must be locked independently: %s", err)
+	}
+	other()
+
+	acquired := make(chan error)
+	go func() {
+		unlock, err := lockVolumeTimeout(volPath, 5*time.Second)
+		if err == nil {
+			unlock()
+		}
+		acquired <- err
+	}()
+
+	time.Sleep(2 * lockRetryInterval)
+	unlock()
+
+	if err := <-acquired; err != nil {
+		t.Errorf("expected the waiting operation to get the lock: %s", err)
+	}
+}
+
+func TestHealthyDevice(t *testing.T) {
+	volPath := path.Join(t.TempDir(), "volume")
+
+	for _, record := range []*volumeRecord{
+		nil,
+		{Path: volPath, State: volumeAttached},
+		{Path: volPath, State: volumeDetached, Accessor: "abc"},
+		// Attached but the tmpfs is gone.
+		{Path: volPath, State: volumeMounted, Accessor: "abc"},
+	} {
+		if device := healthyDevice(volPath, record); device != "" {
+			t.Errorf("expected the volume to be attached again: %#v", record)
+		}
+	}
+}
+
+func TestFindMountedVolume(t *testing.T) {
+	tmpfsVolume := path.Join(config.VolumeRoot, "tmpfs-volume")
+	ramfsVolume := path.Join(config.VolumeRoot, "ramfs-volume")
+
+	mounts := []*mount.Info{
+		{Mountpoint: tmpfsVolume, Fstype: "tmpfs", Major: 0, Minor: 50},
+		{Mountpoint: ramfsVolume, Fstype: "ramfs", Major: 0, Minor: 51},
+		{Mountpoint: "/var/lib/docker", Fstype: "ext4", Major: 8, Minor: 1},
+		{Mountpoint: "/pods/tmpfs", Fstype: "tmpfs", Major: 0, Minor: 50},
+		{Mountpoint: "/pods/ramfs", Fstype: "ramfs", Major: 0, Minor: 51},
+		{Mountpoint: "/pods/disk", Fstype: "ext4", Major: 8, Minor: 1},
+	}
+
+	for dir, expected := range map[string]string{
+		"/pods/tmpfs": tmpfsVolume,
+		"/pods/ramfs": ramfsVolume,
+		"/pods/disk":  "",
+		"/pods/gone":  "",
+	} {
+		if volume := findMountedVolume(mounts, dir); volume != expected {
+			t.Errorf("%s: expected: %q got: %q", dir, expected, volume)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/secrets-bridge-v2/keystore"
+)
+
+const (
+	defaultPKIMount = "pki"
+	// insecureBundlePassword is the well known default password of Java
+	// keystores, bundles protected by it are refused.
+	insecureBundlePassword = "changeit"
+)
+
+// pkiSpec is the PKI role to issue the volume certificate from.
+type pkiSpec struct {
+	mount          string
+	role           string
+	commonName     string
+	service        string
+	altNames       []string
+	ipSANs         []string
+	ttl            string
+	bundles        []string
+	bundlePassword string
+	// keyMode is the mode of key.pem and the bundles, private to the volume
+	// uid unless pkiKeyMode says otherwise.
+	keyMode os.FileMode
+}
+
+// certificateCreds is an issued certificate. It is kept in the volume state
+// so the renew daemon knows when to issue a new one. The private key is only
+// known right after issuing, it is never recorded.
+type certificateCreds struct {
+	Mount        string    `json:"mount"`
+	SerialNumber string    `json:"serialNumber"`
+	Certificate  string    `json:"certificate"`
+	PrivateKey   string    `json:"-"`
+	CAChain      []string  `json:"caChain"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+// getPKISpec parses the pki* driver options.
+func getPKISpec(options map[string]interface{}) (*pkiSpec, error) {
+	role, _ := options["pkiRole"].(string)
+	if role == "" {
+		return nil, nil
+	}
+
+	spec := &pkiSpec{
+		mount: defaultPKIMount,
+		role:  role,
+	}
+
+	if mount, ok := options["pkiMount"].(string); ok && mount != "" {
+		spec.mount = strings.Trim(mount, "/")
+	}
+	spec.commonName, _ = options["pkiCommonName"].(string)
+	spec.service, _ = options["pkiService"].(string)
+	spec.ttl, _ = options["pkiTTL"].(string)
+	spec.altNames = splitOption(options, "pkiAltNames")
+	spec.ipSANs = splitOption(options, "pkiIPSans")
+	spec.bundles = splitOption(options, "pkiBundles")
+
+	spec.bundlePassword, _ = options["pkiBundlePassword"].(string)
+
+	var err error
+	if spec.keyMode, err = getModeOption(options, "pkiKeyMode", privateMode); err != nil {
+		return spec, err
+	}
+
+	if strings.Contains(spec.role, "/") || spec.mount == "" {
+		return spec, fmt.Errorf("invalid pki role: %s", path.Join(spec.mount, "issue", spec.role))
+	}
+
+	if spec.ttl != "" {
+		if _, err := time.ParseDuration(spec.ttl); err != nil {
+			return spec, fmt.Errorf("invalid pkiTTL: %s", err)
+		}
+	}
+
+	for _, bundle := range spec.bundles {
+		if bundle != "pkcs12" && bundle != "jks" {
+			return spec, fmt.Errorf("unknown pki bundle: %s, must be pkcs12 or jks", bundle)
+		}
+	}
+
+	if len(spec.bundles) > 0 && spec.bundlePassword == "" {
+		return spec, fmt.Errorf("pkiBundlePassword is required for pki bundles")
+	}
+	if spec.bundlePassword == insecureBundlePassword {
+		return spec, fmt.Errorf("pkiBundlePassword can not be the well known default: %s", insecureBundlePassword)
+	}
+
+	return spec, nil
+}
+
+func (p *pkiSpec) fileNames() []string {
+	files := []string{"cert.pem", "key.pem", "ca.pem"}
+	for _, bundle := range p.bundles {
+		files = append(files, bundleFileName(bundle))
+	}
+	return files
+}
+
+// issue requests a new certificate for the volume.
+func (p *pkiSpec) issue(vClient *api.Client, volumeName string) (*certificateCreds, error) {
+	commonName, altNames, ipSANs, err := p.identity(volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	issuePath := path.Join(p.mount, "issue", p.role)
+	logrus.Debugf("issuing certificate for: %s from: %s", commonName, issuePath)
+
+	data := map[string]interface{}{
+		"common_name": commonName,
+		"alt_names":   strings.Join(altNames, ","),
+		"ip_sans":     strings.Join(ipSANs, ","),
+		"format":      "pem",
+	}
+	if p.ttl != "" {
+		data["ttl"] = p.ttl
+	}
+
+	secret, err := vClient.Logical().Write(issuePath, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no certificate returned from: %s", issuePath)
+	}
+
+	creds := &certificateCreds{
+		Mount: p.mount,
+	}
+	creds.SerialNumber, _ = secret.Data["serial_number"].(string)
+	creds.Certificate, _ = secret.Data["certificate"].(string)
+	creds.PrivateKey, _ = secret.Data["private_key"].(string)
+
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok && len(chain) > 0 {
+		for _, ca := range chain {
+			if caString, ok := ca.(string); ok {
+				creds.CAChain = append(creds.CAChain, caString)
+			}
+		}
+	} else if issuingCA, ok := secret.Data["issuing_ca"].(string); ok {
+		creds.CAChain = []string{issuingCA}
+	}
+
+	cert, err := parseCertificate(creds.Certificate)
+	if err != nil {
+		return creds, err
+	}
+	creds.NotBefore = cert.NotBefore
+	creds.NotAfter = cert.NotAfter
+
+	return creds, nil
+}
+
+// identity returns the common name and SANs for the certificate. Unless
+// pkiCommonName is set they are derived from the Rancher metadata of the
+// service the volume belongs to. Per container volumes are named after their
+// stack, <stack>_<volume>_..., and the service is the one in that stack with
+// containers on this host, or pkiService if several match.
+func (p *pkiSpec) identity(volumeName string) (string, []string, []string, error) {
+	if p.commonName != "" {
+		return p.commonName, p.altNames, p.ipSANs, nil
+	}
+
+	client, err := hostMetadata.metadataClient(config.MetadataURL)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	host, err := client.GetSelfHost()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	containers, err := client.GetContainers()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	stack := strings.SplitN(volumeName, "_", 2)[0]
+
+	services := map[string][]metadata.Container{}
+	for _, container := range containers {
+		if container.HostUUID != host.UUID || container.StackName != stack || container.ServiceName == "" {
+			continue
+		}
+		if p.service != "" && container.ServiceName != p.service {
+			continue
+		}
+		services[container.ServiceName] = append(services[container.ServiceName], container)
+	}
+
+	if len(services) != 1 {
+		return "", nil, nil, fmt.Errorf("could not determine the service of volume: %s, set pkiService or pkiCommonName", volumeName)
+	}
+
+	var service string
+	for name := range services {
+		service = name
+	}
+
+	commonName := fmt.Sprintf("%s.%s.rancher.internal", service, stack)
+	altNames := []string{fmt.Sprintf("%s.%s", service, stack), service}
+	ipSANs := []string{}
+	for _, container := range services[service] {
+		altNames = append(altNames, container.Name)
+		if container.PrimaryIp != "" {
+			ipSANs = append(ipSANs, container.PrimaryIp)
+		}
+	}
+
+	return commonName, append(altNames, p.altNames...), append(ipSANs, p.ipSANs...), nil
+}
+
+// files returns the PEM files and requested bundles.
+func (p *pkiSpec) files(creds *certificateCreds) ([]*volumeFile, error) {
+	files := []*volumeFile{
+		{name: "cert.pem", content: []byte(creds.Certificate + "\n")},
+		{name: "key.pem", content: []byte(creds.PrivateKey + "\n"), mode: p.keyMode},
+		{name: "ca.pem", content: []byte(strings.Join(creds.CAChain, "\n") + "\n")},
+	}
+
+	if len(p.bundles) == 0 {
+		return files, nil
+	}
+
+	key, err := parsePrivateKey(creds.PrivateKey)
+	if err != nil {
+		return files, err
+	}
+
+	cert, err := parseCertificate(creds.Certificate)
+	if err != nil {
+		return files, err
+	}
+
+	caCerts := []*x509.Certificate{}
+	for _, ca := range creds.CAChain {
+		caCert, err := parseCertificate(ca)
+		if err != nil {
+			return files, err
+		}
+		caCerts = append(caCerts, caCert)
+	}
+
+	for _, bundle := range p.bundles {
+		var content []byte
+		switch bundle {
+		case "pkcs12":
+			content, err = keystore.EncodePKCS12(key, cert, caCerts, p.bundlePassword)
+		case "jks":
+			content, err = keystore.EncodeJKS(key, cert, caCerts, "vault", p.bundlePassword)
+		}
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, &volumeFile{name: bundleFileName(bundle), content: content, mode: p.keyMode})
+	}
+
+	return files, nil
+}
+
+// renewAt is when the renew daemon issues a new certificate, two thirds
+// into its lifetime.
+func (c *certificateCreds) renewAt() time.Time {
+	return c.NotBefore.Add(c.NotAfter.Sub(c.NotBefore) * 2 / 3)
+}
+
+// id identifies the certificate for revocation, <mount>/<serial number>.
+func (c *certificateCreds) id() string {
+	return path.Join(c.Mount, c.SerialNumber)
+}
+
+func bundleFileName(bundle string) string {
+	if bundle == "jks" {
+		return "keystore.jks"
+	}
+	return "keystore.p12"
+}
+
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(keyPEM string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
+
+// splitOption splits a comma separated driver option.
+func splitOption(options map[string]interface{}, key string) []string {
+	values := []string{}
+
+	value, _ := options[key].(string)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
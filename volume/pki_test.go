@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// newTestCertificate returns a self signed PEM certificate and its key.
+func newTestCertificate(t *testing.T, serial int64, notBefore time.Time, lifetime time.Duration) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "web.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestPKIIssue(t *testing.T) {
+	notBefore := time.Now().Truncate(time.Second)
+	certPEM, keyPEM := newTestCertificate(t, 10, notBefore, 3*time.Hour)
+
+	var request map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/pki_int/issue/web" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&request)
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"serial_number": "0a",
+				"certificate":   certPEM,
+				"private_key":   keyPEM,
+				"ca_chain":      []string{certPEM},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	vClient, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := getPKISpec(map[string]interface{}{
+		"pkiRole":           "web",
+		"pkiMount":          "/pki_int/",
+		"pkiCommonName":     "web.example.com",
+		"pkiAltNames":       "web, www.example.com",
+		"pkiBundles":        "pkcs12,jks",
+		"pkiBundlePassword": "s3cret",
+	})
+	if err != nil {
+		t.Fatalf("failed to parse options: %s", err)
+	}
+
+	creds, err := spec.issue(vClient, "stack_volume")
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %s", err)
+	}
+
+	if request["common_name"] != "web.example.com" || request["alt_names"] != "web,www.example.com" {
+		t.Errorf("unexpected issue request: %v", request)
+	}
+
+	if creds.id() != "pki_int/0a" {
+		t.Errorf("unexpected certificate id: %s", creds.id())
+	}
+
+	if expected := notBefore.Add(2 * time.Hour); !creds.renewAt().Equal(expected) {
+		t.Errorf("expected renewal at: %s got: %s", expected, creds.renewAt())
+	}
+
+	files, err := spec.files(creds)
+	if err != nil {
+		t.Fatalf("failed to build files: %s", err)
+	}
+
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.name)
+	}
+	if len(names) != 5 || names[3] != "keystore.p12" || names[4] != "keystore.jks" {
+		t.Errorf("unexpected files: %v", names)
+	}
+
+	for _, file := range files {
+		private := file.name != "cert.pem" && file.name != "ca.pem"
+		if private && file.mode != privateMode || !private && file.mode != 0 {
+			t.Errorf("unexpected mode of: %s: %s", file.name, file.mode)
+		}
+	}
+}
+
+func TestPKISpecValidation(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"pkiRole": "a/b"},
+		{"pkiRole": "web", "pkiTTL": "forever"},
+		{"pkiRole": "web", "pkiBundles": "pem"},
+		{"pkiRole": "web", "pkiBundles": "jks"},
+		{"pkiRole": "web", "pkiBundles": "jks", "pkiBundlePassword": "changeit"},
+		{"pkiRole": "web", "pkiKeyMode": "0999"},
+	} {
+		if _, err := getPKISpec(options); err == nil {
+			t.Errorf("expected options: %v to be rejected", options)
+		}
+	}
+
+	if spec, err := getPKISpec(map[string]interface{}{}); spec != nil || err != nil {
+		t.Errorf("expected no spec without pkiRole")
+	}
+}
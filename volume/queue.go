@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultRevocationQueue = "/var/lib/rancher/secrets-bridge-v2/revocations.json"
+
+	revocationRetryBase = 30 * time.Second
+	revocationRetryMax  = time.Hour
+)
+
+// Kinds of secrets the token server revokes.
+const (
+	revokeToken       = "token"
+	revokeLease       = "lease"
+	revokeCertificate = "certificate"
+)
+
+var revocationQueue = newRevocationStore(getRevocationQueuePath())
+
+// revocation is a secret that still has to be revoked.
+type revocation struct {
+	Kind string `json:"kind"`
+	// ID is the token accessor, the lease ID or <mount>/<serial number> of a
+	// certificate.
+	ID          string    `json:"id"`
+	Attempts    int       `json:"attempts"`
+	Added       time.Time `json:"added"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// revocationStore persists revocations that failed so a later driver call or
+// the renew daemon can retry them. Like the state store it is a JSON file
+// shared by every driver process.
+type revocationStore struct {
+	path   string
+	revoke func(r *revocation) error
+}
+
+func newRevocationStore(path string) *revocationStore {
+	return &revocationStore{
+		path:   path,
+		revoke: sendRevocation,
+	}
+}
+
+func getRevocationQueuePath() string {
+	if envPath := os.Getenv("VAULT_DRIVER_REVOCATION_QUEUE"); envPath != "" {
+		return envPath
+	}
+	return defaultRevocationQueue
+}
+
+// RevocationsCommand shows and retries the queued revocations.
+func RevocationsCommand() cli.Command {
+	return cli.Command{
+		Name:  "revocations",
+		Usage: "Manage revocations waiting to be retried",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the pending revocations",
+				Action: listRevocations,
+			},
+			{
+				Name:   "retry",
+				Usage:  "Retry every pending revocation now",
+				Action: retryRevocations,
+			},
+		},
+	}
+}
+
+func listRevocations(c *cli.Context) error {
+	pending, err := revocationQueue.list()
+	if err != nil {
+		return err
+	}
+
+	printRevocations(os.Stdout, pending)
+	return nil
+}
+
+func retryRevocations(c *cli.Context) error {
+	if _, err := revocationQueue.retry(time.Now(), true); err != nil {
+		return err
+	}
+	return listRevocations(c)
+}
+
+// retryDueRevocations is run by driver calls, a failure must not fail the
+// call.
+func retryDueRevocations() {
+	pending, err := revocationQueue.retry(time.Now(), false)
+	if err != nil {
+		logrus.Errorf("failed to retry revocations: %s", err)
+		return
+	}
+	if pending > 0 {
+		logrus.Infof("revocations pending: %d", pending)
+	}
+}
+
+// add queues the revocations, a secret already in the queue keeps its
+// schedule.
+func (q *revocationStore) add(revocations []*revocation, now time.Time) error {
+	if len(revocations) == 0 {
+		return nil
+	}
+
+	return q.update(func(pending []*revocation) ([]*revocation, error) {
+		for _, r := range revocations {
+			if findRevocation(pending, r) != nil {
+				continue
+			}
+
+			queued := *r
+			queued.Attempts = 1
+			queued.Added = now
+			queued.NextAttempt = now.Add(revocationBackoff(1))
+			pending = append(pending, &queued)
+		}
+		return pending, nil
+	})
+}
+
+func (q *revocationStore) list() ([]*revocation, error) {
+	var pending []*revocation
+	err := q.view(func(queued []*revocation) error {
+		pending = queued
+		return nil
+	})
+	return pending, err
+}
+
+// retry revokes the queued secrets that are due, or all of them if force is
+// set, and returns how many are still pending. The requests are made without
+// holding the lock, revoking a secret twice is harmless.
+func (q *revocationStore) retry(now time.Time, force bool) (int, error) {
+	queued, err := q.list()
+	if err != nil {
+		return 0, err
+	}
+
+	done := []*revocation{}
+	failed := map[*revocation]error{}
+	for _, r := range queued {
+		if !force && now.Before(r.NextAttempt) {
+			continue
+		}
+
+		if err := q.revoke(r); err != nil {
+			logrus.Errorf("failed to revoke %s: %s got: %s", r.Kind, r.ID, err)
+			failed[r] = err
+			continue
+		}
+		done = append(done, r)
+	}
+
+	if len(done) == 0 && len(failed) == 0 {
+		return len(queued), nil
+	}
+
+	remaining := 0
+	err = q.update(func(pending []*revocation) ([]*revocation, error) {
+		kept := []*revocation{}
+		for _, r := range pending {
+			if findRevocation(done, r) != nil {
+				continue
+			}
+
+			for attempted, err := range failed {
+				if attempted.Kind == r.Kind && attempted.ID == r.ID {
+					r.Attempts++
+					r.NextAttempt = now.Add(revocationBackoff(r.Attempts))
+					r.LastError = err.Error()
+				}
+			}
+			kept = append(kept, r)
+		}
+
+		remaining = len(kept)
+		return kept, nil
+	})
+	return remaining, err
+}
+
+func (q *revocationStore) view(fn func(pending []*revocation) error) error {
+	unlock, err := lockFile(q.path+".lock", syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := q.read()
+	if err != nil {
+		return err
+	}
+
+	return fn(pending)
+}
+
+func (q *revocationStore) update(fn func(pending []*revocation) ([]*revocation, error)) error {
+	unlock, err := lockFile(q.path+".lock", syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := q.read()
+	if err != nil {
+		return err
+	}
+
+	if pending, err = fn(pending); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(q.path, content)
+}
+
+func (q *revocationStore) read() ([]*revocation, error) {
+	pending := []*revocation{}
+
+	content, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &pending); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+func findRevocation(revocations []*revocation, r *revocation) *revocation {
+	for _, queued := range revocations {
+		if queued.Kind == r.Kind && queued.ID == r.ID {
+			return queued
+		}
+	}
+	return nil
+}
+
+// revocationBackoff doubles the wait after every failed attempt.
+func revocationBackoff(attempts int) time.Duration {
+	wait := revocationRetryBase
+	for i := 1; i < attempts && wait < revocationRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > revocationRetryMax {
+		wait = revocationRetryMax
+	}
+	return wait
+}
+
+// sendRevocation asks the token server to revoke the secret.
+func sendRevocation(r *revocation) error {
+	switch r.Kind {
+	case revokeToken:
+		return makeTokenRevokeRequest(r.ID)
+	case revokeLease:
+		return makeLeaseRevokeRequest(r.ID)
+	case revokeCertificate:
+		i := strings.LastIndex(r.ID, "/")
+		if i < 0 {
+			logrus.Errorf("skipping invalid certificate: %s", r.ID)
+			return nil
+		}
+		return makeCertificateRevokeRequest(r.ID[:i], r.ID[i+1:])
+	}
+	return fmt.Errorf("unknown revocation kind: %s", r.Kind)
+}
+
+func printRevocations(out io.Writer, pending []*revocation) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	for _, r := range pending {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Kind, r.ID, r.Attempts, r.NextAttempt.Format(time.RFC3339), r.LastError)
+	}
+	w.Flush()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRevocationQueue(t *testing.T) {
+	queue := newRevocationStore(path.Join(t.TempDir(), "revocations.json"))
+
+	failing := map[string]bool{"token-1": true, "lease-1": true}
+	queue.revoke = func(r *revocation) error {
+		if failing[r.ID] {
+			return fmt.Errorf("token server unavailable")
+		}
+		return nil
+	}
+
+	now := time.Now()
+	if err := queue.add([]*revocation{
+		{Kind: revokeToken, ID: "token-1"},
+		{Kind: revokeLease, ID: "lease-1"},
+		{Kind: revokeToken, ID: "token-1"},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := queue.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending revocations, got: %d", len(pending))
+	}
+
+	// Nothing is due before the first backoff passed.
+	remaining, err := queue.retry(now, false)
+	if err != nil || remaining != 2 {
+		t.Fatalf("expected 2 remaining, got: %d %v", remaining, err)
+	}
+
+	delete(failing, "lease-1")
+	later := now.Add(revocationRetryBase)
+	if remaining, err = queue.retry(later, false); err != nil || remaining != 1 {
+		t.Fatalf("expected 1 remaining, got: %d %v", remaining, err)
+	}
+
+	pending, err = queue.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := pending[0]
+	if r.ID != "token-1" || r.Attempts != 2 || r.LastError == "" {
+		t.Errorf("unexpected revocation: %#v", r)
+	}
+	if !r.NextAttempt.Equal(later.Add(2 * revocationRetryBase)) {
+		t.Errorf("expected backoff to double, next attempt: %s", r.NextAttempt)
+	}
+
+	delete(failing, "token-1")
+	if remaining, err = queue.retry(now, true); err != nil || remaining != 0 {
+		t.Fatalf("expected forced retry to drain the queue, got: %d %v", remaining, err)
+	}
+}
+
+func TestRevocationBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:   revocationRetryBase,
+		2:   2 * revocationRetryBase,
+		3:   4 * revocationRetryBase,
+		100: revocationRetryMax,
+	} {
+		if wait := revocationBackoff(attempts); wait != expected {
+			t.Errorf("attempt %d: expected: %s got: %s", attempts, expected, wait)
+		}
+	}
+}
+
+func TestVolumeSecretsRevokeQueuesFailures(t *testing.T) {
+	saved := revocationQueue
+	revocationQueue = newRevocationStore(path.Join(t.TempDir(), "revocations.json"))
+	defer func() { revocationQueue = saved }()
+
+	revoked := []string{}
+	revocationQueue.revoke = func(r *revocation) error {
+		if r.Kind == revokeToken {
+			return fmt.Errorf("token server unavailable")
+		}
+		revoked = append(revoked, r.ID)
+		return nil
+	}
+
+	secrets := &volumeSecrets{accessor: "accessor", leases: []string{"lease", ""}, certificates: []string{"pki/01"}}
+	if err := secrets.revoke(); err != nil {
+		t.Fatalf("failed revocations must not fail teardown: %s", err)
+	}
+
+	if len(revoked) != 2 || revoked[0] != "lease" || revoked[1] != "pki/01" {
+		t.Errorf("unexpected revocations: %v", revoked)
+	}
+
+	pending, err := revocationQueue.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Kind != revokeToken || pending[0].ID != "accessor" {
+		t.Errorf("expected the token to be queued, got: %#v", pending)
+	}
+}
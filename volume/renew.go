@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+	"github.com/rancher/secrets-bridge-v2/server"
+	"github.com/urfave/cli"
+)
+
+const renewErrorFile = ".renew-error"
+
+var errNotRenewable = fmt.Errorf("volume does not hold a renewable token")
+
+// volumeState is recorded in the renewal dir of the state store during
+// attach so the renew daemon knows how to refresh the volume. It is only
+// recorded for unwrapped client tokens, wrapping tokens can not be renewed.
+// It never goes into the volume, the workload could change it there, nor
+// into the state file on disk, it holds the token and database password.
+type volumeState struct {
+	// Token is the client token, the sinks may not have written it to a
+	// well known file.
+	Token string `json:"token"`
+	// Options are the driver options needed to render the content again.
+	Options     map[string]interface{} `json:"options,omitempty"`
+	Database    *databaseCreds         `json:"database,omitempty"`
+	Certificate *certificateCreds      `json:"certificate,omitempty"`
+}
+
+// renewal tracks the schedule of a single volume in the renew daemon.
+type renewal struct {
+	next   time.Time
+	failed bool
+	// attached is when the volume was attached, it changes when the volume
+	// is attached again.
+	attached time.Time
+}
+
+type renewer struct {
+	root     string
+	fraction float64
+	volumes  map[string]*renewal
+}
+
+// RenewCommand runs the host side token renewal daemon.
+func RenewCommand() cli.Command {
+	return cli.Command{
+		Name:   "renew",
+		Usage:  "Renew tokens and refresh secrets of mounted volumes",
+		Action: renewVolumes,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "interval",
+				Usage: "how often to scan for volumes",
+				Value: 30 * time.Second,
+			},
+			cli.Float64Flag{
+				Name:  "fraction",
+				Usage: "fraction of the token TTL to wait before renewing",
+				Value: 0.5,
+			},
+		},
+	}
+}
+
+func renewVolumes(c *cli.Context) error {
+	fraction := c.Float64("fraction")
+	if fraction <= 0 || fraction >= 1 {
+		return fmt.Errorf("fraction must be between 0 and 1")
+	}
+
+	r := &renewer{
+		root:     config.VolumeRoot,
+		fraction: fraction,
+		volumes:  map[string]*renewal{},
+	}
+
+	logrus.Infof("renewing volumes under: %s", r.root)
+	for {
+		r.scan()
+		retryDueRevocations()
+		time.Sleep(c.Duration("interval"))
+	}
+}
+
+// scan renews every volume that is due and forgets volumes that are gone.
+func (r *renewer) scan() {
+	records := map[string]*volumeRecord{}
+	if err := volumeStore.view(func(volumes map[string]*volumeRecord) error {
+		for volPath, record := range volumes {
+			if record.Renewal != nil && path.Dir(volPath) == r.root {
+				copied := *record
+				records[volPath] = &copied
+			}
+		}
+		return nil
+	}); err != nil {
+		logrus.Errorf("failed to list volumes: %s", err)
+		return
+	}
+
+	for dir, record := range records {
+		vol, ok := r.volumes[dir]
+		if !ok || !vol.attached.Equal(record.Attached) {
+			vol = &renewal{attached: record.Attached}
+			r.volumes[dir] = vol
+		}
+
+		if vol.failed || time.Now().Before(vol.next) {
+			continue
+		}
+
+		// A volume busy with a driver operation is renewed on the next scan.
+		unlock, err := lockVolumeTimeout(dir, 0)
+		if err != nil {
+			logrus.Debugf("skipping: %s: %s", dir, err)
+			continue
+		}
+		ttl, err := renewVolume(dir)
+		unlock()
+
+		switch {
+		case err == errNotRenewable:
+			vol.failed = true
+			logrus.Debugf("skipping: %s: %s", dir, err)
+		case err == nil:
+			vol.next = time.Now().Add(time.Duration(float64(ttl) * r.fraction))
+			logrus.Debugf("renewed: %s next renewal at: %s", dir, vol.next)
+		case isPermanentRenewError(err):
+			vol.failed = true
+			logrus.Errorf("giving up renewing: %s: %s", dir, err)
+			reportRenewError(dir, err)
+		default:
+			logrus.Errorf("failed to renew: %s, will retry: %s", dir, err)
+		}
+	}
+
+	for dir := range r.volumes {
+		if _, ok := records[dir]; !ok {
+			delete(r.volumes, dir)
+		}
+	}
+}
+
+// renewVolume renews the token of the volume in dir and rewrites its secrets
+// and templates. A certificate past two thirds of its lifetime is replaced.
+// The time until the next renewal is due is returned.
+func renewVolume(dir string) (time.Duration, error) {
+	record, err := volumeStore.get(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Detached, or attached with a wrapping token.
+	if record == nil || record.Renewal == nil {
+		return 0, errNotRenewable
+	}
+	state := record.Renewal
+
+	vClient, err := newVaultClient(state.Token)
+	if err != nil {
+		return 0, err
+	}
+
+	ttl, err := renewSelf(vClient)
+	if err != nil {
+		return 0, err
+	}
+
+	if state.Database != nil && state.Database.LeaseID != "" {
+		leaseTTL, err := renewLease(vClient, state.Database.LeaseID)
+		if err != nil {
+			return 0, err
+		}
+		if leaseTTL < ttl {
+			ttl = leaseTTL
+		}
+	}
+
+	content, err := getVolumeContent(state.Options)
+	if err != nil {
+		return ttl, permanentRenewError{err}
+	}
+
+	if err := content.files.storage.lockMemory(); err != nil {
+		return ttl, err
+	}
+
+	creds := &credentials{token: state.Token, database: state.Database, certificate: state.Certificate}
+	replaced := creds.certificate != nil && !time.Now().Before(creds.certificate.renewAt())
+	if replaced {
+		creds.certificate = nil
+	}
+
+	if err := content.read(vClient, creds); err != nil {
+		return ttl, err
+	}
+
+	if replaced {
+		if err := makeSecretRegisterRequest(server.SecretCertificate, creds.certificate.id()); err != nil {
+			issued := &volumeSecrets{certificates: creds.certificateIDs()}
+			if err := issued.revoke(); err != nil {
+				logrus.Errorf("failed to revoke unregistered certificate: %s", err)
+			}
+			return ttl, err
+		}
+	}
+
+	if err := content.write(creds, dir); err != nil {
+		return ttl, err
+	}
+
+	if replaced {
+		if err := volumeStore.update(func(volumes map[string]*volumeRecord) error {
+			if record, ok := volumes[dir]; ok {
+				record.Certificates = creds.certificateIDs()
+				if record.Renewal != nil {
+					record.Renewal.Certificate = creds.certificate
+				}
+				record.Updated = time.Now()
+			}
+			return nil
+		}); err != nil {
+			return ttl, err
+		}
+
+		replaced := &volumeSecrets{certificates: []string{state.Certificate.id()}}
+		if err := replaced.revoke(); err != nil {
+			logrus.Errorf("failed to revoke replaced certificate: %s", err)
+		}
+	}
+
+	if creds.certificate != nil {
+		if untilRenew := creds.certificate.renewAt().Sub(time.Now()); untilRenew < ttl {
+			ttl = untilRenew
+		}
+	}
+
+	// A previous failure was recovered from.
+	if record.RenewError != "" {
+		clearRenewError(dir)
+	}
+
+	return ttl, nil
+}
+
+// renewSelf renews the client token. Vault rejecting the renewal, or the
+// token no longer being renewable, is a permanent failure.
+func renewSelf(vClient *api.Client) (time.Duration, error) {
+	req := vClient.NewRequest("PUT", "/v1/auth/token/renew-self")
+	if err := req.SetJSONBody(map[string]interface{}{"increment": 0}); err != nil {
+		return 0, err
+	}
+
+	resp, err := vClient.RawRequest(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return 0, permanentRenewError{err}
+		}
+		return 0, err
+	}
+
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if secret.Auth == nil || !secret.Auth.Renewable || secret.Auth.LeaseDuration <= 0 {
+		return 0, permanentRenewError{fmt.Errorf("token is no longer renewable")}
+	}
+
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second, nil
+}
+
+// renewLease renews a dynamic secret lease, it is renewed by the token that
+// created it.
+func renewLease(vClient *api.Client, leaseID string) (time.Duration, error) {
+	req := vClient.NewRequest("PUT", "/v1/sys/leases/renew")
+	if err := req.SetJSONBody(map[string]interface{}{"lease_id": leaseID}); err != nil {
+		return 0, err
+	}
+
+	resp, err := vClient.RawRequest(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return 0, permanentRenewError{err}
+		}
+		return 0, err
+	}
+
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if !secret.Renewable || secret.LeaseDuration <= 0 {
+		return 0, permanentRenewError{fmt.Errorf("lease: %s is no longer renewable", leaseID)}
+	}
+
+	return time.Duration(secret.LeaseDuration) * time.Second, nil
+}
+
+// reportRenewError tells the workload in the volume that renewal failed and
+// records it so the next attach issues a new token.
+func reportRenewError(dir string, renewErr error) {
+	msg := fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), renewErr)
+	if err := writeVolumeFile(dir, renewErrorFile, []byte(msg+"\n"), os.FileMode(0644), -1, -1); err != nil {
+		logrus.Errorf("failed to write renewal error to: %s: %s", dir, err)
+	}
+
+	if err := setRenewError(dir, msg); err != nil {
+		logrus.Errorf("failed to record renewal error of: %s: %s", dir, err)
+	}
+}
+
+func clearRenewError(dir string) {
+	os.Remove(path.Join(dir, renewErrorFile))
+
+	if err := setRenewError(dir, ""); err != nil {
+		logrus.Errorf("failed to clear renewal error of: %s: %s", dir, err)
+	}
+}
+
+// setRenewError records the renewal error of an existing record.
+func setRenewError(dir, msg string) error {
+	return volumeStore.update(func(volumes map[string]*volumeRecord) error {
+		if record, ok := volumes[dir]; ok {
+			record.RenewError = msg
+			record.Updated = time.Now()
+		}
+		return nil
+	})
+}
+
+type permanentRenewError struct {
+	err error
+}
+
+func (p permanentRenewError) Error() string {
+	return p.err.Error()
+}
+
+func isPermanentRenewError(err error) bool {
+	_, ok := err.(permanentRenewError)
+	return ok
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeRenewVault answers renewals by token: renewable tokens and their
+// leases are renewed for ten minutes, revoked ones are refused and anything
+// else fails as if Vault was sealed.
+type fakeRenewVault struct {
+	mu       sync.Mutex
+	renewals map[string]int
+	issued   []string
+	// certificate is returned by pki/issue/web.
+	certificate string
+	key         string
+}
+
+func newFakeRenewVault(t *testing.T) (*fakeRenewVault, *httptest.Server) {
+	vault := &fakeRenewVault{renewals: map[string]int{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+
+		token := req.Header.Get("X-Vault-Token")
+		vault.renewals[token]++
+
+		body := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&body)
+
+		switch {
+		case token == "revoked":
+			rw.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(rw, `{"errors": ["permission denied"]}`)
+		case token == "expiring" && req.URL.Path == "/v1/auth/token/renew-self":
+			fmt.Fprint(rw, `{"auth": {"client_token": "expiring", "renewable": false, "lease_duration": 0}}`)
+		case token != "renewable" && token != "expiring":
+			rw.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(rw, `{"errors": ["Vault is sealed"]}`)
+		case req.URL.Path == "/v1/auth/token/renew-self":
+			fmt.Fprint(rw, `{"auth": {"client_token": "renewable", "renewable": true, "lease_duration": 600}}`)
+		case req.URL.Path == "/v1/sys/leases/renew" && body["lease_id"] == "database/creds/app/expired":
+			fmt.Fprint(rw, `{"lease_id": "database/creds/app/expired", "renewable": false, "lease_duration": 0}`)
+		case req.URL.Path == "/v1/sys/leases/renew":
+			fmt.Fprintf(rw, `{"lease_id": %q, "renewable": true, "lease_duration": 300}`, body["lease_id"])
+		case req.URL.Path == "/v1/pki/issue/web":
+			vault.issued = append(vault.issued, body["common_name"].(string))
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"serial_number": "0b",
+					"certificate":   vault.certificate,
+					"private_key":   vault.key,
+					"ca_chain":      []string{vault.certificate},
+				},
+			})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return vault, ts
+}
+
+func (f *fakeRenewVault) count(token string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.renewals[token]
+}
+
+func newTestVaultClient(t *testing.T, addr, token string) *api.Client {
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = addr
+	vClient, err := api.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vClient.SetToken(token)
+	return vClient
+}
+
+func TestRenewSelf(t *testing.T) {
+	_, ts := newFakeRenewVault(t)
+	defer ts.Close()
+
+	ttl, err := renewSelf(newTestVaultClient(t, ts.URL, "renewable"))
+	if err != nil || ttl != 10*time.Minute {
+		t.Errorf("expected the token to be renewed for 10m, got: %s %v", ttl, err)
+	}
+
+	for _, token := range []string{"revoked", "expiring"} {
+		if _, err := renewSelf(newTestVaultClient(t, ts.URL, token)); !isPermanentRenewError(err) {
+			t.Errorf("expected a permanent failure for token: %s, got: %v", token, err)
+		}
+	}
+
+	if _, err := renewSelf(newTestVaultClient(t, ts.URL, "sealed")); err == nil || isPermanentRenewError(err) {
+		t.Errorf("expected a server error to be retried, got: %v", err)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	_, ts := newFakeRenewVault(t)
+	defer ts.Close()
+
+	ttl, err := renewLease(newTestVaultClient(t, ts.URL, "renewable"), "database/creds/app/1")
+	if err != nil || ttl != 5*time.Minute {
+		t.Errorf("expected the lease to be renewed for 5m, got: %s %v", ttl, err)
+	}
+
+	if _, err := renewLease(newTestVaultClient(t, ts.URL, "renewable"), "database/creds/app/expired"); !isPermanentRenewError(err) {
+		t.Errorf("expected a lease that is no longer renewable to fail permanently, got: %v", err)
+	}
+
+	if _, err := renewLease(newTestVaultClient(t, ts.URL, "revoked"), "database/creds/app/1"); !isPermanentRenewError(err) {
+		t.Errorf("expected a refused renewal to fail permanently, got: %v", err)
+	}
+
+	if _, err := renewLease(newTestVaultClient(t, ts.URL, "sealed"), "database/creds/app/1"); err == nil || isPermanentRenewError(err) {
+		t.Errorf("expected a server error to be retried, got: %v", err)
+	}
+}
+
+// withRenewTestState points the store, the revocation queue and Vault at
+// test doubles, revoked collects the revoked IDs.
+func withRenewTestState(t *testing.T, vaultAddr string) (string, *[]string) {
+	savedStore, savedQueue, savedAddr := volumeStore, revocationQueue, config.VaultAddr
+	t.Cleanup(func() {
+		volumeStore, revocationQueue, config.VaultAddr = savedStore, savedQueue, savedAddr
+	})
+
+	dir := t.TempDir()
+	volumeStore = newTestStateStore(dir)
+	revocationQueue = newRevocationStore(path.Join(dir, "revocations.json"))
+	config.VaultAddr = vaultAddr
+
+	revoked := &[]string{}
+	revocationQueue.revoke = func(r *revocation) error {
+		*revoked = append(*revoked, r.ID)
+		return nil
+	}
+
+	root := path.Join(dir, "volumes")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root, revoked
+}
+
+func attachTestVolume(t *testing.T, volPath string, state *volumeState) {
+	if err := os.MkdirAll(volPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := volumeStore.modify(volPath, func(record *volumeRecord) {
+		record.State = volumeMounted
+		record.Renewal = state
+		record.RenewError = ""
+		record.Attached = time.Now()
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenewerScan(t *testing.T) {
+	vault, ts := newFakeRenewVault(t)
+	defer ts.Close()
+	root, _ := withRenewTestState(t, ts.URL)
+
+	healthy := path.Join(root, "healthy")
+	revoked := path.Join(root, "revoked")
+	sealed := path.Join(root, "sealed")
+	wrapped := path.Join(root, "wrapped")
+	options := map[string]interface{}{"name": "app"}
+
+	attachTestVolume(t, healthy, &volumeState{Token: "renewable", Options: options})
+	attachTestVolume(t, revoked, &volumeState{Token: "revoked", Options: options})
+	attachTestVolume(t, sealed, &volumeState{Token: "sealed", Options: options})
+	attachTestVolume(t, wrapped, nil)
+	// Volumes outside the root are not renewed.
+	attachTestVolume(t, path.Join(t.TempDir(), "elsewhere"), &volumeState{Token: "renewable", Options: options})
+
+	r := &renewer{root: root, fraction: 0.5, volumes: map[string]*renewal{}}
+	r.scan()
+
+	if vault.count("renewable") != 1 {
+		t.Errorf("expected a single renewal, got: %d", vault.count("renewable"))
+	}
+	vol := r.volumes[healthy]
+	if vol == nil || vol.failed || vol.next.Before(time.Now().Add(4*time.Minute)) || vol.next.After(time.Now().Add(5*time.Minute)) {
+		t.Fatalf("expected the next renewal at half the ttl, got: %#v", vol)
+	}
+	if token, _ := ioutil.ReadFile(path.Join(healthy, "token")); string(token) != "renewable" {
+		t.Errorf("expected the token to be written again, got: %q", token)
+	}
+	if _, ok := r.volumes[wrapped]; ok {
+		t.Errorf("expected the wrapped volume to be skipped")
+	}
+
+	if vol := r.volumes[revoked]; vol == nil || !vol.failed {
+		t.Errorf("expected the revoked token to fail permanently")
+	}
+	if _, err := os.Stat(path.Join(revoked, renewErrorFile)); err != nil {
+		t.Errorf("expected the failure to be reported in the volume: %s", err)
+	}
+	if record, _ := volumeStore.get(revoked); record.RenewError == "" {
+		t.Errorf("expected the failure to be recorded")
+	}
+
+	if vol := r.volumes[sealed]; vol == nil || vol.failed {
+		t.Errorf("expected a server error to be retried")
+	}
+	if record, _ := volumeStore.get(sealed); record.RenewError != "" {
+		t.Errorf("expected a server error not to be recorded as permanent")
+	}
+
+	// Nothing is due, the failed volume is given up and the sealed one
+	// retried.
+	r.scan()
+	if vault.count("renewable") != 1 || vault.count("revoked") != 1 || vault.count("sealed") != 2 {
+		t.Errorf("unexpected renewals: %v", vault.renewals)
+	}
+
+	r.volumes[healthy].next = time.Now().Add(-time.Second)
+	r.scan()
+	if vault.count("renewable") != 2 {
+		t.Errorf("expected the due volume to be renewed, got: %d", vault.count("renewable"))
+	}
+
+	// Attaching again starts a new schedule.
+	attachTestVolume(t, revoked, &volumeState{Token: "renewable", Options: options})
+	r.scan()
+	if vol := r.volumes[revoked]; vol == nil || vol.failed {
+		t.Errorf("expected the attached volume to be renewed again")
+	}
+
+	if err := volumeStore.remove(healthy); err != nil {
+		t.Fatal(err)
+	}
+	r.scan()
+	if _, ok := r.volumes[healthy]; ok {
+		t.Errorf("expected a removed volume to be forgotten")
+	}
+}
+
+func TestRenewVolumeIgnoresVolumeFiles(t *testing.T) {
+	vault, ts := newFakeRenewVault(t)
+	defer ts.Close()
+	root, _ := withRenewTestState(t, ts.URL)
+
+	volPath := path.Join(root, "app")
+	attachTestVolume(t, volPath, &volumeState{Token: "renewable", Options: map[string]interface{}{"name": "app"}})
+
+	// A workload writing state into its volume changes nothing.
+	injected := `{"token": "injected", "options": {"templates": "[{\"file\": \"shadow\", \"source\": \"/etc/shadow\"}]"}}`
+	if err := ioutil.WriteFile(path.Join(volPath, ".volume"), []byte(injected), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := renewVolume(volPath); err != nil {
+		t.Fatal(err)
+	}
+	if vault.count("injected") != 0 {
+		t.Errorf("expected the token of the volume file to be ignored")
+	}
+	if _, err := os.Stat(path.Join(volPath, "shadow")); err == nil {
+		t.Errorf("expected the options of the volume file to be ignored")
+	}
+}
+
+func TestRenewVolumeReplacesCertificate(t *testing.T) {
+	vault, ts := newFakeRenewVault(t)
+	defer ts.Close()
+	status := http.StatusCreated
+	registered := withRegisteringTokenServer(t, &status)
+	root, revoked := withRenewTestState(t, ts.URL)
+
+	vault.certificate, vault.key = newTestCertificate(t, 11, time.Now().Truncate(time.Second), 3*time.Hour)
+
+	volPath := path.Join(root, "web")
+	options := map[string]interface{}{"name": "web", "pkiRole": "web", "pkiCommonName": "web.example.com"}
+	expired := &certificateCreds{
+		Mount:        "pki",
+		SerialNumber: "0a",
+		NotBefore:    time.Now().Add(-3 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Minute),
+	}
+	attachTestVolume(t, volPath, &volumeState{Token: "renewable", Options: options, Certificate: expired})
+	if err := volumeStore.modify(volPath, func(record *volumeRecord) {
+		record.Certificates = []string{expired.id()}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, err := renewVolume(volPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two thirds into the three hour lifetime comes before the token ttl.
+	if ttl != 10*time.Minute {
+		t.Errorf("expected the token ttl, got: %s", ttl)
+	}
+
+	if len(vault.issued) != 1 || vault.issued[0] != "web.example.com" {
+		t.Errorf("expected a new certificate, got: %v", vault.issued)
+	}
+	if cert, _ := ioutil.ReadFile(path.Join(volPath, "cert.pem")); string(cert) != vault.certificate+"\n" {
+		t.Errorf("expected the new certificate in the volume")
+	}
+
+	record, err := volumeStore.get(volPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Certificates) != 1 || record.Certificates[0] != "pki/0b" || record.Renewal.Certificate.SerialNumber != "0b" {
+		t.Errorf("expected the new certificate to be recorded, got: %v %#v", record.Certificates, record.Renewal.Certificate)
+	}
+	if len(*revoked) != 1 || (*revoked)[0] != "pki/0a" {
+		t.Errorf("expected the replaced certificate to be revoked, got: %v", *revoked)
+	}
+	if len(*registered) != 1 || (*registered)[0].ID != "pki/0b" {
+		t.Errorf("expected the new certificate to be registered, got: %v", *registered)
+	}
+
+	// The key is only in the volume.
+	state, _ := json.Marshal(record.Renewal)
+	if strings.Contains(string(state), "PRIVATE KEY") {
+		t.Errorf("expected the private key not to be recorded")
+	}
+
+	// A current certificate is kept, its files are not touched.
+	if err := os.Remove(path.Join(volPath, "key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renewVolume(volPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(vault.issued) != 1 {
+		t.Errorf("expected the certificate to be kept, got: %v", vault.issued)
+	}
+	if _, err := os.Stat(path.Join(volPath, "key.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected the kept certificate not to be written again")
+	}
+
+	// A new certificate the token server refuses to register is revoked.
+	status = http.StatusForbidden
+	if err := volumeStore.modify(volPath, func(record *volumeRecord) {
+		record.Renewal.Certificate.NotAfter = time.Now().Add(-time.Minute)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renewVolume(volPath); err == nil {
+		t.Errorf("expected the unregistered certificate to fail the renewal")
+	}
+	if len(*revoked) != 2 || (*revoked)[1] != "pki/0b" {
+		t.Errorf("expected the unregistered certificate to be revoked, got: %v", *revoked)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	defaultFileMode = 0644
+)
+
+// secretSpec describes a single Vault KV value that should be rendered into
+// the volume as its own file.
+type secretSpec struct {
+	// Path is the path of the secret, including the mount, e.g. secret/myapp
+	Path string `json:"path"`
+	// Key is the field to read from the secret. If empty the whole secret is
+	// written as JSON.
+	Key string `json:"key"`
+	// File is the name of the file in the volume, defaults to Key or the last
+	// element of Path.
+	File string `json:"file"`
+	// Mode is the octal file mode, defaults to the volume fileMode.
+	Mode string `json:"mode"`
+	// KVVersion is 1 or 2, defaults to 1
+	KVVersion int `json:"kv_version"`
+	// Mount is the KV v2 mount point, defaults to the first element of Path.
+	Mount string `json:"mount"`
+
+	fileMode os.FileMode
+}
+
+// getSecretSpecs parses the "secrets" driver option. The value can be a JSON
+// string, as passed through Rancher driver_opts, or an already decoded list.
+func getSecretSpecs(options map[string]interface{}) ([]*secretSpec, error) {
+	specs := []*secretSpec{}
+
+	var specJSON []byte
+	switch secrets := options["secrets"].(type) {
+	case nil:
+		return specs, nil
+	case string:
+		if secrets == "" {
+			return specs, nil
+		}
+		specJSON = []byte(secrets)
+	case []interface{}:
+		var err error
+		if specJSON, err = json.Marshal(secrets); err != nil {
+			return specs, err
+		}
+	default:
+		return specs, fmt.Errorf("secrets option must be a JSON list")
+	}
+
+	if err := json.Unmarshal(specJSON, &specs); err != nil {
+		return specs, fmt.Errorf("could not parse secrets option: %s", err)
+	}
+
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return specs, err
+		}
+	}
+
+	return specs, nil
+}
+
+func (s *secretSpec) validate() error {
+	s.Path = strings.Trim(s.Path, "/")
+	if s.Path == "" {
+		return fmt.Errorf("secret path is required")
+	}
+
+	switch s.KVVersion {
+	case 0:
+		s.KVVersion = 1
+	case 1, 2:
+	default:
+		return fmt.Errorf("secret: %s has unsupported kv_version: %d", s.Path, s.KVVersion)
+	}
+
+	if s.File == "" {
+		s.File = s.Key
+	}
+	if s.File == "" {
+		s.File = path.Base(s.Path)
+	}
+	if err := validateFileName(s.File); err != nil {
+		return err
+	}
+
+	mode, err := parseFileMode(s.Mode, 0)
+	if err != nil {
+		return fmt.Errorf("secret: %s has invalid mode: %s", s.Path, err)
+	}
+	s.fileMode = mode
+
+	return nil
+}
+
+// apiPath returns the path to read from the Vault API.
+func (s *secretSpec) apiPath() string {
+	if s.KVVersion != 2 {
+		return s.Path
+	}
+
+	mount := strings.Trim(s.Mount, "/")
+	if mount == "" {
+		mount = strings.SplitN(s.Path, "/", 2)[0]
+	}
+
+	return path.Join(mount, "data", strings.TrimPrefix(s.Path, mount+"/"))
+}
+
+// render extracts the configured value from a secret read from Vault.
+func (s *secretSpec) render(secret *api.Secret) ([]byte, error) {
+	data := secret.Data
+	if s.KVVersion == 2 {
+		nested, ok := data["data"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("secret: %s is not a kv version 2 secret", s.Path)
+		}
+		data = nested
+	}
+
+	if s.Key == "" {
+		return json.Marshal(data)
+	}
+
+	value, ok := data[s.Key]
+	if !ok {
+		return nil, fmt.Errorf("key: %s not found in secret: %s", s.Key, s.Path)
+	}
+
+	if str, ok := value.(string); ok {
+		return []byte(str), nil
+	}
+	return json.Marshal(value)
+}
+
+// readSecrets reads every secret with the given client.
+func readSecrets(vClient *api.Client, specs []*secretSpec) ([]*volumeFile, error) {
+	secrets := []*volumeFile{}
+
+	for _, spec := range specs {
+		logrus.Debugf("reading secret: %s", spec.apiPath())
+		secret, err := vClient.Logical().Read(spec.apiPath())
+		if err != nil {
+			return secrets, err
+		}
+
+		if secret == nil {
+			return secrets, fmt.Errorf("secret: %s not found", spec.Path)
+		}
+
+		content, err := spec.render(secret)
+		if err != nil {
+			return secrets, err
+		}
+
+		secrets = append(secrets, &volumeFile{
+			name:    spec.File,
+			content: content,
+			mode:    spec.fileMode,
+		})
+	}
+
+	return secrets, nil
+}
+
+// newVaultClient returns a Vault API client for the configured vaultAddr,
+// the other settings come from the standard VAULT_* environment variables,
+// authenticated with token.
+func newVaultClient(token string) (*api.Client, error) {
+	if config.VaultAddr == "" {
+		return nil, fmt.Errorf("vaultAddr is not set in the driver config")
+	}
+
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = config.VaultAddr
+
+	client, err := api.NewClient(vaultConfig)
+	if err != nil {
+		return client, err
+	}
+
+	client.SetToken(token)
+	return client, nil
+}
+
+func validateFileName(name string) error {
+	if name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid file name: %s", name)
+	}
+
+	switch name {
+	case "token", ".accessor", renewErrorFile:
+		return fmt.Errorf("file name: %s is reserved", name)
+	}
+
+	return nil
+}
+
+func parseFileMode(mode string, defaultMode os.FileMode) (os.FileMode, error) {
+	if mode == "" {
+		return defaultMode, nil
+	}
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return defaultMode, err
+	}
+
+	if parsed&^uint64(os.ModePerm) != 0 {
+		return defaultMode, fmt.Errorf("mode: %s is out of range", mode)
+	}
+
+	return os.FileMode(parsed), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestGetSecretSpecs(t *testing.T) {
+	options := map[string]interface{}{
+		"secrets": `[{"path": "secret/myapp", "key": "password", "mode": "0400"},
+			{"path": "/kv/team/db/", "kv_version": 2, "mount": "kv/team", "file": "db.json"}]`,
+	}
+
+	specs, err := getSecretSpecs(options)
+	if err != nil {
+		t.Fatalf("failed to parse secrets: %s", err)
+	}
+
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 specs, got: %d", len(specs))
+	}
+
+	if specs[0].File != "password" || specs[0].fileMode != os.FileMode(0400) || specs[0].apiPath() != "secret/myapp" {
+		t.Errorf("unexpected kv v1 spec: %#v", specs[0])
+	}
+
+	if specs[1].apiPath() != "kv/team/data/db" {
+		t.Errorf("unexpected kv v2 path: %s", specs[1].apiPath())
+	}
+}
+
+func TestGetSecretSpecsInvalid(t *testing.T) {
+	for _, secrets := range []string{
+		`[{"key": "password"}]`,
+		`[{"path": "secret/a", "file": "../etc/passwd"}]`,
+		`[{"path": "secret/a", "file": "token"}]`,
+		`[{"path": "secret/a", "mode": "999"}]`,
+		`[{"path": "secret/a", "kv_version": 3}]`,
+		`[{"path": "secret/a"}, {"path": "other/a"}]`,
+	} {
+		if _, err := getVolumeContent(map[string]interface{}{"secrets": secrets}); err == nil {
+			t.Errorf("expected error for: %s", secrets)
+		}
+	}
+}
+
+func TestSecretSpecRender(t *testing.T) {
+	spec := &secretSpec{Path: "secret/myapp", Key: "port", KVVersion: 2}
+	secret := &api.Secret{
+		Data: map[string]interface{}{
+			"data": map[string]interface{}{"port": 5432, "user": "app"},
+		},
+	}
+
+	content, err := spec.render(secret)
+	if err != nil || string(content) != "5432" {
+		t.Errorf("unexpected render result: %s %s", content, err)
+	}
+
+	spec.Key = "missing"
+	if _, err := spec.render(secret); err == nil {
+		t.Errorf("expected error for missing key")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envKeyRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// volumeFile is a rendered file waiting to be written into the volume.
+type volumeFile struct {
+	name    string
+	content []byte
+	mode    os.FileMode
+}
+
+// credentials is everything read from Vault for a volume, sinks decide how
+// it is laid out on disk.
+type credentials struct {
+	token   string
+	secrets []*volumeFile
+	// files, the rendered templates and certificates, are written as is by
+	// every sink combination.
+	files       []*volumeFile
+	database    *databaseCreds
+	certificate *certificateCreds
+}
+
+// leaseIDs returns the leases that have to be revoked with the token.
+func (c *credentials) leaseIDs() []string {
+	leases := []string{}
+	if c.database != nil && c.database.LeaseID != "" {
+		leases = append(leases, c.database.LeaseID)
+	}
+	return leases
+}
+
+// certificateIDs returns the certificates that have to be revoked with the
+// token.
+func (c *credentials) certificateIDs() []string {
+	certificates := []string{}
+	if c.certificate != nil && c.certificate.SerialNumber != "" {
+		certificates = append(certificates, c.certificate.id())
+	}
+	return certificates
+}
+
+// sink writes credentials into the volume in a single format.
+type sink interface {
+	write(dir string, creds *credentials, files *fileOptions) error
+	fileNames(specs []*secretSpec) []string
+}
+
+// sinkFactories maps the names accepted in the formats option to the sink and
+// the file it writes by default.
+var sinkFactories = map[string]struct {
+	defaultFile string
+	new         func(file string) sink
+}{
+	"files":       {"", func(string) sink { return filesSink{} }},
+	"env":         {"secrets.env", func(file string) sink { return envSink{file} }},
+	"json":        {"secrets.json", func(file string) sink { return jsonSink{file} }},
+	"yaml":        {"secrets.yaml", func(file string) sink { return yamlSink{file} }},
+	"properties":  {"secrets.properties", func(file string) sink { return propertiesSink{file} }},
+	"vault-token": {".vault-token", func(file string) sink { return vaultTokenSink{file} }},
+}
+
+// getSinks parses the formats driver option, a comma separated list of
+// format[:file] entries. Defaults to files, the token and every secret in
+// its own file.
+func getSinks(options map[string]interface{}) ([]sink, error) {
+	sinks := []sink{}
+
+	formats, _ := options["formats"].(string)
+	if strings.TrimSpace(formats) == "" {
+		formats = "files"
+	}
+
+	seen := map[string]bool{}
+	for _, format := range strings.Split(formats, ",") {
+		parts := strings.SplitN(strings.TrimSpace(format), ":", 2)
+
+		factory, ok := sinkFactories[parts[0]]
+		if !ok {
+			return sinks, fmt.Errorf("unknown format: %s", parts[0])
+		}
+
+		if seen[parts[0]] {
+			return sinks, fmt.Errorf("format: %s is defined more than once", parts[0])
+		}
+		seen[parts[0]] = true
+
+		file := factory.defaultFile
+		if len(parts) == 2 {
+			if factory.defaultFile == "" {
+				return sinks, fmt.Errorf("format: %s does not take a file name", parts[0])
+			}
+			file = parts[1]
+			if err := validateFileName(file); err != nil {
+				return sinks, err
+			}
+		}
+
+		sinks = append(sinks, factory.new(file))
+	}
+
+	return sinks, nil
+}
+
+// keyedSink writes the token and the secrets as key/value pairs, keys
+// derived from the file names must not collide.
+type keyedSink interface {
+	checkKeys(names []string) error
+}
+
+// credentialValues flattens the credentials to key/value pairs, the token is
+// stored under tokenKey and the secrets under their file names.
+func credentialValues(creds *credentials, tokenKey string, keyFunc func(string) string) ([]string, map[string]string, error) {
+	names := []string{}
+	for _, secret := range creds.secrets {
+		names = append(names, secret.name)
+	}
+	if err := checkCredentialKeys(names, tokenKey, keyFunc); err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]string{tokenKey: creds.token}
+	for _, secret := range creds.secrets {
+		values[keyFunc(secret.name)] = string(secret.content)
+	}
+
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, values, nil
+}
+
+// checkCredentialKeys fails if two secrets, or a secret and the token, would
+// be stored under the same key.
+func checkCredentialKeys(names []string, tokenKey string, keyFunc func(string) string) error {
+	owners := map[string]string{tokenKey: "the token"}
+	for _, name := range names {
+		key := keyFunc(name)
+		if owner, ok := owners[key]; ok {
+			return fmt.Errorf("secret: %s and %s are both written as: %s", name, owner, key)
+		}
+		owners[key] = name
+	}
+	return nil
+}
+
+func sameKey(key string) string {
+	return key
+}
+
+// filesSink writes the token and every secret into its own file.
+type filesSink struct{}
+
+func (s filesSink) write(dir string, creds *credentials, files *fileOptions) error {
+	if err := files.writeFile(dir, "token", []byte(creds.token), 0); err != nil {
+		return err
+	}
+
+	for _, secret := range creds.secrets {
+		if err := files.writeFile(dir, secret.name, secret.content, secret.mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s filesSink) fileNames(specs []*secretSpec) []string {
+	names := []string{}
+	for _, spec := range specs {
+		names = append(names, spec.File)
+	}
+	return names
+}
+
+// envSink writes a .env file with VAULT_TOKEN and a variable per secret.
+type envSink struct {
+	file string
+}
+
+func (s envSink) write(dir string, creds *credentials, files *fileOptions) error {
+	keys, values, err := credentialValues(creds, "VAULT_TOKEN", envKey)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s=%s\n", key, quoteEnv(values[key]))
+	}
+
+	return files.writeFile(dir, s.file, buf.Bytes(), 0)
+}
+
+func (s envSink) fileNames([]*secretSpec) []string {
+	return []string{s.file}
+}
+
+func (s envSink) checkKeys(names []string) error {
+	return checkCredentialKeys(names, "VAULT_TOKEN", envKey)
+}
+
+// envKey turns a file name into an environment variable name, db.password
+// becomes DB_PASSWORD.
+func envKey(name string) string {
+	key := envKeyRegexp.ReplaceAllString(strings.ToUpper(name), "_")
+	if key != "" && key[0] >= '0' && key[0] <= '9' {
+		key = "_" + key
+	}
+	return key
+}
+
+func quoteEnv(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// jsonSink writes a JSON object with the token and the secrets.
+type jsonSink struct {
+	file string
+}
+
+func (s jsonSink) write(dir string, creds *credentials, files *fileOptions) error {
+	_, values, err := credentialValues(creds, "token", sameKey)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return files.writeFile(dir, s.file, append(content, '\n'), 0)
+}
+
+func (s jsonSink) fileNames([]*secretSpec) []string {
+	return []string{s.file}
+}
+
+func (s jsonSink) checkKeys(names []string) error {
+	return checkCredentialKeys(names, "token", sameKey)
+}
+
+// yamlSink writes a flat YAML mapping. Keys and values are JSON encoded,
+// which is valid YAML and avoids any quoting surprises.
+type yamlSink struct {
+	file string
+}
+
+func (s yamlSink) write(dir string, creds *credentials, files *fileOptions) error {
+	keys, values, err := credentialValues(creds, "token", sameKey)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, key := range keys {
+		quotedKey, _ := json.Marshal(key)
+		quotedValue, _ := json.Marshal(values[key])
+		fmt.Fprintf(buf, "%s: %s\n", quotedKey, quotedValue)
+	}
+
+	return files.writeFile(dir, s.file, buf.Bytes(), 0)
+}
+
+func (s yamlSink) fileNames([]*secretSpec) []string {
+	return []string{s.file}
+}
+
+func (s yamlSink) checkKeys(names []string) error {
+	return checkCredentialKeys(names, "token", sameKey)
+}
+
+// propertiesSink writes a Java properties file.
+type propertiesSink struct {
+	file string
+}
+
+func (s propertiesSink) write(dir string, creds *credentials, files *fileOptions) error {
+	keys, values, err := credentialValues(creds, "vault.token", sameKey)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s=%s\n", escapeProperty(key, true), escapeProperty(values[key], false))
+	}
+
+	return files.writeFile(dir, s.file, buf.Bytes(), 0)
+}
+
+func (s propertiesSink) fileNames([]*secretSpec) []string {
+	return []string{s.file}
+}
+
+func (s propertiesSink) checkKeys(names []string) error {
+	return checkCredentialKeys(names, "vault.token", sameKey)
+}
+
+func escapeProperty(value string, isKey bool) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "=", `\=`, ":", `\:`, "#", `\#`, "!", `\!`)
+	escaped := replacer.Replace(value)
+
+	if isKey {
+		return strings.Replace(escaped, " ", `\ `, -1)
+	}
+
+	if strings.HasPrefix(escaped, " ") {
+		escaped = `\` + escaped
+	}
+	return escaped
+}
+
+// vaultTokenSink writes the token the way the Vault CLI expects to find it
+// in ~/.vault-token, so the volume can be mounted as the workload's HOME.
+type vaultTokenSink struct {
+	file string
+}
+
+func (s vaultTokenSink) write(dir string, creds *credentials, files *fileOptions) error {
+	return files.writeFile(dir, s.file, []byte(creds.token), 0)
+}
+
+func (s vaultTokenSink) fileNames([]*secretSpec) []string {
+	return []string{s.file}
+}
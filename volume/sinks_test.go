@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSinksWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sinks, err := getSinks(map[string]interface{}{"formats": "files, env:app.env, properties"})
+	if err != nil {
+		t.Fatalf("failed to parse formats: %s", err)
+	}
+
+	files := &fileOptions{uid: -1, gid: -1, fileMode: defaultFileMode}
+	creds := &credentials{
+		token: "client-token",
+		secrets: []*volumeFile{
+			{name: "db.password", content: []byte(`p"a$s=`), mode: 0400},
+		},
+	}
+
+	for _, s := range sinks {
+		if err := s.write(dir, creds, files); err != nil {
+			t.Fatalf("sink failed to write: %s", err)
+		}
+	}
+
+	expected := map[string]string{
+		"token":              "client-token",
+		"db.password":        `p"a$s=`,
+		"app.env":            "DB_PASSWORD=\"p\\\"a\\$s=\"\nVAULT_TOKEN=\"client-token\"\n",
+		"secrets.properties": "db.password=p\"a$s\\=\nvault.token=client-token\n",
+	}
+
+	for file, content := range expected {
+		actual, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Errorf("failed to read: %s: %s", file, err)
+			continue
+		}
+
+		if string(actual) != content {
+			t.Errorf("file: %s expected: %q got: %q", file, content, actual)
+		}
+	}
+
+	if info, err := os.Stat(path.Join(dir, "db.password")); err != nil || info.Mode() != os.FileMode(0400) {
+		t.Errorf("unexpected secret file mode: %v %s", info, err)
+	}
+}
+
+func TestGetSinksInvalid(t *testing.T) {
+	for _, formats := range []string{"xml", "env,env", "files:secrets", "json:../x"} {
+		if _, err := getSinks(map[string]interface{}{"formats": formats}); err == nil {
+			t.Errorf("expected error for: %s", formats)
+		}
+	}
+}
+
+func TestSinkKeyCollisions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"formats": "env", "secrets": `[{"path": "secret/a", "file": "db.password"}, {"path": "secret/b", "file": "db-password"}]`},
+		{"formats": "env", "secrets": `[{"path": "secret/a", "file": "vault_token"}]`},
+		{"formats": "properties", "secrets": `[{"path": "secret/a", "file": "vault.token"}]`},
+		{"formats": "env", "secrets": `[{"path": "secret/a", "file": "db.username"}]`, "databaseRole": "app"},
+	} {
+		if _, err := getVolumeContent(options); err == nil {
+			t.Errorf("expected a key collision for: %#v", options)
+		}
+	}
+
+	// The files format keeps the names apart.
+	options := map[string]interface{}{"secrets": `[{"path": "secret/a", "file": "db.password"}, {"path": "secret/b", "file": "db-password"}]`}
+	if _, err := getVolumeContent(options); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	creds := &credentials{
+		token: "client-token",
+		secrets: []*volumeFile{
+			{name: "vault.token", content: []byte("forged")},
+		},
+	}
+	files := &fileOptions{uid: -1, gid: -1, fileMode: defaultFileMode}
+	if err := (propertiesSink{"secrets.properties"}).write(t.TempDir(), creds, files); err == nil {
+		t.Errorf("expected the token key to be protected")
+	}
+}
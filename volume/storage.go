@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/moby/moby/pkg/mount"
+)
+
+const (
+	// storageTmpfs is swappable, the kernel enforces the size.
+	storageTmpfs = "tmpfs"
+	// storageRamfs is never swapped, ramfs ignores size so the driver
+	// enforces it on every write and the workload gets the volume read
+	// only.
+	storageRamfs = "ramfs"
+	// storageMlock is ramfs backed and additionally locks the memory of the
+	// driver process, so rendered secrets are not swapped out of the driver
+	// either.
+	storageMlock = "mlock"
+
+	defaultVolumeSize = 10 * 1024 * 1024
+)
+
+// forcedMountFlags are always added, secrets are never executable or device
+// nodes.
+var forcedMountFlags = []string{"noexec", "nosuid", "nodev"}
+
+// storageOptions is how the volume is backed, parsed from the storage and
+// mountOpts driver options.
+type storageOptions struct {
+	mode string
+	// size is the limit of the volume in bytes.
+	size int64
+	// nrInodes is passed on to tmpfs, zero leaves the kernel default.
+	nrInodes int64
+}
+
+// getStorageOptions parses the storage mode and the mountOpts. Only size and
+// nr_inodes may be set, anything else in mountOpts is rejected.
+func getStorageOptions(options map[string]interface{}) (*storageOptions, error) {
+	storage := &storageOptions{mode: storageTmpfs, size: defaultVolumeSize}
+
+	if mode, ok := options["storage"].(string); ok && mode != "" {
+		switch mode {
+		case storageTmpfs, storageRamfs, storageMlock:
+			storage.mode = mode
+		default:
+			return storage, fmt.Errorf("option: storage must be one of %s, %s or %s", storageTmpfs, storageRamfs, storageMlock)
+		}
+	}
+
+	mountOpts, _ := options["mountOpts"].(string)
+	for _, opt := range strings.Split(mountOpts, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+
+		parts := strings.SplitN(opt, "=", 2)
+		switch {
+		case isForcedMountFlag(opt):
+			// Already set.
+		case len(parts) == 2 && parts[0] == "size":
+			size, err := parseSize(parts[1])
+			if err != nil {
+				return storage, fmt.Errorf("option: mountOpts size is invalid: %s", err)
+			}
+			storage.size = size
+		case len(parts) == 2 && parts[0] == "nr_inodes":
+			inodes, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || inodes <= 0 {
+				return storage, fmt.Errorf("option: mountOpts nr_inodes must be a positive number")
+			}
+			storage.nrInodes = inodes
+		default:
+			return storage, fmt.Errorf("option: mountOpts %s is not allowed, only size and nr_inodes may be set", opt)
+		}
+	}
+
+	return storage, nil
+}
+
+// fstype is the filesystem mounted for the volume.
+func (s *storageOptions) fstype() string {
+	if s.mode == storageTmpfs {
+		return "tmpfs"
+	}
+	return "ramfs"
+}
+
+// protectRamfs remounts the bind mount of the volume at dir read only if the
+// volume is a ramfs. ramfs has no size limit, a workload that could write to
+// it could use up the memory of the host.
+func protectRamfs(volPath, dir string) error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(volPath, &fs); err != nil {
+		return err
+	}
+	if fs.Type != ramfsMagic {
+		return nil
+	}
+	return mount.Mount("none", dir, "none", "bind,remount,ro")
+}
+
+// isVolumeFstype is true for the filesystems fstype mounts, tmpfs and ramfs
+// for both ramfs and mlock volumes.
+func isVolumeFstype(fstype string) bool {
+	return fstype == "tmpfs" || fstype == "ramfs"
+}
+
+// mountOpts are the options passed to mount, the SELinux label is added by
+// fileOptions.
+func (s *storageOptions) mountOpts() string {
+	opts := append([]string{}, forcedMountFlags...)
+	if s.mode == storageTmpfs {
+		opts = append(opts, fmt.Sprintf("size=%d", s.size))
+		if s.nrInodes > 0 {
+			opts = append(opts, fmt.Sprintf("nr_inodes=%d", s.nrInodes))
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// checkWrite fails if writing size bytes to name in dir would take the volume
+// over its size. The kernel already does this for tmpfs.
+func (s *storageOptions) checkWrite(dir, name string, size int) error {
+	if s.mode == storageTmpfs {
+		return nil
+	}
+
+	used, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+
+	// The file is replaced, its current content does not count.
+	if info, err := os.Lstat(filepath.Join(dir, name)); err == nil && info.Mode().IsRegular() {
+		used -= info.Size()
+	}
+
+	if used+int64(size) > s.size {
+		return fmt.Errorf("volume size limit of %d bytes exceeded writing: %s", s.size, name)
+	}
+	return nil
+}
+
+// lockMemory locks the memory of the driver process for mlock volumes. The
+// lock covers every current and future page and lasts as long as the
+// process: a flexvol call exits when it is done, but the agent, the renew
+// daemon and the Docker and CSI plugins keep all of their memory pinned until
+// they are restarted, so their RLIMIT_MEMLOCK has to allow for it.
+func (s *storageOptions) lockMemory() error {
+	if s.mode != storageMlock {
+		return nil
+	}
+
+	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
+		return fmt.Errorf("failed to lock driver memory: %s", err)
+	}
+	return nil
+}
+
+func isForcedMountFlag(opt string) bool {
+	for _, flag := range forcedMountFlags {
+		if opt == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a byte count with an optional k, m or g suffix, the way
+// tmpfs reads its size option. Percentages are not allowed, the limit has to
+// be the same for every storage mode.
+func parseSize(value string) (int64, error) {
+	multipliers := map[string]int64{"k": 1024, "m": 1024 * 1024, "g": 1024 * 1024 * 1024}
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		if m, ok := multipliers[strings.ToLower(value[n-1:])]; ok {
+			multiplier = m
+			value = value[:n-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("%s must be a positive size", value)
+	}
+	return size * multiplier, nil
+}
+
+// dirSize adds up the size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// wipeDir overwrites every regular file under dir with zeros and syncs it, so
+// the secrets are gone from the pages before the volume is unmounted and its
+// memory is handed back.
+func wipeDir(dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if err := wipeFile(name, info.Size()); err != nil {
+			logrus.Errorf("failed to wipe: %s got: %s", name, err)
+		}
+		return nil
+	})
+}
+
+func wipeFile(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zeros := make([]byte, 32*1024)
+	for written := int64(0); written < size; {
+		n := int64(len(zeros))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+
+	return f.Sync()
+}
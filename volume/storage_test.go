@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestGetStorageOptions(t *testing.T) {
+	storage, err := getStorageOptions(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.fstype() != "tmpfs" || storage.mountOpts() != "noexec,nosuid,nodev,size=10485760" {
+		t.Errorf("unexpected defaults: %s %s", storage.fstype(), storage.mountOpts())
+	}
+
+	storage, err = getStorageOptions(map[string]interface{}{"storage": "ramfs", "mountOpts": "size=4k, noexec"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.fstype() != "ramfs" || storage.size != 4096 || storage.mountOpts() != "noexec,nosuid,nodev" {
+		t.Errorf("unexpected ramfs options: %#v %s", storage, storage.mountOpts())
+	}
+
+	for _, options := range []map[string]interface{}{
+		{"storage": "disk"},
+		{"mountOpts": "exec"},
+		{"mountOpts": "size=10m,suid"},
+		{"mountOpts": "size=50%"},
+		{"mountOpts": "size=0"},
+		{"mountOpts": "nr_inodes=lots"},
+		{"mountOpts": "remount,rw"},
+	} {
+		if _, err := getStorageOptions(options); err == nil {
+			t.Errorf("expected error for: %#v", options)
+		}
+	}
+}
+
+func TestRamfsSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	files := &fileOptions{uid: -1, gid: -1, fileMode: defaultFileMode, storage: &storageOptions{mode: storageRamfs, size: 10}}
+
+	if err := files.writeFile(dir, "a", []byte("12345678"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.writeFile(dir, "b", []byte("123"), 0); err == nil {
+		t.Errorf("expected the volume size limit to be enforced")
+	}
+	if err := files.writeFile(dir, "a", []byte("1234567890"), 0); err != nil {
+		t.Errorf("replacing a file must not count its old content: %s", err)
+	}
+}
+
+func TestWipeDir(t *testing.T) {
+	dir := t.TempDir()
+	files := &fileOptions{uid: -1, gid: -1, fileMode: defaultFileMode}
+	secret := bytes.Repeat([]byte("s"), 40*1024)
+	if err := files.writeFile(dir, "secret", secret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wipeDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != len(secret) || !bytes.Equal(content, make([]byte, len(secret))) {
+		t.Errorf("expected the file to be overwritten with zeros")
+	}
+}
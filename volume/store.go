@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultStateDB    = "/var/lib/rancher/secrets-bridge-v2/state.json"
+	defaultRenewalDir = "/run/secrets-bridge-v2/renewal"
+
+	// Statfs types of the filesystems the renewal dir may be on.
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// Volume lifecycle states recorded in the state store.
+const (
+	volumeCreated   = "created"
+	volumeAttached  = "attached"
+	volumeMounted   = "mounted"
+	volumeUnmounted = "unmounted"
+	volumeDetached  = "detached"
+)
+
+var volumeStore = newStateStore(getStateDBPath(), getRenewalDir())
+
+// volumeRecord is what the host knows about a volume. It lives outside the
+// volume so the accessor and leases can still be revoked once the tmpfs is
+// gone.
+type volumeRecord struct {
+	Name         string   `json:"name"`
+	Path         string   `json:"path"`
+	State        string   `json:"state"`
+	Accessor     string   `json:"accessor,omitempty"`
+	Leases       []string `json:"leases,omitempty"`
+	Certificates []string `json:"certificates,omitempty"`
+	Mounts       []string `json:"mounts,omitempty"`
+	// Renewal is what the renew daemon needs to refresh the volume, it
+	// holds the client token and other secrets so it is kept in the
+	// renewal dir, not the state file. RenewError is why it gave up.
+	Renewal    *volumeState `json:"-"`
+	RenewError string       `json:"renewError,omitempty"`
+	// Docker is set for volumes created through the Docker plugin.
+	Docker   *dockerVolume `json:"docker,omitempty"`
+	Created  time.Time     `json:"created"`
+	Attached time.Time     `json:"attached,omitempty"`
+	Updated  time.Time     `json:"updated"`
+}
+
+// stateStore keeps the volume records of the host in a single JSON file.
+// Every driver call is a separate process, so access is serialized with a
+// lock file and changes are written to a temporary file and renamed into
+// place. The state file only holds what is needed to revoke the secrets,
+// the renewal state of each volume is a separate file in renewalDir, which
+// must be in memory so the secrets never reach the disk.
+type stateStore struct {
+	path       string
+	renewalDir string
+	// checkRenewalDir fails if renewalDir is not in memory.
+	checkRenewalDir func(dir string) error
+}
+
+func newStateStore(path, renewalDir string) *stateStore {
+	return &stateStore{
+		path:            path,
+		renewalDir:      renewalDir,
+		checkRenewalDir: checkMemoryDir,
+	}
+}
+
+func getStateDBPath() string {
+	if envPath := os.Getenv("VAULT_DRIVER_STATE_DB"); envPath != "" {
+		return envPath
+	}
+	return defaultStateDB
+}
+
+func getRenewalDir() string {
+	if envPath := os.Getenv("VAULT_DRIVER_RENEWAL_DIR"); envPath != "" {
+		return envPath
+	}
+	return defaultRenewalDir
+}
+
+// view calls fn with the records, keyed by volume path, under a shared lock.
+func (s *stateStore) view(fn func(volumes map[string]*volumeRecord) error) error {
+	unlock, err := s.lock(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	volumes, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	return fn(volumes)
+}
+
+// update calls fn with the records under an exclusive lock and saves them if
+// fn succeeds.
+func (s *stateStore) update(fn func(volumes map[string]*volumeRecord) error) error {
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	volumes, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(volumes); err != nil {
+		return err
+	}
+
+	return s.write(volumes)
+}
+
+// get returns a copy of the record of the volume at volPath, nil if there is
+// none.
+func (s *stateStore) get(volPath string) (*volumeRecord, error) {
+	var record *volumeRecord
+	err := s.view(func(volumes map[string]*volumeRecord) error {
+		if r, ok := volumes[volPath]; ok {
+			copied := *r
+			record = &copied
+		}
+		return nil
+	})
+	return record, err
+}
+
+// findMount returns a copy of the record of the volume mounted at dir.
+func (s *stateStore) findMount(dir string) (*volumeRecord, error) {
+	var record *volumeRecord
+	err := s.view(func(volumes map[string]*volumeRecord) error {
+		for _, r := range volumes {
+			if containsString(r.Mounts, dir) {
+				copied := *r
+				record = &copied
+			}
+		}
+		return nil
+	})
+	return record, err
+}
+
+// modify applies fn to the record of the volume at volPath, creating it if
+// needed.
+func (s *stateStore) modify(volPath string, fn func(record *volumeRecord)) error {
+	return s.update(func(volumes map[string]*volumeRecord) error {
+		record, ok := volumes[volPath]
+		if !ok {
+			record = &volumeRecord{
+				Name:    path.Base(volPath),
+				Path:    volPath,
+				Created: time.Now(),
+			}
+			volumes[volPath] = record
+		}
+
+		fn(record)
+		record.Updated = time.Now()
+		return nil
+	})
+}
+
+func (s *stateStore) remove(volPath string) error {
+	return s.update(func(volumes map[string]*volumeRecord) error {
+		delete(volumes, volPath)
+		return nil
+	})
+}
+
+func (s *stateStore) lock(how int) (func(), error) {
+	return lockFile(s.path+".lock", how)
+}
+
+func (s *stateStore) read() (map[string]*volumeRecord, error) {
+	volumes := map[string]*volumeRecord{}
+
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return volumes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &volumes); err != nil {
+			return nil, err
+		}
+	}
+
+	for volPath, record := range volumes {
+		renewal, err := s.readRenewal(volPath)
+		if err != nil {
+			return nil, err
+		}
+		record.Renewal = renewal
+	}
+
+	return volumes, nil
+}
+
+func (s *stateStore) write(volumes map[string]*volumeRecord) error {
+	if err := s.writeRenewals(volumes); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, content)
+}
+
+// renewalPath is the file of the renewal state of the volume at volPath.
+func (s *stateStore) renewalPath(volPath string) string {
+	sum := sha256.Sum256([]byte(volPath))
+	return path.Join(s.renewalDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// readRenewal returns nil if the volume has no renewal state, the renewal
+// dir is lost with a reboot along with the volumes.
+func (s *stateStore) readRenewal(volPath string) (*volumeState, error) {
+	content, err := ioutil.ReadFile(s.renewalPath(volPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &volumeState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("invalid renewal state of: %s: %s", volPath, err)
+	}
+	return state, nil
+}
+
+// writeRenewals saves the renewal state of the volumes that have one and
+// removes every other file from the renewal dir.
+func (s *stateStore) writeRenewals(volumes map[string]*volumeRecord) error {
+	keep := map[string]bool{}
+	for volPath, record := range volumes {
+		if record.Renewal == nil {
+			continue
+		}
+		name := s.renewalPath(volPath)
+		keep[path.Base(name)] = true
+
+		content, err := json.Marshal(record.Renewal)
+		if err != nil {
+			return err
+		}
+
+		if current, err := ioutil.ReadFile(name); err == nil && bytes.Equal(current, content) {
+			continue
+		}
+
+		if err := os.MkdirAll(s.renewalDir, 0700); err != nil {
+			return err
+		}
+		if s.checkRenewalDir != nil {
+			if err := s.checkRenewalDir(s.renewalDir); err != nil {
+				return err
+			}
+		}
+		if err := writeFileAtomic(name, content); err != nil {
+			return err
+		}
+	}
+
+	names, err := ioutil.ReadDir(s.renewalDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range names {
+		if !keep[info.Name()] {
+			if err := os.Remove(path.Join(s.renewalDir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkMemoryDir fails unless dir is on a tmpfs or ramfs.
+func checkMemoryDir(dir string) error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return err
+	}
+
+	switch fs.Type {
+	case tmpfsMagic, ramfsMagic:
+		return nil
+	}
+	return fmt.Errorf("renewal dir: %s must be on a tmpfs, it holds the client tokens", dir)
+}
+
+// lockFile takes a flock on name, creating it and its directory if needed.
+func lockFile(name string, how int) (func(), error) {
+	if err := os.MkdirAll(path.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// writeFileAtomic replaces name with content through a synced temporary
+// file, readers never see a partial write.
+func writeFileAtomic(name string, content []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(values []string, value string) []string {
+	out := []string{}
+	for _, v := range values {
+		if v != value {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// mergeStrings returns the distinct non empty values of both lists.
+func mergeStrings(a, b []string) []string {
+	out := []string{}
+	for _, v := range append(append([]string{}, a...), b...) {
+		if v != "" && !containsString(out, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (r *volumeRecord) clearSecrets() {
+	r.Accessor = ""
+	r.Leases = nil
+	r.Certificates = nil
+	r.Renewal = nil
+	r.RenewError = ""
+}
+
+// volumeSecrets are the credentials issued to a volume that are revoked when
+// it goes away.
+type volumeSecrets struct {
+	accessor     string
+	leases       []string
+	certificates []string
+}
+
+// deviceSecrets reads the secrets from a device string.
+func deviceSecrets(values url.Values) *volumeSecrets {
+	return &volumeSecrets{
+		accessor:     values.Get("accessor"),
+		leases:       values["lease"],
+		certificates: values["certificate"],
+	}
+}
+
+func recordSecrets(record *volumeRecord) *volumeSecrets {
+	if record == nil {
+		return &volumeSecrets{}
+	}
+
+	return &volumeSecrets{
+		accessor:     record.Accessor,
+		leases:       record.Leases,
+		certificates: record.Certificates,
+	}
+}
+
+// merge combines both sets, the accessor of s wins if both have one.
+func (s *volumeSecrets) merge(other *volumeSecrets) *volumeSecrets {
+	merged := &volumeSecrets{
+		accessor:     s.accessor,
+		leases:       mergeStrings(s.leases, other.leases),
+		certificates: mergeStrings(s.certificates, other.certificates),
+	}
+	if merged.accessor == "" {
+		merged.accessor = other.accessor
+	}
+	return merged
+}
+
+// revocations lists the leases, certificates and finally the token.
+func (s *volumeSecrets) revocations() []*revocation {
+	revocations := []*revocation{}
+	for _, leaseID := range s.leases {
+		if leaseID != "" {
+			revocations = append(revocations, &revocation{Kind: revokeLease, ID: leaseID})
+		}
+	}
+
+	for _, id := range s.certificates {
+		if id != "" {
+			revocations = append(revocations, &revocation{Kind: revokeCertificate, ID: id})
+		}
+	}
+
+	if s.accessor != "" {
+		revocations = append(revocations, &revocation{Kind: revokeToken, ID: s.accessor})
+	}
+
+	return revocations
+}
+
+// revoke revokes the leases, certificates and finally the token. Everything
+// is tried, what fails is queued to be retried later so the volume can still
+// be torn down. An error is only returned if the queue can not be written.
+func (s *volumeSecrets) revoke() error {
+	failed := []*revocation{}
+	for _, r := range s.revocations() {
+		if err := revocationQueue.revoke(r); err != nil {
+			logrus.Errorf("failed to revoke %s: %s got: %s. queued for retry.", r.Kind, r.ID, err)
+			failed = append(failed, r)
+		}
+	}
+
+	return revocationQueue.add(failed, time.Now())
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "volume-state")
+	if err != nil {
+		panic(err)
+	}
+	volumeStore = newTestStateStore(dir)
+	revocationQueue = newRevocationStore(path.Join(dir, "revocations.json"))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestStateStore keeps the state and the renewal state in dir, which does
+// not have to be a tmpfs.
+func newTestStateStore(dir string) *stateStore {
+	store := newStateStore(path.Join(dir, "state.json"), path.Join(dir, "renewal"))
+	store.checkRenewalDir = nil
+	return store
+}
+
+func TestStateStore(t *testing.T) {
+	store := newTestStateStore(t.TempDir())
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := store.modify("/volumes/"+name, func(record *volumeRecord) {
+				record.State = volumeAttached
+				record.Accessor = "accessor-" + name
+			}); err != nil {
+				t.Error(err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if err := store.modify("/volumes/b", func(record *volumeRecord) {
+		record.State = volumeMounted
+		record.Mounts = mergeStrings(record.Mounts, []string{"/mnt/b"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.findMount("/mnt/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Name != "b" || record.Accessor != "accessor-b" || record.Created.IsZero() {
+		t.Fatalf("unexpected record: %#v", record)
+	}
+
+	if err := store.remove("/volumes/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.view(func(volumes map[string]*volumeRecord) error {
+		if len(volumes) != 3 {
+			t.Errorf("expected 3 volumes, got: %d", len(volumes))
+		}
+		return nil
+	})
+
+	if record, _ := store.get("/volumes/a"); record != nil {
+		t.Errorf("removed volume is still recorded")
+	}
+}
+
+func TestStateStoreRenewal(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStateStore(dir)
+
+	if err := store.modify("/volumes/a", func(record *volumeRecord) {
+		record.Accessor = "accessor-a"
+		record.Renewal = &volumeState{Token: "client-token", Database: &databaseCreds{Password: "db-password"}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "client-token") || strings.Contains(string(content), "db-password") || !strings.Contains(string(content), "accessor-a") {
+		t.Errorf("expected only the accessor in the state file, got: %s", content)
+	}
+
+	record, err := store.get("/volumes/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Renewal == nil || record.Renewal.Token != "client-token" {
+		t.Fatalf("expected the renewal state to be read back, got: %#v", record.Renewal)
+	}
+
+	if err := store.modify("/volumes/a", func(record *volumeRecord) {
+		record.clearSecrets()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ioutil.ReadDir(path.Join(dir, "renewal")); len(names) != 0 {
+		t.Errorf("expected the renewal state to be removed, got: %d files", len(names))
+	}
+
+	store.checkRenewalDir = func(dir string) error { return fmt.Errorf("not a tmpfs") }
+	if err := store.modify("/volumes/a", func(record *volumeRecord) {
+		record.Renewal = &volumeState{Token: "client-token"}
+	}); err == nil {
+		t.Errorf("expected the renewal state to need a tmpfs")
+	}
+}
+
+func TestVolumeSecretsMerge(t *testing.T) {
+	values, err := getDeviceValues("device=%2Fvolumes%2Fweb&accessor=old&lease=database%2Fcreds%2Fapp%2F1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged := deviceSecrets(values).merge(recordSecrets(&volumeRecord{
+		Accessor: "new",
+		Leases:   []string{"database/creds/app/1", "database/creds/app/2"},
+	}))
+
+	if merged.accessor != "old" || len(merged.leases) != 2 {
+		t.Errorf("unexpected merge: %#v", merged)
+	}
+
+	if merged := deviceSecrets(values).merge(recordSecrets(nil)); merged.accessor != "old" {
+		t.Errorf("device string secrets were lost: %#v", merged)
+	}
+}
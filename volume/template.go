@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// templateSpec describes a text/template that is rendered into the volume.
+type templateSpec struct {
+	// File is the name of the rendered file in the volume.
+	File string `json:"file"`
+	// Template is the inline template content.
+	Template string `json:"template"`
+	// Source is the path of a template file in the templateDir of the
+	// driver config, absolute or relative to it. It is used when Template is
+	// empty.
+	Source string `json:"source"`
+	// Mode is the octal file mode, defaults to the volume fileMode.
+	Mode string `json:"mode"`
+
+	fileMode os.FileMode
+}
+
+// templateSecret is what the secret template function returns, so templates
+// can be written as {{ with secret "secret/myapp" }}{{ .Data.password }}{{ end }}
+type templateSecret struct {
+	LeaseID       string
+	LeaseDuration int
+	Renewable     bool
+	Data          map[string]interface{}
+}
+
+// templateRenderer renders templates against Vault, caching reads so a path
+// referenced more than once is only fetched once per attach.
+type templateRenderer struct {
+	vClient *api.Client
+	cache   map[string]*templateSecret
+}
+
+func getTemplateSpecs(options map[string]interface{}) ([]*templateSpec, error) {
+	specs := []*templateSpec{}
+
+	var specJSON []byte
+	switch templates := options["templates"].(type) {
+	case nil:
+		return specs, nil
+	case string:
+		if templates == "" {
+			return specs, nil
+		}
+		specJSON = []byte(templates)
+	case []interface{}:
+		var err error
+		if specJSON, err = json.Marshal(templates); err != nil {
+			return specs, err
+		}
+	default:
+		return specs, fmt.Errorf("templates option must be a JSON list")
+	}
+
+	if err := json.Unmarshal(specJSON, &specs); err != nil {
+		return specs, fmt.Errorf("could not parse templates option: %s", err)
+	}
+
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return specs, err
+		}
+	}
+
+	return specs, nil
+}
+
+func (t *templateSpec) validate() error {
+	if t.File == "" {
+		return fmt.Errorf("template file name is required")
+	}
+	if err := validateFileName(t.File); err != nil {
+		return err
+	}
+
+	if t.Template == "" {
+		if t.Source == "" {
+			return fmt.Errorf("template: %s needs either template or source set", t.File)
+		}
+
+		content, err := readTemplateSource(t.Source)
+		if err != nil {
+			return fmt.Errorf("template: %s: %s", t.File, err)
+		}
+		t.Template = string(content)
+	}
+
+	// Parse now so syntax errors are reported before a token is requested.
+	if _, err := template.New(t.File).Funcs((&templateRenderer{}).funcMap()).Parse(t.Template); err != nil {
+		return err
+	}
+
+	mode, err := parseFileMode(t.Mode, 0)
+	if err != nil {
+		return fmt.Errorf("template: %s has invalid mode: %s", t.File, err)
+	}
+	t.fileMode = mode
+
+	return nil
+}
+
+// readTemplateSource reads a template file from the templateDir. Sources
+// live on the host, not in the workload image, which is not available while
+// the volume is attached. Whoever sets the volume options must not be able
+// to read other host files, so the source has to resolve, symlinks
+// included, to a regular file inside it.
+func readTemplateSource(source string) ([]byte, error) {
+	if config.TemplateDir == "" {
+		return nil, fmt.Errorf("template sources are disabled, templateDir is not set in the driver config")
+	}
+
+	root, err := filepath.EvalSymlinks(filepath.Clean(config.TemplateDir))
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Clean(source)
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(root, name)
+	}
+
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("source: %s is outside the template directory", source)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("source: %s is not a regular file", source)
+	}
+
+	return ioutil.ReadFile(resolved)
+}
+
+func newTemplateRenderer(vClient *api.Client) *templateRenderer {
+	return &templateRenderer{
+		vClient: vClient,
+		cache:   map[string]*templateSecret{},
+	}
+}
+
+func (r *templateRenderer) funcMap() template.FuncMap {
+	return template.FuncMap{
+		"secret":       r.secret,
+		"key":          r.key,
+		"base64Encode": base64Encode,
+		"base64Decode": base64Decode,
+		"toJSON":       toJSON,
+		"toJSONPretty": toJSONPretty,
+		"trimSpace":    strings.TrimSpace,
+	}
+}
+
+// render executes the template and returns the rendered content.
+func (r *templateRenderer) render(spec *templateSpec) ([]byte, error) {
+	tmpl, err := template.New(spec.File).Funcs(r.funcMap()).Option("missingkey=error").Parse(spec.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, nil); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (r *templateRenderer) secret(secretPath string) (*templateSecret, error) {
+	secretPath = strings.Trim(secretPath, "/")
+	if cached, ok := r.cache[secretPath]; ok {
+		return cached, nil
+	}
+
+	secret, err := r.vClient.Logical().Read(secretPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		return nil, fmt.Errorf("secret: %s not found", secretPath)
+	}
+
+	ts := &templateSecret{
+		LeaseID:       secret.LeaseID,
+		LeaseDuration: secret.LeaseDuration,
+		Renewable:     secret.Renewable,
+		Data:          secret.Data,
+	}
+	r.cache[secretPath] = ts
+
+	return ts, nil
+}
+
+// key returns a single field of a secret as a string. KV version 2 responses
+// are unwrapped, so {{ key "secret/data/myapp" "password" }} works for both.
+func (r *templateRenderer) key(secretPath, field string) (string, error) {
+	secret, err := r.secret(secretPath)
+	if err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, isV2 := data["metadata"]; isV2 {
+			data = nested
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("key: %s not found in secret: %s", field, secretPath)
+	}
+
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+
+	content, err := json.Marshal(value)
+	return string(content), err
+}
+
+func renderTemplates(vClient *api.Client, specs []*templateSpec) ([]*volumeFile, error) {
+	rendered := []*volumeFile{}
+	renderer := newTemplateRenderer(vClient)
+
+	for _, spec := range specs {
+		content, err := renderer.render(spec)
+		if err != nil {
+			return rendered, fmt.Errorf("failed to render template: %s: %s", spec.File, err)
+		}
+
+		rendered = append(rendered, &volumeFile{
+			name:    spec.File,
+			content: content,
+			mode:    spec.fileMode,
+		})
+	}
+
+	return rendered, nil
+}
+
+func base64Encode(value string) string {
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func base64Decode(value string) (string, error) {
+	content, err := base64.StdEncoding.DecodeString(value)
+	return string(content), err
+}
+
+func toJSON(value interface{}) (string, error) {
+	content, err := json.Marshal(value)
+	return string(content), err
+}
+
+func toJSONPretty(value interface{}) (string, error) {
+	content, err := json.MarshalIndent(value, "", "  ")
+	return string(content), err
+}
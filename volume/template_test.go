@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestTemplateRender(t *testing.T) {
+	reads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reads++
+		if req.URL.Path != "/v1/secret/data/myapp" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(rw, `{"data": {"data": {"user": "app", "password": "s3cr3t"}, "metadata": {"version": 1}}}`)
+	}))
+	defer ts.Close()
+
+	config := api.DefaultConfig()
+	config.Address = ts.URL
+	vClient, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &templateSpec{
+		File:     "config.yml",
+		Template: `user: {{ key "secret/data/myapp" "user" }}` + "\n" + `password: {{ key "secret/data/myapp" "password" | base64Encode }}`,
+	}
+	if err := spec.validate(); err != nil {
+		t.Fatalf("template failed to validate: %s", err)
+	}
+
+	content, err := newTemplateRenderer(vClient).render(spec)
+	if err != nil {
+		t.Fatalf("template failed to render: %s", err)
+	}
+
+	expected := "user: app\npassword: czNjcjN0"
+	if string(content) != expected {
+		t.Errorf("expected: %q got: %q", expected, content)
+	}
+
+	if reads != 1 {
+		t.Errorf("expected secret to be read once, got: %d", reads)
+	}
+
+	spec.Template = `{{ key "secret/missing" "user" }}`
+	if _, err := newTemplateRenderer(vClient).render(spec); err == nil {
+		t.Errorf("expected error rendering missing secret")
+	}
+}
+
+func TestTemplateSource(t *testing.T) {
+	defer func(dir string) { config.TemplateDir = dir }(config.TemplateDir)
+
+	dir := t.TempDir()
+	templateDir := path.Join(dir, "templates")
+	if err := os.Mkdir(templateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(templateDir, "app.tmpl"), []byte("user: app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "host.key"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path.Join(dir, "host.key"), path.Join(templateDir, "escape.tmpl")); err != nil {
+		t.Fatal(err)
+	}
+
+	config.TemplateDir = ""
+	if err := (&templateSpec{File: "app.yml", Source: path.Join(templateDir, "app.tmpl")}).validate(); err == nil {
+		t.Errorf("expected sources to be refused without a template directory")
+	}
+
+	config.TemplateDir = templateDir
+	for _, source := range []string{"app.tmpl", path.Join(templateDir, "app.tmpl"), "sub/../app.tmpl"} {
+		spec := &templateSpec{File: "app.yml", Source: source}
+		if err := spec.validate(); err != nil || spec.Template != "user: app" {
+			t.Errorf("expected source: %s to be read, got: %q %v", source, spec.Template, err)
+		}
+	}
+
+	for _, source := range []string{path.Join(dir, "host.key"), "../host.key", "escape.tmpl", "/etc/shadow", "."} {
+		if err := (&templateSpec{File: "app.yml", Source: source}).validate(); err == nil {
+			t.Errorf("expected source: %s to be refused", source)
+		}
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,37 +12,38 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/moby/moby/pkg/mount"
 	"github.com/rancher/go-rancher-metadata/metadata"
-	"github.com/rancher/secrets-api/pkg/rsautils"
 	"github.com/rancher/secrets-bridge-v2/server"
 	"github.com/rancher/secrets-bridge-v2/signature"
 )
 
-const (
-	volRoot        = "/var/lib/rancher/volumes/secrets-bridge-v2"
-	metadataURL    = "http://169.254.169.250/2016-07-29"
-	privateKeyFile = "/var/lib/rancher/etc/ssl/host.key"
-)
-
-var (
-	vaultTokenServerURL = setVaultTokenServerURL()
-)
-
 type FlexVol struct{}
 
-func setVaultTokenServerURL() string {
-	envString := os.Getenv("VAULT_TOKEN_SERVER_URL")
-	if envString == "" {
-		envString = "http://vault-token-server:8080/v1-vault-driver/tokens"
+// Init checks the driver can reach Vault and collects volumes leaked by host
+// crashes or failed unmounts. A failed collection must not keep the driver
+// from loading.
+func (v *FlexVol) Init() error {
+	if err := config.checkVaultAddr(); err != nil {
+		return err
 	}
 
-	return envString
-}
+	retryDueRevocations()
 
-func (v *FlexVol) Init() error {
+	results, err := newCollector(false).run()
+	if err != nil {
+		logrus.Errorf("garbage collection failed: %s", err)
+		return nil
+	}
+
+	for _, result := range results {
+		if result.action != gcKept {
+			logrus.Infof("garbage collection: %s %s: %s", result.path, result.action, result.reason)
+		}
+	}
 	return nil
 }
 
@@ -50,9 +52,16 @@ func (v *FlexVol) Create(options map[string]interface{}) (map[string]interface{}
 	resp := options
 
 	if name, ok := options["name"].(string); ok {
-		volPath := path.Join(volRoot, name)
+		volPath := path.Join(config.VolumeRoot, name)
 		logrus.Debugf("volume path is: %s", volPath)
 
+		if err := volumeStore.modify(volPath, func(record *volumeRecord) {
+			record.Name = name
+			record.State = volumeCreated
+		}); err != nil {
+			logrus.Errorf("failed to record volume: %s", err)
+		}
+
 		resp["device"] = newDeviceString(volPath)
 		return resp, nil
 	}
@@ -62,10 +71,34 @@ func (v *FlexVol) Create(options map[string]interface{}) (map[string]interface{}
 
 func (v *FlexVol) Delete(options map[string]interface{}) error {
 	logrus.Infof("%#v", options)
-	if device, ok := options["device"].(string); ok {
-		return v.Detach(device)
+	device, ok := options["device"].(string)
+	if !ok {
+		return nil
 	}
-	return nil
+
+	values, err := getDeviceValues(device)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockVolume(values.Get("device"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, err := volumeStore.get(values.Get("device"))
+	if err != nil {
+		logrus.Errorf("failed to read volume state: %s", err)
+	}
+
+	if record == nil || record.State != volumeDetached {
+		if err := v.detach(values); err != nil {
+			return err
+		}
+	}
+
+	return volumeStore.remove(values.Get("device"))
 }
 
 func (v *FlexVol) Attach(options map[string]interface{}) (string, error) {
@@ -79,18 +112,37 @@ func (v *FlexVol) Attach(options map[string]interface{}) (string, error) {
 		return dev, fmt.Errorf("could not find device key in options")
 	}
 
+	retryDueRevocations()
+
 	devValues, err := getDeviceValues(dev)
 	if err != nil {
 		return dev, err
 	}
 
-	// Revoke if there was a previous accessor on the volume
-	accessor := devValues.Get("accessor")
-	if accessor != "" {
-		makeTokenRevokeRequest(accessor)
+	unlock, err := lockVolume(devValues.Get("device"))
+	if err != nil {
+		return dev, err
 	}
+	defer unlock()
 
-	host, err := getHostMetadata()
+	record, err := volumeStore.get(devValues.Get("device"))
+	if err != nil {
+		logrus.Errorf("failed to read volume state: %s", err)
+	}
+
+	// A repeated attach of a volume that is still healthy keeps its token.
+	if attachedDevice := healthyDevice(devValues.Get("device"), record); attachedDevice != "" {
+		logrus.Infof("volume: %s is already attached", devValues.Get("device"))
+		return attachedDevice, nil
+	}
+
+	// Revoke if there was a previous accessor on the volume
+	previous := deviceSecrets(devValues)
+	previous.merge(recordSecrets(record)).revoke()
+	devValues.Del("lease")
+	devValues.Del("certificate")
+
+	hostUUID, err := config.hostIdentity.HostUUID()
 	if err != nil {
 		return dev, err
 	}
@@ -100,31 +152,148 @@ func (v *FlexVol) Attach(options map[string]interface{}) (string, error) {
 		return dev, fmt.Errorf("no policies were passed in driver opts, can not create token")
 	}
 
+	// The role is a host setting, a volume can not choose what it trusts.
+	if _, ok := options["vaultRole"]; ok {
+		return dev, fmt.Errorf("option: vaultRole is not supported, the role is set in the driver config")
+	}
+
+	content, err := getVolumeContent(options)
+	if err != nil {
+		return dev, err
+	}
+
+	// Reading secrets consumes the wrapping token, so the unwrapped client
+	// token is what ends up in the volume.
+	unwrap, err := getBoolOption(options, "unwrap")
+	if err != nil {
+		return dev, err
+	}
+	unwrap = unwrap || !content.empty()
+
 	req := &server.VaultTokenInput{
 		Policies:   policies,
-		HostUUID:   host.UUID,
+		HostUUID:   hostUUID,
 		VolumeName: name,
 	}
+	req.PodName, _ = options[kubePodName].(string)
+	req.PodNamespace, _ = options[kubePodNamespace].(string)
+	req.ServiceAccount, _ = options[kubeServiceAccount].(string)
+
+	// Token servers refuse pod fields from Rancher hosts, they can not be
+	// verified.
+	if (req.PodName != "" || req.PodNamespace != "" || req.ServiceAccount != "") && config.hostIdentity.Provider() == server.IdentityRancher {
+		return dev, fmt.Errorf("pod volumes need a %s or %s host identity", server.IdentityStatic, server.IdentityCloud)
+	}
+
+	decryptionKey, err := tokenDecryptionKey(req)
+	if err != nil {
+		return dev, err
+	}
 
 	token, err := makeTokenRequest(req)
 	if err != nil {
 		return dev, err
 	}
 
-	err = createTmpfs(devValues.Get("device"), options)
+	clientToken, err := decryptToken(decryptionKey, token.EncryptedToken)
 	if err != nil {
+		logrus.Errorf("failed to decrypt token: %s. calling revoke.", err)
+		issuedSecrets(token, nil).revoke()
 		return dev, err
 	}
 
-	err = writeToken(token.EncryptedToken, options)
+	// Make sure the token came from the expected role before it is written
+	// anywhere.
+	if config.SkipProvenanceCheck {
+		logrus.Warnf("skipping token provenance check for volume: %s", name)
+	} else if err := verifyWrappingToken(clientToken, config.VaultRole); err != nil {
+		logrus.Errorf("failed to verify token: %s. calling revoke.", err)
+		issuedSecrets(token, nil).revoke()
+		return dev, fmt.Errorf("refusing to attach, token provenance check failed: %s", err)
+	}
+
+	err = createTmpfs(devValues.Get("device"), content.files)
+	if err != nil {
+		issuedSecrets(token, nil).revoke()
+		return dev, err
+	}
+
+	if unwrap {
+		clientToken, err = unwrapToken(clientToken)
+		if err != nil {
+			logrus.Errorf("failed to unwrap token: %s. calling revoke.", err)
+			cleanupTmpfs(devValues.Get("device"))
+			issuedSecrets(token, nil).revoke()
+			return dev, err
+		}
+	}
+
+	creds := &credentials{token: clientToken}
+	if !content.empty() {
+		vClient, err := newVaultClient(clientToken)
+		if err == nil {
+			err = content.read(vClient, creds)
+		}
+		if err != nil {
+			logrus.Errorf("failed to read secrets: %s for volume. calling revoke.", err)
+			cleanupTmpfs(devValues.Get("device"))
+			issuedSecrets(token, creds).revoke()
+			return dev, err
+		}
+	}
+
+	// The token server only revokes secrets for the host they were
+	// registered to.
+	if err := registerSecrets(creds); err != nil {
+		logrus.Errorf("failed to register secrets: %s. calling revoke.", err)
+		cleanupTmpfs(devValues.Get("device"))
+		issuedSecrets(token, creds).revoke()
+		return dev, err
+	}
+
+	err = content.write(creds, devValues.Get("device"))
 	if err != nil {
 		logrus.Errorf("failed to write token: %s to volume. calling revoke.", err)
-		makeTokenRevokeRequest(token.Accessor)
+		cleanupTmpfs(devValues.Get("device"))
+		issuedSecrets(token, creds).revoke()
 		return dev, err
 	}
 
+	for _, lease := range creds.leaseIDs() {
+		devValues.Add("lease", lease)
+	}
+
+	for _, certificate := range creds.certificateIDs() {
+		devValues.Add("certificate", certificate)
+	}
+
+	// Only client tokens can be renewed.
+	var renewState *volumeState
+	if unwrap {
+		renewState = &volumeState{
+			Token:       clientToken,
+			Options:     contentOptions(options),
+			Database:    creds.database,
+			Certificate: creds.certificate,
+		}
+	}
+
 	devValues.Set("accessor", token.Accessor)
 
+	if err := volumeStore.modify(devValues.Get("device"), func(record *volumeRecord) {
+		record.Name = name
+		record.State = volumeAttached
+		record.Accessor = token.Accessor
+		record.Leases = creds.leaseIDs()
+		record.Certificates = creds.certificateIDs()
+		record.Mounts = nil
+		record.Renewal = renewState
+		record.RenewError = ""
+		record.Attached = time.Now()
+	}); err != nil {
+		logrus.Errorf("failed to record volume: %s", err)
+	}
+
 	err = writeAccessor(token.Accessor, devValues.Get("device"))
 	return devValues.Encode(), err
 }
@@ -137,16 +306,51 @@ func (v *FlexVol) Detach(device string) error {
 		return err
 	}
 
-	if err := mount.Unmount(values.Get("device")); err != nil {
+	unlock, err := lockVolume(values.Get("device"))
+	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	return v.detach(values)
+}
+
+// detach revokes and removes the volume, the caller holds its lock.
+func (v *FlexVol) detach(values url.Values) error {
+	volPath := values.Get("device")
 
-	err = makeTokenRevokeRequest(values.Get("accessor"))
+	record, err := volumeStore.get(volPath)
 	if err != nil {
+		logrus.Errorf("failed to read volume state: %s", err)
+	}
+
+	// Like cleanupTmpfs, the secrets are overwritten before the memory of
+	// the volume is handed back, but a failed unmount fails the detach.
+	if err := wipeDir(volPath); err != nil {
+		logrus.Errorf("failed to wipe: %s got: %s", volPath, err)
+	}
+
+	if err := mount.Unmount(volPath); err != nil {
+		return err
+	}
+
+	// The renew daemon replaces certificates, the current ones are in the
+	// record.
+	secrets := deviceSecrets(values).merge(recordSecrets(record))
+	if err := secrets.revoke(); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(values.Get("device"))
+	if record != nil {
+		if err := volumeStore.modify(volPath, func(record *volumeRecord) {
+			record.State = volumeDetached
+			record.clearSecrets()
+		}); err != nil {
+			logrus.Errorf("failed to record volume: %s", err)
+		}
+	}
+
+	return os.RemoveAll(volPath)
 }
 
 func (v *FlexVol) Mount(dir string, device string, params map[string]interface{}) error {
@@ -155,117 +359,311 @@ func (v *FlexVol) Mount(dir string, device string, params map[string]interface{}
 	if err != nil {
 		return err
 	}
-	return mount.Mount(values.Get("device"), dir, "none", "bind,rw")
+
+	unlock, err := lockVolume(values.Get("device"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if mounted, err := mount.Mounted(dir); err != nil {
+		return err
+	} else if !mounted {
+		if err := mount.Mount(values.Get("device"), dir, "none", "bind,rw"); err != nil {
+			return err
+		}
+		if err := protectRamfs(values.Get("device"), dir); err != nil {
+			logrus.Errorf("failed to remount read only: %s got: %s", dir, err)
+			mount.Unmount(dir)
+			return err
+		}
+	}
+
+	if err := volumeStore.modify(values.Get("device"), func(record *volumeRecord) {
+		record.State = volumeMounted
+		record.Mounts = mergeStrings(record.Mounts, []string{dir})
+	}); err != nil {
+		logrus.Errorf("failed to record volume: %s", err)
+	}
+
+	return nil
 }
 
 func (v *FlexVol) Unmount(dir string) error {
 	logrus.Debugf("Dir: %s", dir)
 
-	accessorFile := path.Join(dir, ".accessor")
-	if _, err := os.Stat(accessorFile); err == nil {
-		accessorBytes, err := ioutil.ReadFile(accessorFile)
+	record, err := volumeStore.findMount(dir)
+	if err != nil {
+		logrus.Errorf("failed to read volume state: %s", err)
+	}
+
+	volPath := mountedVolume(dir)
+	if record != nil {
+		volPath = record.Path
+	}
+	if volPath != "" {
+		unlock, err := lockVolume(volPath)
 		if err != nil {
 			return err
 		}
+		defer unlock()
 
-		if err = makeTokenRevokeRequest(string(accessorBytes)); err != nil {
-			return err
+		// Another operation may have changed the volume while waiting.
+		if record, err = volumeStore.findMount(dir); err != nil {
+			logrus.Errorf("failed to read volume state: %s", err)
 		}
 	}
 
-	return mount.Unmount(dir)
+	// Only the state store is trusted, the workload can write to the volume.
+	if err := recordSecrets(record).revoke(); err != nil {
+		return err
+	}
+
+	if err := mount.Unmount(dir); err != nil {
+		return err
+	}
+
+	if record != nil {
+		if err := volumeStore.modify(record.Path, func(record *volumeRecord) {
+			record.State = volumeUnmounted
+			record.Mounts = removeString(record.Mounts, dir)
+			record.clearSecrets()
+		}); err != nil {
+			logrus.Errorf("failed to record volume: %s", err)
+		}
+	}
+
+	return nil
 }
 
-func createTmpfs(dir string, options map[string]interface{}) error {
+// healthyDevice returns the device of a volume that is attached, still
+// mounted and holds the token it was attached with. Empty if the volume has
+// to be attached again.
+func healthyDevice(volPath string, record *volumeRecord) string {
+	if record == nil || record.Accessor == "" {
+		return ""
+	}
+	if record.State != volumeAttached && record.State != volumeMounted {
+		return ""
+	}
+
+	if mounted, err := mount.Mounted(volPath); err != nil || !mounted {
+		return ""
+	}
+
+	accessor, err := ioutil.ReadFile(path.Join(volPath, ".accessor"))
+	if err != nil || string(accessor) != record.Accessor {
+		return ""
+	}
+
+	// The renew daemon gave up on the token.
+	if record.RenewError != "" {
+		return ""
+	}
+
+	return recordDevice(volPath, record)
+}
+
+// recordDevice is the device string of the volume at volPath with the
+// secrets of its record.
+func recordDevice(volPath string, record *volumeRecord) string {
+	values := url.Values{}
+	values.Set("device", volPath)
+	if record.Accessor != "" {
+		values.Set("accessor", record.Accessor)
+	}
+	for _, lease := range record.Leases {
+		values.Add("lease", lease)
+	}
+	for _, certificate := range record.Certificates {
+		values.Add("certificate", certificate)
+	}
+	return values.Encode()
+}
+
+// issuedSecrets are the secrets handed out during a failed attach.
+func issuedSecrets(token *server.VaultIntermediateTokenResponse, creds *credentials) *volumeSecrets {
+	secrets := &volumeSecrets{accessor: token.Accessor}
+	if creds != nil {
+		secrets.leases = creds.leaseIDs()
+		secrets.certificates = creds.certificateIDs()
+	}
+	return secrets
+}
+
+// removeVolume removes the tmpfs and the record of a volume that is never
+// detached, Kubernetes and CSI volumes only live as long as their mount.
+func removeVolume(volPath string) {
+	unlock, err := lockVolume(volPath)
+	if err != nil {
+		logrus.Errorf("failed to remove volume: %s", err)
+		return
+	}
+	defer unlock()
+
+	cleanupTmpfs(volPath)
+
+	if err := volumeStore.remove(volPath); err != nil {
+		logrus.Errorf("failed to remove volume record: %s", err)
+	}
+}
+
+// createTmpfs mounts the in-memory filesystem of the volume at dir, a tmpfs
+// or ramfs depending on the storage option.
+func createTmpfs(dir string, files *fileOptions) error {
+	// A volume that is attached again still has the tmpfs of the previous
+	// attach, with files the workload could have replaced. It is wiped and
+	// mounted fresh, never written into.
 	mounted, err := mount.Mounted(dir)
-	if mounted || err != nil {
+	if err != nil {
 		return err
 	}
-	mode := int(0755)
-	mountOpts := "size=10m"
+	if mounted {
+		logrus.Infof("replacing the existing mount of: %s", dir)
+		cleanupTmpfs(dir)
+		if mounted, err := mount.Mounted(dir); err != nil || mounted {
+			return fmt.Errorf("refusing to attach onto the existing mount of: %s", dir)
+		}
+	}
 
-	if uMode, ok := options["mode"].(int); ok {
-		mode = int(uMode)
+	if err := files.storage.lockMemory(); err != nil {
+		return err
 	}
 
-	if mOpts, ok := options["mountOpts"].(string); ok {
-		mountOpts = mOpts
+	if err := os.MkdirAll(dir, os.FileMode(defaultDirMode)); err != nil {
+		return err
 	}
 
-	if err := os.MkdirAll(dir, os.FileMode(mode)); err != nil {
+	if err := mount.Mount(files.storage.fstype(), dir, files.storage.fstype(), files.mountOpts()); err != nil {
 		return err
 	}
 
-	return mount.Mount("tmpfs", dir, "tmpfs", mountOpts)
+	return files.setupDir(dir)
 }
 
-func makeTokenRevokeRequest(accessor string) error {
-	client := &http.Client{}
-	vtei := &server.VaultTokenExpireInput{
-		Accessor: accessor,
+// cleanupTmpfs overwrites the files of the volume before it is unmounted and
+// removed.
+func cleanupTmpfs(dir string) {
+	if err := wipeDir(dir); err != nil {
+		logrus.Errorf("failed to wipe: %s got: %s", dir, err)
 	}
 
-	host, err := getHostMetadata()
-	if err != nil {
-		return err
+	if err := mount.Unmount(dir); err != nil {
+		logrus.Errorf("failed to unmount: %s got: %s", dir, err)
 	}
 
-	vtei.HostUUID = host.UUID
+	if err := os.RemoveAll(dir); err != nil {
+		logrus.Errorf("failed to remove: %s got: %s", dir, err)
+	}
+}
 
-	signature, err := getSignature(vtei)
+func makeTokenRevokeRequest(accessor string) error {
+	hostUUID, err := config.hostIdentity.HostUUID()
 	if err != nil {
 		return err
 	}
 
-	vteiJSON, err := json.Marshal(vtei)
+	return makeSignedRevokeRequest("tokens", &server.VaultTokenExpireInput{
+		Accessor: accessor,
+		HostUUID: hostUUID,
+	})
+}
+
+func makeLeaseRevokeRequest(leaseID string) error {
+	hostUUID, err := config.hostIdentity.HostUUID()
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("DELETE", vaultTokenServerURL, bytes.NewBuffer(vteiJSON))
-	req.Header.Set(server.SignatureHeaderString, signature)
+	return makeSignedRevokeRequest("leases", &server.VaultLeaseRevokeInput{
+		LeaseID:  leaseID,
+		HostUUID: hostUUID,
+	})
+}
+
+// registerSecrets tells the token server the leases and certificates were
+// issued to this host.
+func registerSecrets(creds *credentials) error {
+	for _, lease := range creds.leaseIDs() {
+		if err := makeSecretRegisterRequest(server.SecretLease, lease); err != nil {
+			return err
+		}
+	}
+	for _, certificate := range creds.certificateIDs() {
+		if err := makeSecretRegisterRequest(server.SecretCertificate, certificate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func makeSecretRegisterRequest(kind, id string) error {
+	hostUUID, err := config.hostIdentity.HostUUID()
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doTokenServerRequest("POST", "secrets", &server.VaultSecretRegisterInput{
+		Kind:     kind,
+		ID:       id,
+		HostUUID: hostUUID,
+	})
 	if err != nil {
 		return err
 	}
+	defer closeResponse(resp)
 
-	// StatusBadRequest is returned if the vault client is already expired.
-	if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusBadRequest {
-		return nil
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("registering %s: %s received status code: %d msg: %s", kind, id, resp.StatusCode, body)
 	}
-
-	return fmt.Errorf("request status was not accepted")
+	return nil
 }
 
-func makeTokenRequest(tokenBody *server.VaultTokenInput) (*server.VaultIntermediateTokenResponse, error) {
-	tokenResp := &server.VaultIntermediateTokenResponse{}
-	client := &http.Client{}
-
-	signature, err := getSignature(tokenBody)
+func makeCertificateRevokeRequest(mount, serialNumber string) error {
+	hostUUID, err := config.hostIdentity.HostUUID()
 	if err != nil {
-		return tokenResp, err
+		return err
 	}
 
-	tokenJSON, err := json.Marshal(tokenBody)
+	return makeSignedRevokeRequest("certificates", &server.VaultCertificateRevokeInput{
+		Mount:        mount,
+		SerialNumber: serialNumber,
+		HostUUID:     hostUUID,
+	})
+}
+
+// makeSignedRevokeRequest sends a signed DELETE request to endpoint of the
+// token servers.
+func makeSignedRevokeRequest(endpoint string, msg signature.Message) error {
+	resp, err := doTokenServerRequest("DELETE", endpoint, msg)
 	if err != nil {
-		return tokenResp, err
+		return err
 	}
+	defer closeResponse(resp)
 
-	req, err := http.NewRequest("POST", vaultTokenServerURL, bytes.NewBuffer(tokenJSON))
-	req.Header.Set(server.SignatureHeaderString, signature)
-	if err != nil {
-		return tokenResp, err
+	if resp.StatusCode == http.StatusAccepted {
+		return nil
+	}
+
+	// A client error means the secret is already expired or revoked,
+	// retrying can not change the answer.
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		logrus.Infof("revoke request status was: %d, treating the secret as gone", resp.StatusCode)
+		return nil
 	}
 
-	resp, err := client.Do(req)
+	return fmt.Errorf("revoke request status was: %d", resp.StatusCode)
+}
+
+func makeTokenRequest(tokenBody *server.VaultTokenInput) (*server.VaultIntermediateTokenResponse, error) {
+	tokenResp := &server.VaultIntermediateTokenResponse{}
+
+	resp, err := doTokenServerRequest("POST", "tokens", tokenBody)
 	if err != nil {
 		return tokenResp, err
 	}
-	defer resp.Body.Close()
+	defer closeResponse(resp)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := ioutil.ReadAll(resp.Body)
@@ -279,12 +677,7 @@ func makeTokenRequest(tokenBody *server.VaultTokenInput) (*server.VaultIntermedi
 }
 
 func getSignature(tokenBody signature.Message) (string, error) {
-	content, err := ioutil.ReadFile(privateKeyFile)
-	if err != nil {
-		return "", err
-	}
-
-	key, err := signature.LoadPrivateKeyFromString(string(content))
+	key, err := hostKey.get(config.PrivateKeyFile)
 	if err != nil {
 		return "", err
 	}
@@ -293,42 +686,59 @@ func getSignature(tokenBody signature.Message) (string, error) {
 	return base64.StdEncoding.EncodeToString(signature), err
 }
 
-func getHostMetadata() (metadata.Host, error) {
-	client, err := metadata.NewClientAndWait(metadataURL)
+// getSignatureV2 signs the message for a request of method to path, the
+// encoded signature header and the signature are returned.
+func getSignatureV2(msg signature.CanonicalMessage, method, path string) (string, string, error) {
+	key, err := hostKey.get(config.PrivateKeyFile)
 	if err != nil {
-		return metadata.Host{}, err
+		return "", "", err
 	}
 
-	return client.GetSelfHost()
+	algorithm := config.SignatureAlgorithm
+	if algorithm == "" {
+		if algorithm, err = signature.DefaultAlgorithm(key.Public()); err != nil {
+			return "", "", err
+		}
+	}
+
+	params, sig, err := signature.SignV2WithAlgorithm(msg, method, path, key, algorithm)
+	return params, base64.StdEncoding.EncodeToString(sig), err
 }
 
-func writeToken(token string, options map[string]interface{}) error {
-	devPath, ok := options["device"].(string)
-	if !ok {
-		return fmt.Errorf("could not find key: %s in options", "device")
-	}
-	values, err := getDeviceValues(devPath)
-	if err != nil {
-		return err
-	}
-	fullPath := path.Join(values.Get("device"), "token")
+func getHostMetadata() (metadata.Host, error) {
+	return hostMetadata.get(config.MetadataURL)
+}
 
-	decryptor, err := rsautils.NewRSADecryptorKeyFromFile(privateKeyFile)
+// tokenDecryptionKey returns the key the token server encrypts the token of
+// req to. RSA host keys decrypt it themselves, other host keys only sign, a
+// new encryption key is sent with the request for them.
+func tokenDecryptionKey(req *server.VaultTokenInput) (crypto.PrivateKey, error) {
+	key, err := hostKey.get(config.PrivateKeyFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return key, nil
 	}
 
-	tokenBytes, err := decryptor.Decrypt(token)
+	encryptionKey, err := signature.NewEncryptionKey()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	req.EncryptionKey = signature.EncodeEncryptionKey(encryptionKey.PublicKey())
+	return encryptionKey, nil
+}
 
-	return ioutil.WriteFile(fullPath, tokenBytes, os.FileMode(0644))
+// decryptToken reverses the encryption of the token by the token server.
+func decryptToken(key crypto.PrivateKey, token string) (string, error) {
+	tokenBytes, err := signature.Decrypt(key, token)
+	return string(tokenBytes), err
 }
 
+// writeAccessor keeps the accessor readable by root only, the workload has
+// no use for it.
 func writeAccessor(accessor, devPath string) error {
-	fullPath := path.Join(devPath, ".accessor")
-	return ioutil.WriteFile(fullPath, []byte(accessor), os.FileMode(0644))
+	return writePrivateFile(devPath, ".accessor", []byte(accessor))
 }
 
 func newDeviceString(device string) string {
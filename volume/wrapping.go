@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	tokenCreatePath = "auth/token/create"
+)
+
+// wrapInfo is the response of sys/wrapping/lookup.
+type wrapInfo struct {
+	CreationPath string
+	CreationTime time.Time
+	CreationTTL  time.Duration
+}
+
+// verifyWrappingToken checks that the wrapping token was created by the
+// token create endpoint, for role if it is set, and has not expired.
+func verifyWrappingToken(wrappingToken, role string) error {
+	info, err := lookupWrappingToken(wrappingToken)
+	if err != nil {
+		return err
+	}
+
+	if role != "" {
+		if expected := path.Join(tokenCreatePath, role); info.CreationPath != expected {
+			return fmt.Errorf("wrapping token was created by: %s, expected: %s", info.CreationPath, expected)
+		}
+	} else if info.CreationPath != tokenCreatePath && !strings.HasPrefix(info.CreationPath, tokenCreatePath+"/") {
+		return fmt.Errorf("wrapping token was created by: %s, not by: %s", info.CreationPath, tokenCreatePath)
+	}
+
+	if expires := info.CreationTime.Add(info.CreationTTL); time.Now().After(expires) {
+		return fmt.Errorf("wrapping token expired at: %s", expires)
+	}
+
+	return nil
+}
+
+// lookupWrappingToken reads the wrapping token properties without consuming
+// it.
+func lookupWrappingToken(wrappingToken string) (*wrapInfo, error) {
+	info := &wrapInfo{}
+
+	client, err := newVaultClient("")
+	if err != nil {
+		return info, err
+	}
+	client.ClearToken()
+
+	secret, err := client.Logical().Write("sys/wrapping/lookup", map[string]interface{}{
+		"token": wrappingToken,
+	})
+	if err != nil {
+		return info, err
+	}
+
+	if secret == nil || secret.Data == nil {
+		return info, fmt.Errorf("wrapping token lookup returned no data")
+	}
+
+	info.CreationPath, _ = secret.Data["creation_path"].(string)
+
+	creationTime, _ := secret.Data["creation_time"].(string)
+	if info.CreationTime, err = time.Parse(time.RFC3339Nano, creationTime); err != nil {
+		return info, fmt.Errorf("invalid wrapping token creation time: %s", err)
+	}
+
+	ttl, err := strconv.ParseInt(fmt.Sprint(secret.Data["creation_ttl"]), 10, 64)
+	if err != nil {
+		return info, fmt.Errorf("invalid wrapping token creation ttl: %s", err)
+	}
+	info.CreationTTL = time.Duration(ttl) * time.Second
+
+	logrus.Debugf("wrapping token created by: %s at: %s ttl: %s", info.CreationPath, info.CreationTime, info.CreationTTL)
+	return info, nil
+}
+
+// unwrapToken exchanges a response wrapping token for the client token.
+func unwrapToken(wrappingToken string) (string, error) {
+	client, err := newVaultClient(wrappingToken)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.Logical().Unwrap("")
+	if err != nil {
+		return "", err
+	}
+
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("unwrapping did not return a client token")
+	}
+
+	return secret.Auth.ClientToken, nil
+}
+
+// getBoolOption reads a boolean driver option, which Rancher passes as a
+// string.
+func getBoolOption(options map[string]interface{}, key string) (bool, error) {
+	switch value := options[key].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return value, nil
+	case string:
+		if value == "" {
+			return false, nil
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("option: %s must be true or false", key)
+		}
+		return parsed, nil
+	default:
+		return false, fmt.Errorf("option: %s must be true or false", key)
+	}
+}
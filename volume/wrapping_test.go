@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newFakeWrappingServer(creationPath string, created time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/sys/wrapping/lookup":
+			fmt.Fprintf(rw, `{"data": {"creation_path": %q, "creation_time": %q, "creation_ttl": 300}}`,
+				creationPath, created.Format(time.RFC3339Nano))
+		case "/v1/sys/wrapping/unwrap":
+			fmt.Fprint(rw, `{"auth": {"client_token": "client-token", "accessor": "accessor"}}`)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVerifyWrappingToken(t *testing.T) {
+	defer func(addr string) { config.VaultAddr = addr }(config.VaultAddr)
+
+	ts := newFakeWrappingServer("auth/token/create/vault-driver", time.Now())
+	defer ts.Close()
+	config.VaultAddr = ts.URL
+
+	if err := verifyWrappingToken("wrapping-token", "vault-driver"); err != nil {
+		t.Errorf("wrapping token failed to verify: %s", err)
+	}
+
+	if err := verifyWrappingToken("wrapping-token", "other-role"); err == nil {
+		t.Errorf("expected wrapping token from another role to be rejected")
+	}
+
+	token, err := unwrapToken("wrapping-token")
+	if err != nil || token != "client-token" {
+		t.Errorf("unexpected unwrap result: %s %s", token, err)
+	}
+}
+
+func TestVerifyWrappingTokenRejected(t *testing.T) {
+	defer func(addr string) { config.VaultAddr = addr }(config.VaultAddr)
+
+	for _, ts := range []*httptest.Server{
+		newFakeWrappingServer("secret/data/foo", time.Now()),
+		newFakeWrappingServer("auth/token/create-orphan", time.Now()),
+		newFakeWrappingServer("auth/token/create/vault-driver", time.Now().Add(-time.Hour)),
+	} {
+		config.VaultAddr = ts.URL
+		if err := verifyWrappingToken("wrapping-token", ""); err == nil {
+			t.Errorf("expected wrapping token to be rejected")
+		}
+		ts.Close()
+	}
+}